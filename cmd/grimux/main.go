@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 
+	"github.com/glo0ml34f/grimux/internal/eval"
+	"github.com/glo0ml34f/grimux/internal/openai"
 	"github.com/glo0ml34f/grimux/internal/plugin"
 	"github.com/glo0ml34f/grimux/internal/repl"
 )
@@ -18,6 +22,8 @@ func main() {
 	serious := flag.Bool("serious", false, "start in serious mode")
 	audit := flag.Bool("audit", false, "enable audit logging")
 	pluginDir := flag.String("plugins", "", "plugins directory")
+	tmuxSocket := flag.String("tmux-socket", "", "tmux server socket path (instead of $TMUX)")
+	tmuxName := flag.String("L", "", "tmux server socket name (instead of $TMUX)")
 	flag.Parse()
 
 	if *showVersion {
@@ -27,11 +33,18 @@ func main() {
 	repl.SetSeriousMode(*serious)
 	repl.SetAuditMode(*audit)
 	repl.SetVersion(version)
+	repl.SetTmuxServer(*tmuxSocket, *tmuxName)
 	home, _ := os.UserHomeDir()
 	repl.SetBanFile(filepath.Join(home, ".grimux_banned"))
 	if *pluginDir != "" {
 		plugin.GetManager().SetDir(*pluginDir)
 	}
+	if flag.NArg() > 0 && flag.Arg(0) == "eval" {
+		os.Exit(runEval(flag.Args()[1:]))
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "status" {
+		os.Exit(runStatus(flag.Args()[1:]))
+	}
 	if flag.NArg() > 0 {
 		repl.SetSessionFile(flag.Arg(0))
 	}
@@ -41,3 +54,77 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// runStatus implements "grimux status" for tmux status lines, e.g.
+// set -g status-right '#(grimux status)'. It prints nothing when no grimux
+// is running so the segment simply disappears.
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	pane := fs.String("pane", "", "only the grimux running in this pane")
+	asJSON := fs.Bool("json", false, "print the state as JSON")
+	fs.Parse(args)
+	st, err := repl.ReadStatus(*pane)
+	if err != nil {
+		return 1
+	}
+	if *asJSON {
+		b, _ := json.Marshal(st)
+		fmt.Println(string(b))
+		return 0
+	}
+	fmt.Println(st.Line())
+	return 0
+}
+
+// runEval implements "grimux eval <suite.yaml>". It prints a Markdown report
+// and returns a non-zero exit code when any case fails.
+func runEval(args []string) int {
+	fs := flag.NewFlagSet("eval", flag.ExitOnError)
+	mdOut := fs.String("md", "", "write Markdown report to file")
+	jsonOut := fs.String("json", "", "write JSON report to file")
+	apiURL := fs.String("url", "", "API URL (\"mock\" answers locally)")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: grimux eval [-md file] [-json file] [-url url] <suite.yaml>")
+		return 2
+	}
+	suite, err := eval.LoadSuite(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	url := *apiURL
+	if url == "" {
+		url = suite.APIURL
+	}
+	if url == "" {
+		url = os.Getenv("OPENAI_API_URL")
+	}
+	var sender eval.Sender = &openai.Client{APIKey: os.Getenv("OPENAI_API_KEY"), APIURL: url, HTTPClient: http.DefaultClient}
+	if url == eval.MockURL {
+		sender = eval.Mock{}
+	}
+	rep := eval.Run(suite, sender)
+	md := rep.Markdown()
+	fmt.Print(md)
+	if *mdOut != "" {
+		if err := os.WriteFile(*mdOut, []byte(md), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if *jsonOut != "" {
+		b, err := rep.JSON()
+		if err == nil {
+			err = os.WriteFile(*jsonOut, b, 0644)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if rep.Failed > 0 {
+		return 1
+	}
+	return 0
+}
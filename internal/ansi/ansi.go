@@ -0,0 +1,62 @@
+package ansi
+
+import (
+	"regexp"
+	"strings"
+)
+
+// escapes matches CSI sequences (colors, cursor movement), OSC sequences
+// (titles, hyperlinks) and the remaining two byte escapes.
+var escapes = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_]`)
+
+// Strip removes escape sequences from s.
+func Strip(s string) string {
+	if !Has(s) {
+		return s
+	}
+	return escapes.ReplaceAllString(s, "")
+}
+
+// Has reports whether s contains an escape character.
+func Has(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] == 0x1b {
+			return true
+		}
+	}
+	return false
+}
+
+// Plain turns raw terminal output into text: escapes are removed, CRLF
+// becomes a newline, a bare carriage return lets the rest of the line
+// overwrite what was there and backspace moves one column back.
+func Plain(s string) string {
+	s = strings.ReplaceAll(Strip(s), "\r\n", "\n")
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if !strings.ContainsAny(l, "\r\b") {
+			continue
+		}
+		var buf []rune
+		col := 0
+		for _, r := range l {
+			switch r {
+			case '\r':
+				col = 0
+			case '\b':
+				if col > 0 {
+					col--
+				}
+			default:
+				if col < len(buf) {
+					buf[col] = r
+				} else {
+					buf = append(buf, r)
+				}
+				col++
+			}
+		}
+		lines[i] = string(buf)
+	}
+	return strings.Join(lines, "\n")
+}
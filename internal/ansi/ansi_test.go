@@ -0,0 +1,20 @@
+package ansi
+
+import "testing"
+
+func TestStrip(t *testing.T) {
+	in := "\x1b[1;31merror\x1b[0m: \x1b]0;title\x07bad \x1b(Bthing\x1b[K\n"
+	if got := Strip(in); got != "error: bad thing\n" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+	if !Has(in) || Has("plain") {
+		t.Fatalf("Has gave wrong answer")
+	}
+}
+
+func TestPlain(t *testing.T) {
+	in := "$ ls\r\n\x1b[34mdir\x1b[0m\r\n10%\r50%\r100%\r\nab\bc\r\n"
+	if got := Plain(in); got != "$ ls\ndir\n100%\nac\n" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
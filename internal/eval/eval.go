@@ -0,0 +1,271 @@
+package eval
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sender sends a prompt to a model and returns the reply.
+type Sender interface {
+	SendPromptModel(model, prompt string) (string, error)
+}
+
+// MockURL selects Mock instead of a real API.
+const MockURL = "mock"
+
+// Mock answers without network access for offline runs of a suite. Replies
+// echo the prompt, so contains and regex assertions check the prompt
+// instead, and the grader always answers PASS.
+type Mock struct{}
+
+// SendPromptModel implements Sender.
+func (Mock) SendPromptModel(model, prompt string) (string, error) {
+	if strings.HasPrefix(prompt, graderIntro) {
+		return "PASS\nmock grader", nil
+	}
+	return prompt, nil
+}
+
+// Assertion checks a reply. Exactly one field is expected to be set.
+type Assertion struct {
+	Contains    string `yaml:"contains,omitempty" json:"contains,omitempty"`
+	NotContains string `yaml:"not_contains,omitempty" json:"not_contains,omitempty"`
+	Regex       string `yaml:"regex,omitempty" json:"regex,omitempty"`
+	JSON        bool   `yaml:"json,omitempty" json:"json,omitempty"`
+	LLM         string `yaml:"llm,omitempty" json:"llm,omitempty"`
+}
+
+// Case is a single prompt with the assertions its reply must satisfy.
+type Case struct {
+	Name   string      `yaml:"name"`
+	Prompt string      `yaml:"prompt"`
+	Assert []Assertion `yaml:"assert"`
+}
+
+// Suite describes a set of cases run against every model and prefix.
+type Suite struct {
+	Name     string   `yaml:"name"`
+	APIURL   string   `yaml:"api_url"`
+	Models   []string `yaml:"models"`
+	Prefixes []string `yaml:"prefixes"`
+	Grader   string   `yaml:"grader"`
+	Cases    []Case   `yaml:"cases"`
+
+	dir string
+}
+
+// LoadSuite parses a suite file. Relative prefix paths are resolved against
+// the suite's directory.
+func LoadSuite(path string) (*Suite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Suite
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parse suite: %w", err)
+	}
+	if len(s.Cases) == 0 {
+		return nil, fmt.Errorf("suite has no cases")
+	}
+	for i, c := range s.Cases {
+		if c.Name == "" {
+			s.Cases[i].Name = fmt.Sprintf("case%d", i+1)
+		}
+		for _, a := range c.Assert {
+			if a.Regex != "" {
+				if _, err := regexp.Compile(a.Regex); err != nil {
+					return nil, fmt.Errorf("case %s: %w", s.Cases[i].Name, err)
+				}
+			}
+		}
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	s.dir = filepath.Dir(path)
+	return &s, nil
+}
+
+// prefixText returns the prompt prefix for p. Entries naming an existing
+// file are read from disk, anything else is used literally.
+func (s *Suite) prefixText(p string) string {
+	path := p
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(s.dir, p)
+	}
+	if b, err := os.ReadFile(path); err == nil {
+		return string(b)
+	}
+	if b, err := os.ReadFile(p); err == nil {
+		return string(b)
+	}
+	return p
+}
+
+// Result is the outcome of one case against one model and prefix.
+type Result struct {
+	Case     string        `json:"case"`
+	Model    string        `json:"model"`
+	Prefix   string        `json:"prefix"`
+	Reply    string        `json:"reply"`
+	Passed   bool          `json:"passed"`
+	Failures []string      `json:"failures,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration_ns"`
+}
+
+// Report collects the results of a suite run.
+type Report struct {
+	Suite   string   `json:"suite"`
+	Passed  int      `json:"passed"`
+	Failed  int      `json:"failed"`
+	Results []Result `json:"results"`
+}
+
+// Run executes every case for each model/prefix combination.
+func Run(s *Suite, sender Sender) *Report {
+	models := s.Models
+	if len(models) == 0 {
+		models = []string{""}
+	}
+	prefixes := s.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	rep := &Report{Suite: s.Name}
+	for _, model := range models {
+		for _, prefix := range prefixes {
+			text := s.prefixText(prefix)
+			for _, c := range s.Cases {
+				res := Result{Case: c.Name, Model: model, Prefix: prefix}
+				start := time.Now()
+				reply, err := sender.SendPromptModel(model, text+c.Prompt)
+				res.Duration = time.Since(start)
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.Reply = reply
+					for _, a := range c.Assert {
+						if msg := check(a, c.Prompt, reply, s, model, sender); msg != "" {
+							res.Failures = append(res.Failures, msg)
+						}
+					}
+					res.Passed = len(res.Failures) == 0
+				}
+				if res.Passed {
+					rep.Passed++
+				} else {
+					rep.Failed++
+				}
+				rep.Results = append(rep.Results, res)
+			}
+		}
+	}
+	return rep
+}
+
+// check evaluates a single assertion and returns a failure message or "".
+func check(a Assertion, prompt, reply string, s *Suite, model string, sender Sender) string {
+	switch {
+	case a.Contains != "":
+		if !strings.Contains(strings.ToLower(reply), strings.ToLower(a.Contains)) {
+			return fmt.Sprintf("missing %q", a.Contains)
+		}
+	case a.NotContains != "":
+		if strings.Contains(strings.ToLower(reply), strings.ToLower(a.NotContains)) {
+			return fmt.Sprintf("unexpected %q", a.NotContains)
+		}
+	case a.Regex != "":
+		if !regexp.MustCompile(a.Regex).MatchString(reply) {
+			return fmt.Sprintf("no match for /%s/", a.Regex)
+		}
+	case a.JSON:
+		body := strings.TrimSpace(reply)
+		if m := jsonBlock.FindStringSubmatch(body); m != nil {
+			body = m[1]
+		}
+		if !json.Valid([]byte(body)) {
+			return "reply is not valid JSON"
+		}
+	case a.LLM != "":
+		grader := s.Grader
+		if grader == "" {
+			grader = model
+		}
+		q := fmt.Sprintf(graderIntro+"\nCriterion: %s\n\nPrompt:\n%s\n\nReply:\n%s", a.LLM, prompt, reply)
+		verdict, err := sender.SendPromptModel(grader, q)
+		if err != nil {
+			return "grader error: " + err.Error()
+		}
+		first := strings.ToUpper(strings.TrimSpace(verdict))
+		if !strings.HasPrefix(first, "PASS") {
+			return fmt.Sprintf("grader: %s", strings.SplitN(strings.TrimSpace(verdict), "\n", 2)[0])
+		}
+	}
+	return ""
+}
+
+const graderIntro = "You are grading an AI assistant. Answer with PASS or FAIL on the first line followed by a short reason."
+
+var jsonBlock = regexp.MustCompile("(?s)^```(?:json)?\n(.*?)\n```$")
+
+// JSON renders the report as indented JSON.
+func (r *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Markdown renders the report as a Markdown summary and result table.
+func (r *Report) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Eval: %s\n\n", r.Suite)
+	fmt.Fprintf(&b, "**%d passed, %d failed**\n\n", r.Passed, r.Failed)
+	type key struct{ model, prefix string }
+	var order []key
+	totals := map[key][2]int{}
+	for _, res := range r.Results {
+		k := key{res.Model, res.Prefix}
+		t, seen := totals[k]
+		if !seen {
+			order = append(order, k)
+		}
+		if res.Passed {
+			t[0]++
+		}
+		t[1]++
+		totals[k] = t
+	}
+	b.WriteString("| Model | Prefix | Passed |\n|---|---|---|\n")
+	for _, k := range order {
+		t := totals[k]
+		fmt.Fprintf(&b, "| %s | %s | %d/%d |\n", orDash(k.model), orDash(k.prefix), t[0], t[1])
+	}
+	b.WriteString("\n| Case | Model | Prefix | Result | Notes |\n|---|---|---|---|---|\n")
+	for _, res := range r.Results {
+		status := "✅"
+		notes := ""
+		if !res.Passed {
+			status = "❌"
+			notes = strings.Join(res.Failures, "; ")
+			if res.Error != "" {
+				notes = "error: " + res.Error
+			}
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", res.Case, orDash(res.Model), orDash(res.Prefix), status, strings.ReplaceAll(notes, "|", `\|`))
+	}
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
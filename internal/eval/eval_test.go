@@ -0,0 +1,101 @@
+package eval
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeSender struct {
+	replies map[string]string
+	prompts []string
+}
+
+func (f *fakeSender) SendPromptModel(model, prompt string) (string, error) {
+	f.prompts = append(f.prompts, model+":"+prompt)
+	if strings.HasPrefix(prompt, "You are grading") {
+		return "PASS\nlooks fine", nil
+	}
+	return f.replies[model], nil
+}
+
+const suiteYAML = `
+name: smoke
+models: [good, bad]
+prefixes:
+  - persona.txt
+  - "Be terse. "
+cases:
+  - name: nmap
+    prompt: how do I scan all ports?
+    assert:
+      - contains: nmap
+      - regex: "-p-"
+      - not_contains: sorry
+      - llm: mentions all ports
+  - name: json
+    prompt: give me json
+    assert:
+      - json: true
+`
+
+func TestLoadSuiteAndRun(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "persona.txt"), []byte("You are a hacker. "), 0644)
+	path := filepath.Join(dir, "suite.yaml")
+	if err := os.WriteFile(path, []byte(suiteYAML), 0644); err != nil {
+		t.Fatalf("write suite: %v", err)
+	}
+	s, err := LoadSuite(path)
+	if err != nil {
+		t.Fatalf("LoadSuite: %v", err)
+	}
+	if len(s.Cases) != 2 || len(s.Cases[0].Assert) != 4 || !s.Cases[1].Assert[0].JSON {
+		t.Fatalf("unexpected suite: %+v", s)
+	}
+	sender := &fakeSender{replies: map[string]string{
+		"good": "```json\n{\"cmd\": \"nmap -p- host\"}\n```",
+		"bad":  "sorry, I can't help",
+	}}
+	rep := Run(s, sender)
+	if len(rep.Results) != 8 || rep.Passed != 4 || rep.Failed != 4 {
+		t.Fatalf("unexpected totals: %d results %d passed %d failed", len(rep.Results), rep.Passed, rep.Failed)
+	}
+	if !strings.HasPrefix(sender.prompts[0], "good:You are a hacker. how do I") {
+		t.Fatalf("prefix file not applied: %q", sender.prompts[0])
+	}
+	md := rep.Markdown()
+	if !strings.Contains(md, "| good | persona.txt | 2/2 |") || !strings.Contains(md, "missing \"nmap\"") {
+		t.Fatalf("unexpected markdown:\n%s", md)
+	}
+	b, err := rep.JSON()
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded.Failed != 4 {
+		t.Fatalf("bad JSON report: %v %+v", err, decoded)
+	}
+}
+
+func TestLoadSuiteBadRegex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.yaml")
+	os.WriteFile(path, []byte("cases:\n  - prompt: hi\n    assert:\n      - regex: \"(\"\n"), 0644)
+	if _, err := LoadSuite(path); err == nil {
+		t.Fatal("expected regex error")
+	}
+}
+
+func TestMockGrader(t *testing.T) {
+	s := &Suite{Name: "offline", Cases: []Case{{
+		Name:   "echo",
+		Prompt: "explain nmap",
+		Assert: []Assertion{{Contains: "nmap"}, {LLM: "is accurate"}},
+	}}}
+	rep := Run(s, Mock{})
+	if rep.Passed != 1 || rep.Results[0].Reply != "explain nmap" {
+		t.Fatalf("unexpected mock run: %+v", rep.Results)
+	}
+}
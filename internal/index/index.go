@@ -0,0 +1,273 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 tuning parameters.
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// maxFileSize skips files larger than this many bytes.
+const maxFileSize = 1 << 20
+
+// Passage is a chunk of a file that can be returned as search context.
+type Passage struct {
+	Path  string         `json:"path"`
+	Line  int            `json:"line"`
+	Text  string         `json:"text"`
+	Terms map[string]int `json:"terms"`
+	Len   int            `json:"len"`
+}
+
+// Result is a scored passage.
+type Result struct {
+	Passage *Passage
+	Score   float64
+}
+
+// Index is an in-memory BM25 index over passages from one or more
+// directories.
+type Index struct {
+	Dirs     []string   `json:"dirs"`
+	Passages []*Passage `json:"passages"`
+	df       map[string]int
+	avgLen   float64
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{df: map[string]int{}}
+}
+
+// DefaultPath returns ~/.grimux/index.json.
+func DefaultPath() string {
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".grimux", "index.json")
+}
+
+// Load reads an index from path. A missing file yields an empty index.
+func Load(path string) (*Index, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return New(), nil
+		}
+		return nil, err
+	}
+	idx := New()
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, err
+	}
+	idx.rebuild()
+	return idx, nil
+}
+
+// Save writes the index to path, creating parent directories as needed.
+func (idx *Index) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Tokenize lowercases text and splits it into alphanumeric terms of at least
+// two characters.
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	out := words[:0]
+	for _, w := range words {
+		if len(w) >= 2 {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// rebuild recomputes document frequencies and the average passage length.
+func (idx *Index) rebuild() {
+	idx.df = map[string]int{}
+	total := 0
+	for _, p := range idx.Passages {
+		for t := range p.Terms {
+			idx.df[t]++
+		}
+		total += p.Len
+	}
+	idx.avgLen = 0
+	if len(idx.Passages) > 0 {
+		idx.avgLen = float64(total) / float64(len(idx.Passages))
+	}
+}
+
+// chunk splits file content into passages on blank lines, merging short
+// paragraphs so each passage has between minLines and maxLines lines.
+func chunk(path, content string) []*Passage {
+	const minLines, maxLines = 8, 40
+	lines := strings.Split(content, "\n")
+	var out []*Passage
+	start := 0
+	flush := func(end int) {
+		text := strings.TrimSpace(strings.Join(lines[start:end], "\n"))
+		if text != "" {
+			terms := map[string]int{}
+			toks := Tokenize(text)
+			for _, t := range toks {
+				terms[t]++
+			}
+			out = append(out, &Passage{Path: path, Line: start + 1, Text: text, Terms: terms, Len: len(toks)})
+		}
+		start = end
+	}
+	for i, l := range lines {
+		n := i + 1 - start
+		if (strings.TrimSpace(l) == "" && n >= minLines) || n >= maxLines {
+			flush(i + 1)
+		}
+	}
+	if start < len(lines) {
+		flush(len(lines))
+	}
+	return out
+}
+
+// isText reports whether data looks like text rather than a binary file.
+func isText(data []byte) bool {
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return !bytes.ContainsRune(head, 0)
+}
+
+// AddDir indexes every text file below dir, replacing any passages from a
+// previous run over the same directory. It returns the number of files
+// indexed.
+func (idx *Index) AddDir(dir string) (int, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return 0, err
+	}
+	idx.removePassages(abs)
+	files := 0
+	err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != abs && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err != nil || info.Size() > maxFileSize {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || !isText(data) {
+			return nil
+		}
+		idx.Passages = append(idx.Passages, chunk(path, string(data))...)
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, err
+	}
+	found := false
+	for _, d := range idx.Dirs {
+		if d == abs {
+			found = true
+		}
+	}
+	if !found {
+		idx.Dirs = append(idx.Dirs, abs)
+	}
+	idx.rebuild()
+	return files, nil
+}
+
+// RemoveDir drops a directory and its passages from the index.
+func (idx *Index) RemoveDir(dir string) bool {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	removed := false
+	dirs := idx.Dirs[:0]
+	for _, d := range idx.Dirs {
+		if d == abs {
+			removed = true
+			continue
+		}
+		dirs = append(dirs, d)
+	}
+	idx.Dirs = dirs
+	idx.removePassages(abs)
+	idx.rebuild()
+	return removed
+}
+
+func (idx *Index) removePassages(dir string) {
+	prefix := dir + string(filepath.Separator)
+	kept := idx.Passages[:0]
+	for _, p := range idx.Passages {
+		if !strings.HasPrefix(p.Path, prefix) {
+			kept = append(kept, p)
+		}
+	}
+	idx.Passages = kept
+}
+
+// Search returns the k best passages for query ranked by BM25.
+func (idx *Index) Search(query string, k int) []Result {
+	terms := Tokenize(query)
+	if len(terms) == 0 || len(idx.Passages) == 0 {
+		return nil
+	}
+	n := float64(len(idx.Passages))
+	var results []Result
+	for _, p := range idx.Passages {
+		score := 0.0
+		for _, t := range terms {
+			tf := float64(p.Terms[t])
+			if tf == 0 {
+				continue
+			}
+			df := float64(idx.df[t])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			norm := tf + k1*(1-b+b*float64(p.Len)/idx.avgLen)
+			score += idf * tf * (k1 + 1) / norm
+		}
+		if score > 0 {
+			results = append(results, Result{Passage: p, Score: score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if k > 0 && len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
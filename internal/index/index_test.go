@@ -0,0 +1,81 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeNotes(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	notes := map[string]string{
+		"smb.md":    "# SMB\nUse smbclient -L //host to list shares.\nNull sessions still work on old boxes.\n",
+		"web.md":    "# Web\nRun ffuf against the target for content discovery.\nCheck robots.txt first.\n",
+		"kerb.md":   "# Kerberos\nKerberoasting with GetUserSPNs then crack with hashcat.\n",
+		"bin.dat":   "\x00\x01\x02",
+		".git/HEAD": "ref: refs/heads/main\n",
+	}
+	for name, data := range notes {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestSearchRanksRelevantPassage(t *testing.T) {
+	dir := writeNotes(t)
+	idx := New()
+	n, err := idx.AddDir(dir)
+	if err != nil {
+		t.Fatalf("AddDir: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 text files indexed, got %d", n)
+	}
+	res := idx.Search("list smb shares", 2)
+	if len(res) == 0 || filepath.Base(res[0].Passage.Path) != "smb.md" {
+		t.Fatalf("unexpected results: %+v", res)
+	}
+	if res := idx.Search("nonexistentterm", 3); len(res) != 0 {
+		t.Fatalf("expected no results, got %d", len(res))
+	}
+}
+
+func TestSaveLoadAndRemove(t *testing.T) {
+	dir := writeNotes(t)
+	idx := New()
+	if _, err := idx.AddDir(dir); err != nil {
+		t.Fatalf("AddDir: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "index.json")
+	if err := idx.Save(path); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	res := loaded.Search("kerberoasting hashcat", 1)
+	if len(res) != 1 || !strings.Contains(res[0].Passage.Text, "GetUserSPNs") {
+		t.Fatalf("unexpected results after load: %+v", res)
+	}
+	if !loaded.RemoveDir(dir) || len(loaded.Passages) != 0 || len(loaded.Dirs) != 0 {
+		t.Fatalf("remove failed: %d passages %v", len(loaded.Passages), loaded.Dirs)
+	}
+}
+
+func TestChunkSplitsLongFiles(t *testing.T) {
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, "line")
+	}
+	ps := chunk("f", strings.Join(lines, "\n"))
+	if len(ps) != 3 || ps[1].Line != 41 {
+		t.Fatalf("unexpected chunks: %d", len(ps))
+	}
+}
@@ -0,0 +1,163 @@
+package mux
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-memory multiplexer for tests. Panes hold a screen of text
+// and record what is typed into them; Respond lets a test react to input
+// the way a program in the pane would.
+type Fake struct {
+	mu      sync.Mutex
+	panes   map[string]*FakePane
+	buffers map[string]string
+}
+
+// FakePane is a pane of a Fake. Lock the Fake with Update before touching
+// its fields while other goroutines use it.
+type FakePane struct {
+	Info PaneInfo
+	// History holds lines that scrolled off the screen.
+	History []string
+	Screen  []string
+	// Input records every write to the pane. Keys sent with SendKeys are
+	// translated, so Enter appears as "\n".
+	Input []string
+	// Respond is called with the Fake locked after each write.
+	Respond func(p *FakePane, input string)
+}
+
+// NewFake returns an empty fake multiplexer.
+func NewFake() *Fake {
+	return &Fake{panes: map[string]*FakePane{}, buffers: map[string]string{}}
+}
+
+// AddPane adds a pane showing the given lines.
+func (f *Fake) AddPane(id string, screen ...string) *FakePane {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := &FakePane{Info: PaneInfo{ID: id, Command: "sh"}, Screen: screen}
+	f.panes[id] = p
+	return p
+}
+
+// Update runs fn with the Fake locked.
+func (f *Fake) Update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+// Print appends lines to the screen of a pane.
+func (p *FakePane) Print(lines ...string) {
+	p.Screen = append(p.Screen, lines...)
+}
+
+// Typed returns everything written to the pane so far.
+func (f *Fake) Typed(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if p := f.panes[id]; p != nil {
+		return strings.Join(p.Input, "")
+	}
+	return ""
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) pane(target string) (*FakePane, error) {
+	p := f.panes[target]
+	if p == nil {
+		return nil, fmt.Errorf("can't find pane %s", target)
+	}
+	return p, nil
+}
+
+func (f *Fake) capture(target string, history bool) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pane(target)
+	if err != nil {
+		return "", err
+	}
+	lines := p.Screen
+	if history {
+		lines = append(append([]string(nil), p.History...), p.Screen...)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func (f *Fake) CapturePane(target string) (string, error) { return f.capture(target, false) }
+
+func (f *Fake) CapturePaneFull(target string) (string, error) { return f.capture(target, true) }
+
+func (f *Fake) write(target, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.pane(target)
+	if err != nil {
+		return err
+	}
+	p.Input = append(p.Input, text)
+	if p.Respond != nil {
+		p.Respond(p, text)
+	}
+	return nil
+}
+
+func (f *Fake) SendKeys(target string, keys ...string) error {
+	var sb strings.Builder
+	for _, k := range keys {
+		if k == "Enter" {
+			k = "\n"
+		}
+		sb.WriteString(k)
+	}
+	return f.write(target, sb.String())
+}
+
+func (f *Fake) SendLiteral(target, text string) error { return f.write(target, text) }
+
+func (f *Fake) PasteText(target, data string) error { return f.write(target, data) }
+
+func (f *Fake) ListPanes() ([]PaneInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]PaneInfo, 0, len(f.panes))
+	for _, p := range f.panes {
+		out = append(out, p.Info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+func (f *Fake) ListBuffers() ([]BufferInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]BufferInfo, 0, len(f.buffers))
+	for name, data := range f.buffers {
+		out = append(out, BufferInfo{Name: name, Size: len(data)})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+func (f *Fake) ShowBuffer(name string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.buffers[name]
+	if !ok {
+		return "", fmt.Errorf("no buffer %s", name)
+	}
+	return data, nil
+}
+
+func (f *Fake) SetBuffer(name, data string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buffers[name] = data
+	return nil
+}
@@ -0,0 +1,74 @@
+package mux
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+// PaneInfo describes a pane. Backends fill in what they know.
+type PaneInfo = tmux.PaneInfo
+
+// BufferInfo contains the name and size of a paste buffer.
+type BufferInfo = tmux.BufferInfo
+
+// Multiplexer is the terminal multiplexer grimux reads panes from and types
+// into. Pane targets are ids such as %3; an empty target is the pane grimux
+// runs in.
+type Multiplexer interface {
+	// Name identifies the backend, e.g. "tmux".
+	Name() string
+	// CapturePane returns the visible text of a pane.
+	CapturePane(target string) (string, error)
+	// CapturePaneFull returns the pane text including its scrollback.
+	CapturePaneFull(target string) (string, error)
+	// SendKeys sends key names (Enter, C-c, ...) or text to a pane.
+	SendKeys(target string, keys ...string) error
+	// SendLiteral types text without interpreting key names.
+	SendLiteral(target, text string) error
+	// PasteText pastes possibly multi-line text in one piece.
+	PasteText(target, data string) error
+	// ListPanes lists the panes the multiplexer knows about.
+	ListPanes() ([]PaneInfo, error)
+	// ListBuffers lists the named paste buffers.
+	ListBuffers() ([]BufferInfo, error)
+	// ShowBuffer returns the contents of a paste buffer.
+	ShowBuffer(name string) (string, error)
+	// SetBuffer stores data in a paste buffer.
+	SetBuffer(name, data string) error
+}
+
+// Detect picks a backend. name comes from the multiplexer config key; when
+// it is empty the environment decides: $TMUX or an explicit tmux socket
+// selects tmux and $STY GNU screen, with tmux as the default.
+func Detect(name string) (Multiplexer, error) {
+	if name == "" {
+		name = "tmux"
+		if os.Getenv("TMUX") == "" && !tmux.ExplicitServer() && os.Getenv("STY") != "" {
+			name = "screen"
+		}
+	}
+	switch name {
+	case "tmux":
+		return Tmux{}, nil
+	case "screen":
+		return NewScreen(), nil
+	}
+	return nil, fmt.Errorf("unknown multiplexer %q", name)
+}
+
+// Tmux drives tmux through the functions of the tmux package, including
+// remote panes and control mode.
+type Tmux struct{}
+
+func (Tmux) Name() string                                  { return "tmux" }
+func (Tmux) CapturePane(target string) (string, error)     { return tmux.CapturePane(target) }
+func (Tmux) CapturePaneFull(target string) (string, error) { return tmux.CapturePaneFull(target) }
+func (Tmux) SendKeys(target string, keys ...string) error  { return tmux.SendKeys(target, keys...) }
+func (Tmux) SendLiteral(target, text string) error         { return tmux.SendLiteral(target, text) }
+func (Tmux) PasteText(target, data string) error           { return tmux.PasteText(target, data) }
+func (Tmux) ListPanes() ([]PaneInfo, error)                { return tmux.ListPanes() }
+func (Tmux) ListBuffers() ([]BufferInfo, error)            { return tmux.ListBuffers() }
+func (Tmux) ShowBuffer(name string) (string, error)        { return tmux.ShowBuffer(name) }
+func (Tmux) SetBuffer(name, data string) error             { return tmux.SetBuffer(name, data) }
@@ -0,0 +1,127 @@
+package mux
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startFakeScreen puts a screen script on PATH that logs its arguments,
+// answers -Q windows and writes content for hardcopy and writebuf.
+func startFakeScreen(t *testing.T, content string) (logFile string) {
+	t.Helper()
+	tmp := t.TempDir()
+	logFile = filepath.Join(tmp, "log")
+	script := `#!/bin/sh
+printf '%s\n' "$*" >> ` + logFile + `
+for last; do :; done
+case "$*" in
+*"-Q windows"*) echo '0$ bash  1*$ vim main.go  2-$ top' ;;
+*"-Q number"*) echo '1 vim' ;;
+*hardcopy*|*writebuf*) printf '%s' '` + content + `' > "$last" ;;
+esac
+`
+	if err := os.WriteFile(filepath.Join(tmp, "screen"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logFile
+}
+
+func TestDetect(t *testing.T) {
+	t.Setenv("TMUX", "")
+	t.Setenv("STY", "123.pts-0.host")
+	m, err := Detect("")
+	if err != nil || m.Name() != "screen" {
+		t.Fatalf("want screen from $STY, got %v %v", m, err)
+	}
+	if s := m.(*Screen); s.Session != "123.pts-0.host" {
+		t.Fatalf("session %q", s.Session)
+	}
+	t.Setenv("TMUX", "/tmp/sock,1,0")
+	if m, _ := Detect(""); m.Name() != "tmux" {
+		t.Fatalf("want tmux from $TMUX, got %s", m.Name())
+	}
+	if m, _ := Detect("screen"); m.Name() != "screen" {
+		t.Fatalf("config should win over the environment")
+	}
+	if _, err := Detect("zellij"); err == nil {
+		t.Fatal("expected error for unknown multiplexer")
+	}
+}
+
+func TestScreenCapture(t *testing.T) {
+	logFile := startFakeScreen(t, "$ ls    \nmain.go   \n\n\n")
+	s := &Screen{Session: "sess"}
+	out, err := s.CapturePaneFull("%2")
+	if err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+	if out != "$ ls\nmain.go\n" {
+		t.Fatalf("unexpected capture %q", out)
+	}
+	log, _ := os.ReadFile(logFile)
+	if !strings.HasPrefix(string(log), "-S sess -p 2 -X hardcopy -h ") {
+		t.Fatalf("unexpected args %q", log)
+	}
+	if _, err := s.CapturePane("main"); err == nil {
+		t.Fatal("expected error for non-window target")
+	}
+}
+
+func TestScreenSendKeys(t *testing.T) {
+	logFile := startFakeScreen(t, "")
+	s := &Screen{}
+	if err := s.SendKeys("%1", "echo $HOME ^_^", "Enter", "C-c"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	log, _ := os.ReadFile(logFile)
+	want := `-p 1 -X stuff echo \$HOME \^_\^\015\003` + "\n"
+	if string(log) != want {
+		t.Fatalf("got %q want %q", log, want)
+	}
+}
+
+func TestScreenListPanesAndBuffers(t *testing.T) {
+	startFakeScreen(t, "copied")
+	s := &Screen{Session: "sess"}
+	panes, err := s.ListPanes()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(panes) != 3 || panes[1].ID != "%1" || panes[1].Title != "vim main.go" || !panes[1].Active || panes[0].Active {
+		t.Fatalf("unexpected panes %+v", panes)
+	}
+	bufs, err := s.ListBuffers()
+	if err != nil || len(bufs) != 1 || bufs[0] != (BufferInfo{Name: ScreenBuffer, Size: 6}) {
+		t.Fatalf("unexpected buffers %+v %v", bufs, err)
+	}
+	if _, err := s.ShowBuffer("other"); err == nil {
+		t.Fatal("expected error for unknown buffer")
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := NewFake()
+	p := f.AddPane("%1", "$ ")
+	p.Respond = func(p *FakePane, in string) {
+		if strings.HasSuffix(in, "\n") {
+			p.Print("hi", "$ ")
+		}
+	}
+	if err := f.SendKeys("%1", "echo hi", "Enter"); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := f.CapturePane("%1")
+	if out != "$ \nhi\n$ \n" || f.Typed("%1") != "echo hi\n" {
+		t.Fatalf("unexpected pane %q typed %q", out, f.Typed("%1"))
+	}
+	if _, err := f.CapturePane("%9"); err == nil {
+		t.Fatal("expected error for missing pane")
+	}
+	f.SetBuffer("b", "data")
+	if bufs, _ := f.ListBuffers(); len(bufs) != 1 || bufs[0].Size != 4 {
+		t.Fatalf("unexpected buffers %+v", bufs)
+	}
+}
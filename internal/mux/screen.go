@@ -0,0 +1,283 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Screen drives GNU screen (4.06 or later) with screen -X and -Q. Windows
+// play the role of panes and are addressed as %N for window N. screen keeps
+// a single paste buffer which is exposed as the buffer named "screen".
+type Screen struct {
+	// Session is the session name passed to -S. Empty uses $STY.
+	Session string
+}
+
+// ScreenBuffer is the name under which the screen paste buffer is listed.
+const ScreenBuffer = "screen"
+
+// stuffChunk keeps each stuff command well below screen's message size.
+const stuffChunk = 512
+
+// NewScreen returns a backend for the session grimux runs in.
+func NewScreen() *Screen {
+	return &Screen{Session: os.Getenv("STY")}
+}
+
+func (s *Screen) Name() string { return "screen" }
+
+// window turns a %N target into a window number. An empty target is the
+// window grimux runs in.
+func (s *Screen) window(target string) (string, error) {
+	if target == "" {
+		return os.Getenv("WINDOW"), nil
+	}
+	n := strings.TrimPrefix(target, "%")
+	if _, err := strconv.Atoi(n); err != nil || n == target {
+		return "", fmt.Errorf("invalid screen window %q", target)
+	}
+	return n, nil
+}
+
+// run executes a screen command. mode is -X for commands and -Q for
+// queries, which wait for the answer.
+func (s *Screen) run(mode, window string, args ...string) (string, error) {
+	var argv []string
+	if s.Session != "" {
+		argv = append(argv, "-S", s.Session)
+	}
+	if window != "" {
+		argv = append(argv, "-p", window)
+	}
+	argv = append(append(argv, mode), args...)
+	cmd := exec.Command("screen", argv...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errors.New("screen is not installed")
+		}
+		if msg := strings.TrimSpace(out.String()); msg != "" {
+			return "", fmt.Errorf("screen: %s", msg)
+		}
+		return "", fmt.Errorf("screen command: %w", err)
+	}
+	return out.String(), nil
+}
+
+// sync waits until screen has processed the commands sent before it. -X
+// returns as soon as the message is queued, while -Q waits for an answer.
+func (s *Screen) sync() error {
+	_, err := s.run("-Q", "", "number")
+	return err
+}
+
+// dump runs a command that writes to a file, such as hardcopy or writebuf,
+// and returns what it wrote. ok is false when screen wrote nothing.
+func (s *Screen) dump(window string, args ...string) (out string, ok bool, err error) {
+	f, err := os.CreateTemp("", "grimux-screen-*")
+	if err != nil {
+		return "", false, err
+	}
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+	defer os.Remove(name)
+	if _, err := s.run("-X", window, append(args, name)...); err != nil {
+		return "", false, err
+	}
+	if err := s.sync(); err != nil {
+		return "", false, err
+	}
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	return string(b), err == nil, err
+}
+
+func (s *Screen) capture(target string, history bool) (string, error) {
+	w, err := s.window(target)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"hardcopy"}
+	if history {
+		args = append(args, "-h")
+	}
+	out, ok, err := s.dump(w, args...)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("screen wrote no hardcopy for window %s", w)
+	}
+	// hardcopy pads lines to the window width
+	lines := strings.Split(out, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n", nil
+}
+
+func (s *Screen) CapturePane(target string) (string, error) { return s.capture(target, false) }
+
+func (s *Screen) CapturePaneFull(target string) (string, error) { return s.capture(target, true) }
+
+// screenKeys maps tmux key names to the bytes they produce.
+var screenKeys = map[string]string{
+	"Enter":  "\r",
+	"Tab":    "\t",
+	"Escape": "\x1b",
+	"BSpace": "\x7f",
+	"Space":  " ",
+	"Up":     "\x1b[A",
+	"Down":   "\x1b[B",
+	"Right":  "\x1b[C",
+	"Left":   "\x1b[D",
+	"Home":   "\x1b[H",
+	"End":    "\x1b[F",
+}
+
+var ctrlKey = regexp.MustCompile(`^C-([a-zA-Z\[\\\]^_@])$`)
+
+// keyBytes translates a send-keys argument. Unknown words are typed as is,
+// like tmux does.
+func keyBytes(key string) string {
+	if b, ok := screenKeys[key]; ok {
+		return b
+	}
+	if m := ctrlKey.FindStringSubmatch(key); m != nil {
+		return string(strings.ToUpper(m[1])[0] & 0x1f)
+	}
+	return key
+}
+
+// stuffEscape protects text from the escape and variable processing screen
+// applies to command arguments. Control characters are written in octal.
+func stuffEscape(text string) string {
+	var sb strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '^' || r == '$':
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, "\\%03o", r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// stuff types text into a window in chunks that do not split characters.
+func (s *Screen) stuff(target, text string) error {
+	w, err := s.window(target)
+	if err != nil {
+		return err
+	}
+	for len(text) > 0 {
+		n := min(len(text), stuffChunk)
+		for n < len(text) && n > 0 && text[n]&0xc0 == 0x80 {
+			n--
+		}
+		if _, err := s.run("-X", w, "stuff", stuffEscape(text[:n])); err != nil {
+			return err
+		}
+		text = text[n:]
+	}
+	return nil
+}
+
+func (s *Screen) SendKeys(target string, keys ...string) error {
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(keyBytes(k))
+	}
+	return s.stuff(target, sb.String())
+}
+
+func (s *Screen) SendLiteral(target, text string) error { return s.stuff(target, text) }
+
+// PasteText types data into the window. screen has no bracketed paste, so
+// multi-line text arrives line by line.
+func (s *Screen) PasteText(target, data string) error { return s.stuff(target, data) }
+
+// windowEntry matches one window in the output of -Q windows, e.g. "1*$ vim".
+var windowEntry = regexp.MustCompile(`(\d+)([-*$!@&Z]*) (.+?)(?:  |$)`)
+
+func (s *Screen) ListPanes() ([]PaneInfo, error) {
+	out, err := s.run("-Q", "", "windows")
+	if err != nil {
+		return nil, err
+	}
+	return parseWindows(s.Session, strings.TrimSpace(out)), nil
+}
+
+func parseWindows(session, out string) []PaneInfo {
+	var panes []PaneInfo
+	for _, m := range windowEntry.FindAllStringSubmatch(out, -1) {
+		n, _ := strconv.Atoi(m[1])
+		panes = append(panes, PaneInfo{
+			ID:         "%" + m[1],
+			Session:    session,
+			Window:     n,
+			WindowName: m[3],
+			Title:      m[3],
+			Command:    m[3],
+			Active:     strings.Contains(m[2], "*"),
+		})
+	}
+	return panes
+}
+
+// ListBuffers lists the paste buffer when it holds anything.
+func (s *Screen) ListBuffers() ([]BufferInfo, error) {
+	out, ok, err := s.dump("", "writebuf")
+	if err != nil || !ok {
+		return nil, err
+	}
+	return []BufferInfo{{Name: ScreenBuffer, Size: len(out)}}, nil
+}
+
+// ShowBuffer returns the paste buffer. screen has only one, so name must
+// be ScreenBuffer or empty.
+func (s *Screen) ShowBuffer(name string) (string, error) {
+	if name != "" && name != ScreenBuffer {
+		return "", fmt.Errorf("screen has no buffer %q", name)
+	}
+	out, _, err := s.dump("", "writebuf")
+	return out, err
+}
+
+// SetBuffer replaces the paste buffer.
+func (s *Screen) SetBuffer(name, data string) error {
+	if name != "" && name != ScreenBuffer {
+		return fmt.Errorf("screen has no buffer %q", name)
+	}
+	f, err := os.CreateTemp("", "grimux-screen-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.run("-X", "", "readbuf", f.Name()); err != nil {
+		return err
+	}
+	// screen reads the file asynchronously
+	return s.sync()
+}
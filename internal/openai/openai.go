@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/glo0ml34f/grimux/internal/ansi"
 	"github.com/glo0ml34f/grimux/internal/input"
 	"github.com/glo0ml34f/grimux/internal/plugin"
 )
@@ -136,9 +137,22 @@ type chatResponse struct {
 
 // SendPrompt sends the given text as a user message and returns the assistant's reply.
 func (c *Client) SendPrompt(prompt string) (string, error) {
-	prompt = plugin.GetManager().RunHook("before_openai", "", prompt)
+	return c.SendPromptModel(ModelName, prompt)
+}
+
+// SendPromptModel is like SendPrompt but uses the given model for this
+// request only. An empty model falls back to the configured default.
+func (c *Client) SendPromptModel(model, prompt string) (string, error) {
+	if model == "" {
+		model = ModelName
+	}
+	if model == "" {
+		model = defaultModelName
+	}
+	// colored pane captures are for humans, the model gets plain text
+	prompt = ansi.Strip(plugin.GetManager().RunHook("before_openai", "", prompt))
 	reqBody := chatRequest{
-		Model:    ModelName,
+		Model:    model,
 		Messages: []chatMessage{{Role: "user", Content: prompt}},
 	}
 	b, err := json.Marshal(reqBody)
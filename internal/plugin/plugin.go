@@ -34,6 +34,7 @@ type Plugin struct {
 	shut     *lua.LFunction
 	commands map[string]*lua.LFunction
 	hooks    map[string][]*lua.LFunction
+	subs     map[string][]*lua.LFunction
 	allowed  map[string]bool
 }
 
@@ -333,6 +334,25 @@ func (m *Manager) Load(path string) (*Plugin, error) {
 			L.Push(lua.LString(p.Handle))
 			return 1
 		},
+		"subscribe": func(L *lua.LState) int {
+			handle := L.CheckString(1)
+			if handle != p.Handle {
+				L.RaiseError("invalid handle")
+				return 0
+			}
+			if p.allowed != nil && !p.allowed["subscribe"] {
+				L.RaiseError("subscribe not allowed")
+				return 0
+			}
+			event := L.CheckString(2)
+			cb := L.CheckFunction(3)
+			if p.subs == nil {
+				p.subs = map[string][]*lua.LFunction{}
+			}
+			p.subs[event] = append(p.subs[event], cb)
+			L.Push(lua.LString(p.Handle))
+			return 1
+		},
 		"command": func(L *lua.LState) int {
 			handle := L.CheckString(1)
 			if handle != p.Handle {
@@ -633,6 +653,29 @@ func (m *Manager) HasHook(name string) bool {
 	return false
 }
 
+// DispatchEvent calls the callbacks subscribed to a tmux event. Callbacks
+// registered for "*" receive every event.
+func (m *Manager) DispatchEvent(name, pane, data string) {
+	for _, p := range m.plugins {
+		fns := append(append([]*lua.LFunction{}, p.subs[name]...), p.subs["*"]...)
+		for _, fn := range fns {
+			if err := p.L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, lua.LString(name), lua.LString(pane), lua.LString(data)); err != nil {
+				p.L.Pop(p.L.GetTop())
+			}
+		}
+	}
+}
+
+// HasSubscriber reports whether any plugin listens for the named event.
+func (m *Manager) HasSubscriber(name string) bool {
+	for _, p := range m.plugins {
+		if len(p.subs[name]) > 0 || len(p.subs["*"]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // HookNames returns the names of hooks registered by the plugin.
 func (m *Manager) HookNames(name string) []string {
 	p, ok := m.plugins[name]
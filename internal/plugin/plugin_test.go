@@ -389,3 +389,31 @@ end
 		t.Fatalf("out=%q", out)
 	}
 }
+
+func TestSubscribeEvent(t *testing.T) {
+	dir := t.TempDir()
+	luaFile := filepath.Join(dir, "plug.lua")
+	code := `
+function init(h)
+  local json = '{"name":"subs","grimux":"0.1.0","version":"0.1.0"}'
+  plugin.register(h, json, {"subscribe"})
+  plugin.subscribe(h, "output", function(ev, pane, data) got = ev .. " " .. pane .. " " .. data end)
+end
+`
+	if err := os.WriteFile(luaFile, []byte(code), 0o600); err != nil {
+		t.Fatalf("write lua: %v", err)
+	}
+	SetPrintHandler(func(*Plugin, string) {})
+	p, err := GetManager().Load(luaFile)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	defer GetManager().Unload(p.Info.Name)
+	if !GetManager().HasSubscriber("output") || GetManager().HasSubscriber("window-add") {
+		t.Fatalf("unexpected subscriber state")
+	}
+	GetManager().DispatchEvent("output", "%1", "hi")
+	if v := p.L.GetGlobal("got"); v.String() != "output %1 hi" {
+		t.Fatalf("unexpected callback value: %v", v)
+	}
+}
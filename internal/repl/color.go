@@ -0,0 +1,86 @@
+package repl
+
+import (
+	"fmt"
+
+	"github.com/glo0ml34f/grimux/internal/ansi"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var capturePaneANSI = tmux.CapturePaneANSI
+var capturePaneFullANSI = tmux.CapturePaneFullANSI
+
+// captureANSI makes !observe and !eat keep color escapes by default.
+var captureANSI bool
+
+// captureFlags strips -e (keep escapes), -p (plain text) and -d (only new
+// lines) from the arguments of a capture command.
+func captureFlags(args []string) (rest []string, keep, delta bool) {
+	keep = captureANSI
+	for _, a := range args {
+		switch a {
+		case "-e":
+			keep = true
+		case "-p":
+			keep = false
+		case "-d":
+			delta = true
+		default:
+			rest = append(rest, a)
+		}
+	}
+	return rest, keep, delta
+}
+
+// capturePaneText grabs the visible pane, or the whole scrollback when full is set,
+// with or without escapes.
+func capturePaneText(pane string, full, keep bool) (string, error) {
+	if onScreen() {
+		// hardcopy has no colors
+		keep = false
+	}
+	switch {
+	case full && keep:
+		return capturePaneFullANSI(pane)
+	case full:
+		return capturePaneFull(pane)
+	case keep:
+		return capturePaneANSI(pane)
+	}
+	return capturePane(pane)
+}
+
+// printColored prints buffer contents. Text with escapes is written as is,
+// followed by a reset so the captured colors do not leak into the prompt.
+func printColored(s string) {
+	if !ansi.Has(s) {
+		cprint(s)
+		return
+	}
+	captureOut(s, false)
+	fmt.Print(s + "\033[0m")
+}
+
+// stripCommand implements !strip <buffer> [dest].
+func stripCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!strip"].Usage)
+		return
+	}
+	data, ok := readBuffer(args[0])
+	if !ok {
+		cmdPrintln("unknown buffer")
+		return
+	}
+	dest := args[0]
+	if len(args) > 1 {
+		dest = args[1]
+	}
+	if _, ok := buffers[dest]; !ok && dest != args[0] {
+		if err := validateBufferName(dest); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+	}
+	writeBuffer(dest, ansi.Strip(data))
+}
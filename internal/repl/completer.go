@@ -3,8 +3,6 @@ package repl
 import (
 	"path/filepath"
 	"strings"
-
-	"github.com/glo0ml34f/grimux/internal/tmux"
 )
 
 type autoCompleter struct{}
@@ -23,13 +21,19 @@ func (c *autoCompleter) Do(line []rune, pos int) ([][]rune, int) {
 				suggestions = append(suggestions, name[len(prefix):])
 			}
 		}
-		ids, _ := tmux.ListPaneIDs()
-		for _, id := range ids {
-			if strings.HasPrefix(id, prefix) {
-				suggestions = append(suggestions, id[len(prefix):])
+		panes, _ := listPanes()
+		for _, p := range panes {
+			refs := []string{p.ID}
+			if p.Label != "" {
+				refs = append(refs, "%pane:"+p.Label)
+			}
+			for _, ref := range refs {
+				if strings.HasPrefix(ref, prefix) {
+					suggestions = append(suggestions, ref[len(prefix):])
+				}
 			}
 		}
-		bufs, _ := tmux.ListBuffers()
+		bufs, _ := mx.ListBuffers()
 		for _, b := range bufs {
 			name := "%" + b.Name
 			if strings.HasPrefix(name, prefix) {
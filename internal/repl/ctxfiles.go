@@ -0,0 +1,317 @@
+package repl
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ctxFiles lists files attached to prompts, stored as absolute paths.
+var ctxFiles []string
+
+// ctxBudget is the approximate token budget for attached files.
+var ctxBudget = 8000
+
+// estimateTokens gives a rough token count using the usual 4 bytes per token.
+func estimateTokens(s string) int { return (len(s) + 3) / 4 }
+
+// ignoreRule is a single .gitignore pattern.
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// gitIgnore matches paths against the .gitignore files of a repository.
+// Rules are kept per directory, relative to root, and nested files are read
+// the first time a path below them is checked.
+type gitIgnore struct {
+	root  string
+	rules map[string][]ignoreRule
+}
+
+// findRepoRoot walks up from dir looking for a .git directory. If none is
+// found dir itself is returned.
+func findRepoRoot(dir string) string {
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
+
+// parseIgnore reads the rules of one .gitignore file.
+func parseIgnore(data string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r ignoreRule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			r.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		r.pattern = line
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// loadGitIgnore prepares matching for the repository containing dir.
+func loadGitIgnore(dir string) *gitIgnore {
+	return &gitIgnore{root: findRepoRoot(dir), rules: map[string][]ignoreRule{}}
+}
+
+// dirRules returns the rules of the .gitignore in dir, which is relative to
+// the root.
+func (g *gitIgnore) dirRules(dir string) []ignoreRule {
+	rules, ok := g.rules[dir]
+	if !ok {
+		data, _ := os.ReadFile(filepath.Join(g.root, filepath.FromSlash(dir), ".gitignore"))
+		rules = parseIgnore(string(data))
+		g.rules[dir] = rules
+	}
+	return rules
+}
+
+// matches applies the .gitignore files from the root down to the directory
+// holding parts, so deeper files override shallower ones.
+func (g *gitIgnore) matches(parts []string, isDir bool) bool {
+	ignored := false
+	for d := 0; d < len(parts); d++ {
+		rel := parts[d:]
+		for _, r := range g.dirRules(strings.Join(parts[:d], "/")) {
+			if r.dirOnly && !isDir {
+				continue
+			}
+			match := false
+			if r.anchored {
+				match, _ = filepath.Match(r.pattern, strings.Join(rel, "/"))
+			} else {
+				match, _ = filepath.Match(r.pattern, rel[len(rel)-1])
+			}
+			if match {
+				ignored = !r.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// ignored reports whether path (absolute) is excluded by the rules, either
+// itself or through one of its parent directories.
+func (g *gitIgnore) ignored(path string, isDir bool) bool {
+	rel, err := filepath.Rel(g.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if parts[0] == ".git" {
+		return true
+	}
+	for i := 1; i <= len(parts); i++ {
+		if g.matches(parts[:i], i < len(parts) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// globFiles expands pattern into regular files. A "**" element matches any
+// number of directories. Files and directories ignored by git are skipped.
+func globFiles(pattern string) ([]string, error) {
+	cwd, _ := os.Getwd()
+	gi := loadGitIgnore(cwd)
+	var out []string
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			abs, _ := filepath.Abs(m)
+			if fi, err := os.Stat(abs); err == nil && fi.Mode().IsRegular() && !gi.ignored(abs, false) {
+				out = append(out, abs)
+			}
+		}
+		return out, nil
+	}
+	idx := strings.Index(pattern, "**")
+	root := filepath.Clean(pattern[:idx])
+	if pattern[:idx] == "" {
+		root = "."
+	}
+	rest := strings.TrimPrefix(pattern[idx+2:], string(filepath.Separator))
+	if rest == "" {
+		rest = "*"
+	}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		abs, _ := filepath.Abs(path)
+		if gi.ignored(abs, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if ok, _ := filepath.Match(rest, d.Name()); ok {
+			out = append(out, abs)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// ctxDisplayName shows a context file relative to the working directory when
+// possible.
+func ctxDisplayName(path string) string {
+	cwd, _ := os.Getwd()
+	if rel, err := filepath.Rel(cwd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// buildFileContext renders attached files with path headers, stopping at the
+// token budget. Names of files that did not fit are returned.
+func buildFileContext() (string, []string) {
+	var b strings.Builder
+	var dropped []string
+	used := 0
+	for _, path := range ctxFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			dropped = append(dropped, ctxDisplayName(path))
+			continue
+		}
+		block := fmt.Sprintf("==> %s <==\n```\n%s\n```\n", ctxDisplayName(path), strings.TrimRight(string(data), "\n"))
+		n := estimateTokens(block)
+		if used+n > ctxBudget {
+			dropped = append(dropped, ctxDisplayName(path))
+			continue
+		}
+		used += n
+		b.WriteString(block)
+	}
+	return b.String(), dropped
+}
+
+// withFileContext prepends attached files to a prompt, warning when some of
+// them were dropped to stay within budget.
+func withFileContext(prompt string) string {
+	if len(ctxFiles) == 0 {
+		return prompt
+	}
+	files, dropped := buildFileContext()
+	if len(dropped) > 0 {
+		warnPrintln(fmt.Sprintf("ctx: dropped %d file(s) over the %d token budget: %s", len(dropped), ctxBudget, strings.Join(dropped, ", ")))
+	}
+	if files == "" {
+		return prompt
+	}
+	return "Files:\n" + files + "---\n" + prompt
+}
+
+// ctxCommand implements !ctx add|ls|rm|budget.
+func ctxCommand(args []string) {
+	if len(args) == 0 {
+		cmdPrintln("usage: " + commands["!ctx"].Usage)
+		return
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			cmdPrintln("usage: !ctx add <glob>")
+			return
+		}
+		added := 0
+		for _, pat := range args[1:] {
+			files, err := globFiles(pat)
+			if err != nil {
+				cmdPrintln("ctx error: " + err.Error())
+				return
+			}
+			for _, f := range files {
+				dup := false
+				for _, existing := range ctxFiles {
+					if existing == f {
+						dup = true
+						break
+					}
+				}
+				if !dup {
+					ctxFiles = append(ctxFiles, f)
+					added++
+				}
+			}
+		}
+		cmdPrintln(fmt.Sprintf("added %d file(s)", added))
+	case "ls":
+		total := 0
+		for _, path := range ctxFiles {
+			n := 0
+			if fi, err := os.Stat(path); err == nil {
+				n = int(fi.Size()+3) / 4
+			}
+			total += n
+			cmdPrintln(fmt.Sprintf("%s (~%d tokens)", ctxDisplayName(path), n))
+		}
+		cmdPrintln(fmt.Sprintf("total ~%d of %d tokens", total, ctxBudget))
+	case "rm":
+		if len(args) < 2 {
+			cmdPrintln("usage: !ctx rm <glob|all>")
+			return
+		}
+		if args[1] == "all" {
+			ctxFiles = nil
+			return
+		}
+		kept := ctxFiles[:0]
+		for _, path := range ctxFiles {
+			name := ctxDisplayName(path)
+			match, _ := filepath.Match(args[1], name)
+			if !match && name != args[1] && path != args[1] {
+				kept = append(kept, path)
+			}
+		}
+		cmdPrintln(fmt.Sprintf("removed %d file(s)", len(ctxFiles)-len(kept)))
+		ctxFiles = kept
+	case "budget":
+		if len(args) < 2 {
+			cmdPrintln(fmt.Sprintf("budget %d tokens", ctxBudget))
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			cmdPrintln("bad budget")
+			return
+		}
+		ctxBudget = n
+	default:
+		cmdPrintln("unknown subcommand")
+	}
+}
@@ -0,0 +1,96 @@
+package repl
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var panePosition = tmux.PanePosition
+var capturePaneRange = tmux.CapturePaneRange
+
+// captureMark is where the last capture of a pane ended: the absolute line
+// the cursor was on and the text of the line above it. The anchor catches
+// panes that were cleared or whose history rotated past the mark.
+type captureMark struct {
+	line   int
+	anchor string
+}
+
+// captureMarks holds the last capture position per pane id.
+var captureMarks = map[string]captureMark{}
+
+// lineAt returns the text of absolute line abs of pane.
+func lineAt(pane string, history, abs int) string {
+	if abs < 0 {
+		return ""
+	}
+	out, err := capturePaneRange(pane, abs-history, abs-history, false)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(out, " \n")
+}
+
+// markPane remembers the cursor position so the next delta capture starts
+// there.
+func markPane(pane string, history, cursor int) {
+	abs := history + cursor
+	captureMarks[pane] = captureMark{line: abs, anchor: lineAt(pane, history, abs-1)}
+}
+
+// deltaCapture returns the lines from the cursor line of the previous
+// capture up to the current cursor line. The old cursor line is included
+// because it usually held a prompt that has since been completed. ok is
+// false when there is no usable mark.
+func deltaCapture(pane string, history, cursor int, escapes bool) (out string, ok bool, err error) {
+	m, found := captureMarks[pane]
+	if !found || m.line > history+cursor {
+		return "", false, nil
+	}
+	if lineAt(pane, history, m.line-1) != m.anchor {
+		return "", false, nil
+	}
+	out, err = capturePaneRange(pane, m.line-history, cursor, escapes)
+	if err != nil {
+		return "", false, err
+	}
+	out = strings.TrimRight(out, " \n")
+	if out != "" {
+		out += "\n"
+	}
+	return out, true, nil
+}
+
+// captureSince captures pane like capturePaneText and records the position
+// for later deltas. With delta set only the lines since the previous
+// capture are returned; the first delta of a pane, or one after the pane
+// was cleared, falls back to a normal capture.
+func captureSince(pane string, full, escapes, delta bool) (string, error) {
+	if delta && onScreen() {
+		return "", errors.New("captures with -d need tmux")
+	}
+	history, cursor, posErr := panePosition(pane)
+	if delta {
+		if posErr != nil {
+			return "", posErr
+		}
+		out, ok, err := deltaCapture(pane, history, cursor, escapes)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			markPane(pane, history, cursor)
+			return out, nil
+		}
+	}
+	out, err := capturePaneText(pane, full, escapes)
+	if err != nil {
+		return "", err
+	}
+	if posErr == nil {
+		markPane(pane, history, cursor)
+	}
+	return out, nil
+}
@@ -0,0 +1,50 @@
+package repl
+
+import (
+	"github.com/glo0ml34f/grimux/internal/plugin"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+// tmuxEventCh queues control mode notifications until the main loop can hand
+// them to plugins. Lua states are not safe to use from the reader goroutine.
+var tmuxEventCh = make(chan tmux.Event, 256)
+
+// startTmuxControl opens the control mode connection and forwards its
+// notifications to tmuxEventCh. When control mode is unavailable grimux keeps
+// forking tmux for every command.
+func startTmuxControl() func() {
+	if mx.Name() != "tmux" {
+		return func() {}
+	}
+	c, err := tmux.StartControl()
+	if err != nil {
+		return func() {}
+	}
+	cancel := c.Subscribe(func(ev tmux.Event) {
+		notifyWatches(ev)
+		select {
+		case tmuxEventCh <- ev:
+		default:
+			// drop events rather than stall the reader
+		}
+	})
+	return func() {
+		cancel()
+		c.Close()
+	}
+}
+
+// dispatchTmuxEvents delivers queued notifications to subscribed plugins.
+func dispatchTmuxEvents() {
+	mgr := plugin.GetManager()
+	for {
+		select {
+		case ev := <-tmuxEventCh:
+			if mgr.HasSubscriber(ev.Name) {
+				mgr.DispatchEvent(ev.Name, ev.Pane, ev.Data)
+			}
+		default:
+			return
+		}
+	}
+}
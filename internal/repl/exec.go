@@ -0,0 +1,196 @@
+package repl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// execRunner describes how a language is run inside the sandbox directory.
+// {file} and {dir} in the command are replaced before it is passed to bash.
+type execRunner struct {
+	ext string
+	cmd string
+}
+
+var execRunners = map[string]execRunner{
+	"python": {ext: ".py", cmd: "python3 {file}"},
+	"bash":   {ext: ".sh", cmd: "bash {file}"},
+	"go":     {ext: ".go", cmd: "go run {file}"},
+	"c":      {ext: ".c", cmd: "gcc -o {dir}/prog {file} && {dir}/prog"},
+}
+
+// langAliases maps code fence names and interpreters to runner names.
+var langAliases = map[string]string{
+	"py":      "python",
+	"python":  "python",
+	"python3": "python",
+	"sh":      "bash",
+	"bash":    "bash",
+	"shell":   "bash",
+	"zsh":     "bash",
+	"go":      "go",
+	"golang":  "go",
+	"c":       "c",
+	"gcc":     "c",
+}
+
+var execTimeout = 30 * time.Second
+var execMaxOutput = 64 * 1024
+
+// fencePattern captures the language and body of fenced code blocks.
+var fencePattern = regexp.MustCompile("(?s)```([a-zA-Z0-9_+-]*)\n(.*?)\n```")
+
+// detectCode extracts code from a buffer and guesses its language from the
+// last code fence or a shebang line. The returned language may be empty.
+func detectCode(data string) (code, lang string) {
+	code = data
+	if m := fencePattern.FindAllStringSubmatch(data, -1); len(m) > 0 {
+		last := m[len(m)-1]
+		code = last[2]
+		lang = langAliases[strings.ToLower(last[1])]
+	}
+	if lang == "" && strings.HasPrefix(code, "#!") {
+		first := strings.Fields(strings.SplitN(code, "\n", 2)[0][2:])
+		if len(first) > 0 {
+			interp := filepath.Base(first[0])
+			if interp == "env" && len(first) > 1 {
+				interp = first[1]
+			}
+			lang = langAliases[interp]
+		}
+	}
+	return code, lang
+}
+
+// cappedBuffer stores at most limit bytes and records whether more arrived.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	room := c.limit - c.buf.Len()
+	if room <= 0 {
+		c.truncated = c.truncated || len(p) > 0
+		return len(p), nil
+	}
+	if len(p) > room {
+		c.buf.Write(p[:room])
+		c.truncated = true
+		return len(p), nil
+	}
+	c.buf.Write(p)
+	return len(p), nil
+}
+
+func (c *cappedBuffer) String() string {
+	if c.truncated {
+		return c.buf.String() + "\n[output truncated]\n"
+	}
+	return c.buf.String()
+}
+
+// execResult holds the outcome of a sandboxed run.
+type execResult struct {
+	stdout   string
+	stderr   string
+	status   int
+	timedOut bool
+}
+
+// runSandboxed writes code into a fresh temp directory and runs it with the
+// runner for lang, enforcing execTimeout and execMaxOutput.
+func runSandboxed(code, lang string) (execResult, error) {
+	var res execResult
+	runner, ok := execRunners[lang]
+	if !ok {
+		return res, fmt.Errorf("no runner for language %q", lang)
+	}
+	dir, err := os.MkdirTemp("", "grimux-exec-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "main"+runner.ext)
+	if err := os.WriteFile(file, []byte(code+"\n"), 0700); err != nil {
+		return res, err
+	}
+	cmdStr := strings.NewReplacer("{file}", strconv.Quote(file), "{dir}", strconv.Quote(dir)).Replace(runner.cmd)
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+	c := exec.CommandContext(ctx, "bash", "-c", cmdStr)
+	c.Dir = dir
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error { return syscall.Kill(-c.Process.Pid, syscall.SIGKILL) }
+	c.WaitDelay = time.Second
+	stdout := &cappedBuffer{limit: execMaxOutput}
+	stderr := &cappedBuffer{limit: execMaxOutput}
+	c.Stdout = stdout
+	c.Stderr = stderr
+	err = c.Run()
+	res.stdout = stdout.String()
+	res.stderr = stderr.String()
+	if ctx.Err() == context.DeadlineExceeded {
+		res.timedOut = true
+		res.status = -1
+		return res, nil
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		res.status = ee.ExitCode()
+		return res, nil
+	}
+	return res, err
+}
+
+// execCommand implements !exec <buffer> [lang].
+func execCommand(bufName, lang string) {
+	data, ok := readBuffer(bufName)
+	if !ok {
+		cmdPrintln("unknown buffer")
+		return
+	}
+	code, detected := detectCode(data)
+	if lang == "" {
+		lang = detected
+	} else if alias, ok := langAliases[strings.ToLower(lang)]; ok {
+		lang = alias
+	}
+	if lang == "" {
+		cmdPrintln("cannot detect language; pass one of python, bash, go, c")
+		return
+	}
+	res, err := runSandboxed(code, lang)
+	if err != nil {
+		cmdPrintln("exec error: " + err.Error())
+		return
+	}
+	status := strconv.Itoa(res.status)
+	if res.timedOut {
+		status = "timeout"
+	}
+	buffers["%exec_out"] = res.stdout
+	buffers["%exec_err"] = res.stderr
+	buffers["%exec_status"] = status
+	cprint(res.stdout)
+	if res.stderr != "" {
+		warnPrintln(res.stderr)
+	}
+	if res.timedOut {
+		warnPrintln(fmt.Sprintf("killed after %s", execTimeout))
+	} else {
+		cmdPrintln("exit status " + status)
+	}
+	forceEnter()
+}
@@ -0,0 +1,397 @@
+package repl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expectTimeout is the default wait for !expect and interact scripts.
+var expectTimeout = 10 * time.Second
+
+// expectPoll is the delay between pane captures while waiting.
+var expectPoll = 100 * time.Millisecond
+
+// interactMaxSteps stops scripts that loop forever through goto.
+const interactMaxSteps = 1000
+
+// paneText returns the full pane history without trailing blank space.
+func paneText(pane string) (string, error) {
+	out, err := capturePaneFull(pane)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(out, " \n"), nil
+}
+
+// expectAnchor is how many lines before a mark must still be in place for
+// the mark to be trusted.
+const expectAnchor = 3
+
+// expectMark is where matching resumes: a line of the pane history and a
+// column in it. Once history-limit is reached old lines are dropped and
+// line numbers shift, so the lines before the mark and the start of its own
+// line are kept to find it again, the way captureMark does for deltas.
+type expectMark struct {
+	line   int
+	col    int
+	anchor []string
+	prefix string
+}
+
+func newExpectMark(lines []string, line, col int) expectMark {
+	m := expectMark{line: line, col: col}
+	m.anchor = append([]string(nil), lines[max(0, line-expectAnchor):line]...)
+	m.prefix = lines[line][:col]
+	return m
+}
+
+// locate returns the line the mark is on now. Lines only move up as
+// history is trimmed, so the search goes from the old line number down.
+// Near the top anchor lines that were trimmed away are not compared.
+func (m expectMark) locate(lines []string) (int, bool) {
+	for l := min(m.line, len(lines)-1); l >= 0; l-- {
+		n := min(l, len(m.anchor))
+		if strings.HasPrefix(lines[l], m.prefix) && equalLines(m.anchor[len(m.anchor)-n:], lines[l-n:l]) {
+			return l, true
+		}
+	}
+	return 0, false
+}
+
+func paneLines(pane string) ([]string, error) {
+	text, err := paneText(pane)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// expectStart returns the mark matching starts from: the beginning of the
+// line the cursor is on, so a prompt that is already showing still counts
+// while older output does not.
+func expectStart(pane string) (expectMark, error) {
+	lines, err := paneLines(pane)
+	if err != nil {
+		return expectMark{}, err
+	}
+	return newExpectMark(lines, len(lines)-1, 0), nil
+}
+
+// expectWait polls pane until one of res matches the output after from. It
+// returns the index of the matching pattern and the mark just past the
+// match, or -1 when timeout expires.
+func expectWait(pane string, res []*regexp.Regexp, timeout time.Duration, from expectMark) (int, expectMark, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		lines, err := paneLines(pane)
+		if err != nil {
+			return -1, from, err
+		}
+		line, ok := from.locate(lines)
+		if !ok {
+			// the pane was cleared or trimmed past the mark, so only
+			// what follows the cursor line now is new
+			from = newExpectMark(lines, len(lines)-1, 0)
+			line = from.line
+		}
+		from.line = line
+		region := strings.Join(append([]string{lines[line][from.col:]}, lines[line+1:]...), "\n")
+		for i, re := range res {
+			if loc := re.FindStringSubmatchIndex(region); loc != nil {
+				storeMatch(re, region, loc)
+				before := region[:loc[1]]
+				end, col := line+strings.Count(before, "\n"), loc[1]-strings.LastIndex(before, "\n")-1
+				if end == line {
+					col += from.col
+				}
+				return i, newExpectMark(lines, end, col), nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return -1, from, nil
+		}
+		time.Sleep(expectPoll)
+	}
+}
+
+// storeMatch writes the match to %match, numbered groups to %match1..n and
+// named groups to %match_<name>, so a pattern cannot overwrite buffers such
+// as %session.
+func storeMatch(re *regexp.Regexp, text string, loc []int) {
+	names := re.SubexpNames()
+	for i := 0; i*2 < len(loc); i++ {
+		val := ""
+		if loc[i*2] >= 0 {
+			val = text[loc[i*2]:loc[i*2+1]]
+		}
+		if i == 0 {
+			buffers["%match"] = val
+			continue
+		}
+		buffers[fmt.Sprintf("%%match%d", i)] = val
+		if names[i] != "" {
+			buffers["%match_"+names[i]] = val
+		}
+	}
+}
+
+// parseTimeout reads a timeout in seconds, allowing fractions.
+func parseTimeout(s string) (time.Duration, error) {
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// parseExpect splits the text after the pane of !expect into the regex and
+// the timeout. A regex between slashes is taken verbatim and may be
+// followed by a timeout; otherwise the rest of the line is the regex, less
+// a trailing number that reads as a timeout.
+func parseExpect(text string) (string, time.Duration, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "/") {
+		pattern, rest, ok := cutSlashed(text)
+		if !ok {
+			return "", 0, fmt.Errorf("missing closing / in %q", text)
+		}
+		if rest = strings.TrimSpace(rest); rest == "" {
+			return pattern, expectTimeout, nil
+		}
+		d, err := parseTimeout(rest)
+		return pattern, d, err
+	}
+	if i := strings.LastIndexAny(text, " \t"); i >= 0 {
+		if d, err := parseTimeout(text[i+1:]); err == nil {
+			return strings.TrimRight(text[:i], " \t"), d, nil
+		}
+	}
+	return text, expectTimeout, nil
+}
+
+// expectCommand implements !expect <pane> <regex> [timeout]. line is the
+// text after !expect as typed, so regexes keep their spacing.
+func expectCommand(args []string, line string) {
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!expect"].Usage)
+		return
+	}
+	pane, err := paneArg(args[0])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	// len(args) > 1, so the pane is followed by white space
+	text := strings.TrimSpace(line)
+	pattern, timeout, err := parseExpect(text[strings.IndexAny(text, " \t"):])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		cmdPrintln("regex error: " + err.Error())
+		return
+	}
+	from, err := expectStart(pane)
+	if err != nil {
+		cmdPrintln("capture error: " + err.Error())
+		return
+	}
+	stop := spinner()
+	idx, _, err := expectWait(pane, []*regexp.Regexp{re}, timeout, from)
+	stop()
+	if err != nil {
+		cmdPrintln("capture error: " + err.Error())
+		return
+	}
+	if idx < 0 {
+		buffers["%match"] = ""
+		warnPrintln(fmt.Sprintf("expect: no match after %s", timeout))
+		return
+	}
+	successPrintln("matched: " + buffers["%match"])
+}
+
+// interactCase is one "on <regex> [=> label]" alternative of a wait.
+type interactCase struct {
+	re    *regexp.Regexp
+	label string
+}
+
+// runInteract executes an interact script against pane. Scripts are the
+// lines following "!interact <pane> [timeout]" in a macro:
+//
+//	send <text>           type text literally and press Enter
+//	keys <key>...         send tmux key names such as C-c
+//	expect <regex>        wait for regex, stop the script on timeout; the
+//	                      regex may be written /between slashes/
+//	on <regex> [=> label] consecutive on lines wait for whichever matches
+//	timeout => <label>    where to go when none of the on lines matched
+//	:label / goto label   jump targets
+//	sleep <secs>          pause
+//	end                   stop the script
+//	!command              run any grimux command
+func runInteract(pane string, timeout time.Duration, lines []string) error {
+	labels := map[string]int{}
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, ":") {
+			labels[strings.TrimSpace(l[1:])] = i
+		}
+	}
+	jump := func(label string) (int, error) {
+		pc, ok := labels[label]
+		if !ok {
+			return 0, fmt.Errorf("unknown label %q", label)
+		}
+		return pc, nil
+	}
+	from, err := expectStart(pane)
+	if err != nil {
+		return err
+	}
+	steps := 0
+	for pc := 0; pc < len(lines); pc++ {
+		if steps++; steps > interactMaxSteps {
+			return fmt.Errorf("script exceeded %d steps", interactMaxSteps)
+		}
+		line := strings.TrimSpace(lines[pc])
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ":") {
+			continue
+		}
+		word, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+		switch word {
+		case "send":
+			if err := writePane(pane, replaceBufferRefs(rest), true, false); err != nil {
+				return err
+			}
+		case "keys":
+			if err := sendKeys(pane, strings.Fields(rest)...); err != nil {
+				return err
+			}
+		case "sleep":
+			d, err := parseTimeout(rest)
+			if err != nil {
+				return err
+			}
+			time.Sleep(d)
+		case "goto":
+			next, err := jump(rest)
+			if err != nil {
+				return err
+			}
+			pc = next
+		case "end":
+			return nil
+		case "expect":
+			pattern := rest
+			if strings.HasPrefix(rest, "/") {
+				var after string
+				var ok bool
+				if pattern, after, ok = cutSlashed(rest); !ok || strings.TrimSpace(after) != "" {
+					return fmt.Errorf("bad expect pattern %q", rest)
+				}
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+			idx, end, err := expectWait(pane, []*regexp.Regexp{re}, timeout, from)
+			if err != nil {
+				return err
+			}
+			if idx < 0 {
+				return fmt.Errorf("timeout waiting for %q", rest)
+			}
+			from = end
+		case "on":
+			var cases []interactCase
+			timeoutLabel := ""
+			j := pc
+			for ; j < len(lines); j++ {
+				l := strings.TrimSpace(lines[j])
+				w, r, _ := strings.Cut(l, " ")
+				r = strings.TrimSpace(r)
+				if w == "timeout" {
+					timeoutLabel = strings.TrimSpace(strings.TrimPrefix(r, "=>"))
+					j++
+					break
+				}
+				if w != "on" {
+					break
+				}
+				pattern, label := r, ""
+				if i := strings.LastIndex(r, " => "); i >= 0 {
+					pattern, label = strings.TrimSpace(r[:i]), strings.TrimSpace(r[i+4:])
+				}
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return err
+				}
+				cases = append(cases, interactCase{re: re, label: label})
+			}
+			res := make([]*regexp.Regexp, len(cases))
+			for i, c := range cases {
+				res[i] = c.re
+			}
+			idx, end, err := expectWait(pane, res, timeout, from)
+			if err != nil {
+				return err
+			}
+			label := timeoutLabel
+			if idx >= 0 {
+				from = end
+				label = cases[idx].label
+			} else if label == "" {
+				return fmt.Errorf("timeout waiting for any of %d patterns", len(cases))
+			}
+			if label == "" {
+				pc = j - 1
+				continue
+			}
+			next, err := jump(label)
+			if err != nil {
+				return err
+			}
+			pc = next
+		default:
+			if strings.HasPrefix(line, "!") {
+				handleCommand(line)
+				continue
+			}
+			return fmt.Errorf("unknown directive %q", word)
+		}
+	}
+	return nil
+}
+
+// interactCommand runs the rest of a macro as an interact script. It is only
+// reachable from !macro, which passes the remaining lines.
+func interactCommand(args []string, lines []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!interact"].Usage)
+		return
+	}
+	timeout := expectTimeout
+	if len(args) > 1 {
+		d, err := parseTimeout(args[1])
+		if err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		timeout = d
+	}
+	pane, err := resolvePane(args[0])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	if err := runInteract(pane, timeout, lines); err != nil {
+		warnPrintln("interact: " + err.Error())
+	}
+}
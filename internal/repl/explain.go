@@ -0,0 +1,374 @@
+package repl
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glo0ml34f/grimux/internal/openai"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var paneDeadStatus = tmux.PaneDeadStatus
+
+// errorSignatures recognise failures in pane output: compiler and linker
+// errors, tracebacks, panics, crashes and exit codes tools print. Exit
+// codes of commands themselves come from tmux, see watchExit, or from
+// exitHook.
+var errorSignatures = []*regexp.Regexp{
+	regexp.MustCompile(`^\S+:\d+:(\d+:)? (fatal )?error: `),              // gcc, clang
+	regexp.MustCompile(`^\S+\.go:\d+:\d+: `),                             // go build
+	regexp.MustCompile(`^error(\[E\d+\])?: `),                            // rustc, cargo
+	regexp.MustCompile(`(collect2|ld): error: |undefined reference to `), // linker
+	regexp.MustCompile(`^Traceback \(most recent call last\):`),          // python
+	regexp.MustCompile(`^(panic: |fatal error: )`),                       // go runtime
+	regexp.MustCompile(`Segmentation fault|core dumped|AddressSanitizer`),
+	regexp.MustCompile(`^make(\[\d+\])?: \*\*\* .*Error \d+`),
+	regexp.MustCompile(`(^|\W)exit (status|code):? [1-9]\d*\b|returned [1-9]\d* exit status`),
+}
+
+// exitHook makes bash or zsh print exitMarker after every command that
+// failed. Shells report the exit codes of commands typed into them to no
+// one, so this is the only way to learn them; !explain hook installs it.
+// The quotes split the marker so the typed line does not match it.
+const exitHook = `__grimux_exit() { local s=$?; [ $s -ne 0 ] && [ "$HISTCMD" != "${__grimux_h-}" ] && printf '__GRIMUX_E''XIT_%s__\n' $s; __grimux_h=$HISTCMD; }; ` +
+	`if [ -n "$ZSH_VERSION" ]; then precmd_functions+=(__grimux_exit); else PROMPT_COMMAND="__grimux_exit${PROMPT_COMMAND:+;$PROMPT_COMMAND}"; fi`
+
+var exitMarker = regexp.MustCompile(`^__GRIMUX_EXIT_(\d+)__$`)
+
+// explainLines is how much recent pane output goes with an explanation.
+var explainLines = 80
+
+// explainCooldown keeps a burst of errors from announcing itself more than
+// once.
+var explainCooldown = 10 * time.Second
+
+// paneError is the last failure seen on a watched pane.
+type paneError struct {
+	pane string
+	line string
+	at   time.Time
+}
+
+type explainWatch struct {
+	pane string // as typed
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+var explainMu sync.Mutex
+var explainWatches = map[string]*explainWatch{}
+var lastError *paneError
+
+// explainNotices holds detected errors until the prompt announces them.
+var explainNotices = make(chan paneError, 16)
+
+// detectError returns the first line that looks like a failure.
+func detectError(lines []string) (string, bool) {
+	for _, l := range lines {
+		for _, re := range errorSignatures {
+			if re.MatchString(l) {
+				return l, true
+			}
+		}
+	}
+	return "", false
+}
+
+// checkErrors records a failure in new output of pane.
+func checkErrors(pane string, lines []string) {
+	for _, l := range lines {
+		if m := exitMarker.FindStringSubmatch(strings.TrimSpace(l)); m != nil {
+			reportError(pane, "exit status "+m[1])
+			return
+		}
+	}
+	if line, ok := detectError(lines); ok {
+		reportError(pane, line)
+	}
+}
+
+// noteExitStatus records a non-zero exit status of a command run in pane,
+// as !run_on learns from its end marker, when the pane is watched.
+func noteExitStatus(pane, status string) {
+	explainMu.Lock()
+	watched := explainWatches[pane] != nil
+	explainMu.Unlock()
+	if watched && status != "0" && status != "timeout" {
+		reportError(pane, "exit status "+status)
+	}
+}
+
+// watchExit reports the exit status of the command a pane runs once it
+// exits with remain-on-exit set, until stop is closed.
+func watchExit(pane string, stop <-chan struct{}) {
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		dead, status, err := paneDeadStatus(pane)
+		if err != nil {
+			return
+		}
+		if dead && status != 0 && !reported {
+			reportError(pane, fmt.Sprintf("exit status %d", status))
+		}
+		// respawn-pane brings the pane back for another run
+		reported = dead
+	}
+}
+
+// reportError records a failure in pane and asks the prompt to announce it.
+func reportError(pane, line string) {
+	explainMu.Lock()
+	now := time.Now()
+	announce := lastError == nil || lastError.pane != pane || now.Sub(lastError.at) >= explainCooldown
+	lastError = &paneError{pane: pane, line: line, at: now}
+	explainMu.Unlock()
+	if !announce {
+		return
+	}
+	select {
+	case explainNotices <- paneError{pane: pane, line: line, at: now}:
+	default:
+	}
+	wakePrompt()
+}
+
+// announceErrors prints the errors detected since the last prompt.
+func announceErrors() {
+	for {
+		select {
+		case e := <-explainNotices:
+			warnPrintln(fmt.Sprintf("error in %s: %s", e.pane, e.line))
+			cmdPrintln("press Ctrl+E or run !explain for a diagnosis")
+		default:
+			return
+		}
+	}
+}
+
+// startExplain watches pane for errors.
+func startExplain(pane string) error {
+	id, err := resolvePane(pane)
+	if err != nil {
+		return err
+	}
+	explainMu.Lock()
+	defer explainMu.Unlock()
+	if explainWatches[id] != nil {
+		return fmt.Errorf("already watching %s", pane)
+	}
+	w := &explainWatch{pane: pane, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	explainWatches[id] = w
+	go func() {
+		defer close(w.done)
+		if mx.Name() == "tmux" {
+			exited := make(chan struct{})
+			defer func() { <-exited }()
+			go func() {
+				defer close(exited)
+				watchExit(id, w.stop)
+			}()
+		}
+		err := followPane(id, w.wake, w.stop, func(lines []string) { checkErrors(id, lines) })
+		if err != nil {
+			select {
+			case pluginMsgCh <- pluginMsg{name: "explain", text: fmt.Sprintf("stopped watching %s: %v", pane, err)}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// wakeExplain asks the watcher of pane to look for output right away.
+func wakeExplain(pane string) {
+	explainMu.Lock()
+	defer explainMu.Unlock()
+	if w := explainWatches[pane]; w != nil {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stopExplain stops watching the pane with id, or every pane when id is
+// empty, and waits for the watchers to end. It returns the number stopped.
+func stopExplain(id string) int {
+	explainMu.Lock()
+	var ws []*explainWatch
+	for p, w := range explainWatches {
+		if id == "" || p == id {
+			close(w.stop)
+			delete(explainWatches, p)
+			ws = append(ws, w)
+		}
+	}
+	if id == "" {
+		lastError = nil
+	}
+	explainMu.Unlock()
+	for _, w := range ws {
+		<-w.done
+	}
+	return len(ws)
+}
+
+// explainPrompt asks for a diagnosis of output, which ends with or contains
+// the failing line.
+func explainPrompt(output, line string) string {
+	var b strings.Builder
+	b.WriteString("The following is recent output of a terminal pane where a command failed.\n")
+	if line != "" {
+		b.WriteString("The first error line seen was: " + line + "\n")
+	}
+	b.WriteString("Explain briefly what went wrong and why, then suggest a fix. ")
+	b.WriteString("If the fix is a change to code or a command, give it in a fenced code block.\n\n```\n")
+	b.WriteString(output)
+	b.WriteString("\n```")
+	return b.String()
+}
+
+// recentOutput returns the last explainLines lines of a pane, history
+// included.
+func recentOutput(pane string) (string, error) {
+	out, err := capturePaneFull(pane)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(out, " \n"), "\n")
+	if len(lines) > explainLines {
+		lines = lines[len(lines)-explainLines:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// explainError sends the output of pane to the AI and stores the diagnosis
+// in %explain and the suggested fix, if any, in %explain_fix.
+func explainError(pane, line string) {
+	output, err := recentOutput(pane)
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	client, err := openai.NewClient()
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	stop := spinner()
+	reply, err := client.SendPrompt(explainPrompt(output, line))
+	stop()
+	if err != nil {
+		cprintln("openai error: " + err.Error())
+		return
+	}
+	buffers["%explain"] = reply
+	if fix := lastCodeBlock(reply); fix != "" {
+		buffers["%explain_fix"] = fix
+	} else {
+		delete(buffers, "%explain_fix")
+	}
+	respDivider()
+	renderMarkdown(reply)
+	respDivider()
+	if auditMode {
+		auditLog = append(auditLog, reply)
+		maybeSummarizeAudit()
+	}
+	if usePopup("answer") {
+		viewInPopup("grimux explain "+pane, reply)
+	}
+}
+
+// explainCommand implements !explain [pane], !explain on <pane>,
+// !explain off [pane|all], !explain hook [pane] and !explain ls.
+func explainCommand(args []string) {
+	if len(args) == 0 {
+		explainMu.Lock()
+		e := lastError
+		lastError = nil
+		explainMu.Unlock()
+		if e == nil {
+			cmdPrintln("no error seen, use !explain <pane> or !explain on <pane>")
+			return
+		}
+		explainError(e.pane, e.line)
+		return
+	}
+	switch args[0] {
+	case "on":
+		if len(args) < 2 {
+			cmdPrintln("usage: " + commands["!explain"].Usage)
+			return
+		}
+		if err := startExplain(args[1]); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		successPrintln("watching " + args[1] + " for errors")
+	case "off":
+		id := ""
+		if len(args) > 1 && args[1] != "all" {
+			var err error
+			if id, err = resolvePane(args[1]); err != nil {
+				cmdPrintln(err.Error())
+				return
+			}
+		}
+		if stopExplain(id) == 0 {
+			cmdPrintln("not watching")
+		}
+	case "hook":
+		if len(args) < 2 {
+			cmdPrintln(exitHook)
+			return
+		}
+		pane, err := paneArg(args[1])
+		if err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		if err := writePane(pane, exitHook, true, false); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		successPrintln("exit codes of commands in " + args[1] + " now show up")
+	case "ls":
+		explainMu.Lock()
+		defer explainMu.Unlock()
+		if len(explainWatches) == 0 {
+			cmdPrintln("not watching any pane")
+			return
+		}
+		var ids []string
+		for id := range explainWatches {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			cmdPrintln(colorize(paneColor, explainWatches[id].pane))
+		}
+		if lastError != nil {
+			cmdPrintln(fmt.Sprintf("last error in %s: %s", lastError.pane, lastError.line))
+		}
+	default:
+		id, err := resolvePane(args[0])
+		if err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		explainError(id, "")
+	}
+}
@@ -0,0 +1,208 @@
+package repl
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// paneGroups maps group names to the pane ids !broadcast sends to.
+var paneGroups = map[string][]string{}
+
+// groupPattern keeps group names usable inside %<group>_<pane> buffers.
+var groupPattern = regexp.MustCompile(`^\w+$`)
+
+// broadcastSettle is how long a pane must stay unchanged before its output
+// is collected when its prompt did not come back.
+var broadcastSettle = 3 * time.Second
+
+// broadcastTimeout bounds the wait for all panes to settle.
+var broadcastTimeout = 30 * time.Second
+
+// broadcastPoll is the delay between captures while waiting.
+var broadcastPoll = 100 * time.Millisecond
+
+// groupCommand implements !group add|rm|ls.
+func groupCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!group"].Usage)
+		return
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			cmdPrintln("usage: " + commands["!group"].Usage)
+			return
+		}
+		name := args[1]
+		if !groupPattern.MatchString(name) {
+			cmdPrintln("group names may only use letters, digits and _")
+			return
+		}
+		for _, p := range args[2:] {
+			id, err := paneArg(p)
+			if err != nil {
+				cmdPrintln(err.Error())
+				return
+			}
+			if !slices.Contains(paneGroups[name], id) {
+				paneGroups[name] = append(paneGroups[name], id)
+			}
+		}
+		successPrintln(fmt.Sprintf("%s: %s", name, strings.Join(paneGroups[name], " ")))
+	case "rm":
+		if len(args) < 2 {
+			cmdPrintln("usage: " + commands["!group"].Usage)
+			return
+		}
+		name := args[1]
+		if _, ok := paneGroups[name]; !ok {
+			cmdPrintln("unknown group " + name)
+			return
+		}
+		if len(args) == 2 {
+			delete(paneGroups, name)
+			return
+		}
+		var drop []string
+		for _, p := range args[2:] {
+			id, err := paneArg(p)
+			if err != nil {
+				cmdPrintln(err.Error())
+				return
+			}
+			if !slices.Contains(paneGroups[name], id) {
+				cmdPrintln(fmt.Sprintf("%s is not in %s", p, name))
+				continue
+			}
+			drop = append(drop, id)
+		}
+		var keep []string
+		for _, id := range paneGroups[name] {
+			if !slices.Contains(drop, id) {
+				keep = append(keep, id)
+			}
+		}
+		if len(keep) == 0 {
+			delete(paneGroups, name)
+		} else {
+			paneGroups[name] = keep
+		}
+	case "ls":
+		if len(paneGroups) == 0 {
+			cmdPrintln("no groups")
+			return
+		}
+		names := make([]string, 0, len(paneGroups))
+		for name := range paneGroups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cmdPrintln(fmt.Sprintf("%s: %s", colorize(bufferColor, name), colorize(paneColor, strings.Join(paneGroups[name], " "))))
+		}
+	default:
+		cmdPrintln("unknown subcommand")
+	}
+}
+
+// groupBuffer names the buffer holding pane's output of a broadcast.
+func groupBuffer(group, pane string) string {
+	return "%" + group + "_" + strings.TrimPrefix(pane, "%")
+}
+
+// lastLine returns the last non-blank line of a capture, which is the
+// prompt while a shell is idle.
+func lastLine(capture string) string {
+	lines := strings.Split(strings.TrimRight(capture, " \n"), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// settlePanes waits until every pane changed and then stayed the same. A
+// pane showing its old prompt again is done as soon as it stops changing;
+// others need broadcastSettle of quiet. It returns the panes that never
+// settled.
+func settlePanes(panes []string, before map[string]string) []string {
+	last := map[string]string{}
+	changed := map[string]time.Time{}
+	for _, p := range panes {
+		last[p] = before[p]
+	}
+	deadline := time.Now().Add(broadcastTimeout)
+	for {
+		var pending []string
+		for _, p := range panes {
+			out, err := capturePane(p)
+			if err != nil {
+				continue
+			}
+			if out != last[p] {
+				last[p] = out
+				changed[p] = time.Now()
+			}
+			quiet := broadcastSettle
+			if lastLine(out) == lastLine(before[p]) {
+				quiet = 2 * broadcastPoll
+			}
+			if t, ok := changed[p]; !ok || time.Since(t) < quiet {
+				pending = append(pending, p)
+			}
+		}
+		if len(pending) == 0 || time.Now().After(deadline) {
+			return pending
+		}
+		time.Sleep(broadcastPoll)
+	}
+}
+
+// broadcastCommand implements !broadcast <group> <cmd>. The command is typed
+// into every pane of the group and, once the panes settle, the lines each
+// pane printed are stored in %<group>_<pane>.
+func broadcastCommand(args []string) {
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!broadcast"].Usage)
+		return
+	}
+	group := args[0]
+	panes, ok := paneGroups[group]
+	if !ok {
+		cmdPrintln("unknown group " + group)
+		return
+	}
+	cmd := replaceBufferRefs(strings.Join(args[1:], " "))
+	before := map[string]string{}
+	var sent []string
+	for _, p := range panes {
+		// mark where the output will start so only new lines are collected
+		history, cursor, err := panePosition(p)
+		if err != nil {
+			warnPrintln(fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		markPane(p, history, cursor)
+		before[p], _ = capturePane(p)
+		if err := writePane(p, cmd, true, false); err != nil {
+			warnPrintln(fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		sent = append(sent, p)
+	}
+	stop := spinner()
+	pending := settlePanes(sent, before)
+	stop()
+	for _, p := range sent {
+		out, err := captureSince(p, false, false, true)
+		if err != nil {
+			warnPrintln(fmt.Sprintf("%s: %v", p, err))
+			continue
+		}
+		writeBuffer(groupBuffer(group, p), out)
+	}
+	if len(pending) > 0 {
+		warnPrintln(fmt.Sprintf("still busy after %s: %s", broadcastTimeout, strings.Join(pending, " ")))
+	}
+	successPrintln(fmt.Sprintf("collected %d pane(s) into %s", len(sent), groupBuffer(group, "*")))
+}
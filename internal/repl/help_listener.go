@@ -22,6 +22,14 @@ func (h *helpListener) OnChange(line []rune, pos int, key rune) ([]rune, int, bo
 		handleCommand("!x")
 		forceEnter()
 		return []rune{}, 0, true
+	case 5: // Ctrl+E on an empty line explains the last error
+		if strings.TrimSpace(string(line)) != "" {
+			return nil, 0, false
+		}
+		fmt.Println()
+		handleCommand("!explain")
+		forceEnter()
+		return []rune{}, 0, true
 	case 4: // Ctrl+D
 		fmt.Println()
 		handleCommand("!quit")
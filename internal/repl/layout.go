@@ -0,0 +1,235 @@
+package repl
+
+import (
+	"fmt"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var currentSession = tmux.CurrentSession
+var listWindows = tmux.ListWindows
+var newWindow = tmux.NewWindow
+var selectLayout = tmux.SelectLayout
+var setPaneTitle = tmux.SetPaneTitle
+
+// layoutPane is a pane saved with the session. Grimux marks the pane grimux
+// itself ran in; it is never started again.
+type layoutPane struct {
+	Dir     string `json:"dir,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Command string `json:"command,omitempty"`
+	Grimux  bool   `json:"grimux,omitempty"`
+}
+
+// layoutWindow is a window of the saved layout. Layout is the tmux layout
+// string, which select-layout accepts once the pane count matches.
+type layoutWindow struct {
+	Name   string       `json:"name"`
+	Layout string       `json:"layout"`
+	Active bool         `json:"active,omitempty"`
+	Panes  []layoutPane `json:"panes"`
+}
+
+// savedLayout is the layout stored in the session file.
+var savedLayout []layoutWindow
+
+// layoutAutoRestore recreates savedLayout when a session is loaded.
+var layoutAutoRestore bool
+
+// captureLayout records the windows and panes of the current session.
+func captureLayout() ([]layoutWindow, error) {
+	session, err := currentSession()
+	if err != nil {
+		return nil, err
+	}
+	wins, err := listWindows(session)
+	if err != nil {
+		return nil, err
+	}
+	panes, err := listPanes()
+	if err != nil {
+		return nil, err
+	}
+	self := tmux.CurrentPane()
+	var out []layoutWindow
+	for _, w := range wins {
+		lw := layoutWindow{Name: w.Name, Layout: w.Layout, Active: w.Active}
+		for _, p := range panes {
+			if p.Session != session || p.Window != w.Index {
+				continue
+			}
+			lw.Panes = append(lw.Panes, layoutPane{Dir: p.Path, Title: p.Title, Label: p.Label, Command: p.Start, Grimux: p.ID == self})
+		}
+		if len(lw.Panes) > 0 {
+			out = append(out, lw)
+		}
+	}
+	return out, nil
+}
+
+// restoreWindow recreates w. When w held grimux and the current window only
+// contains grimux, the other panes are split around it so the saved layout
+// lines up; otherwise a new window is created and the grimux pane becomes a
+// plain shell.
+func restoreWindow(w layoutWindow, alone bool) ([]string, error) {
+	self := tmux.CurrentPane()
+	gi := -1
+	for i, p := range w.Panes {
+		if p.Grimux {
+			gi = i
+		}
+	}
+	ids := make([]string, len(w.Panes))
+	split := func(i int, target string, before bool) error {
+		p := w.Panes[i]
+		cmd := p.Command
+		if p.Grimux {
+			cmd = ""
+		}
+		id, err := splitWindow(tmux.SplitOptions{Target: target, Before: before, Dir: p.Dir, Command: cmd})
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+		// keep room for the next split, the saved layout is applied last
+		selectLayout(id, "tiled")
+		return nil
+	}
+	start := 0
+	if gi >= 0 && alone && self != "" {
+		ids[gi] = self
+		// split-window -b inserts before the target, keeping pane order
+		for i := 0; i < gi; i++ {
+			if err := split(i, self, true); err != nil {
+				return ids, err
+			}
+		}
+		start = gi + 1
+	} else {
+		cmd := w.Panes[0].Command
+		if w.Panes[0].Grimux {
+			cmd = ""
+		}
+		id, err := newWindow(w.Name, w.Panes[0].Dir, cmd)
+		if err != nil {
+			return ids, err
+		}
+		ids[0] = id
+		start = 1
+	}
+	last := ids[start-1]
+	for i := start; i < len(w.Panes); i++ {
+		if err := split(i, last, false); err != nil {
+			return ids, err
+		}
+		last = ids[i]
+	}
+	if err := selectLayout(ids[0], w.Layout); err != nil {
+		warnPrintln(fmt.Sprintf("layout of %s not applied: %v", w.Name, err))
+	}
+	for i, p := range w.Panes {
+		if ids[i] == self {
+			continue
+		}
+		if p.Title != "" {
+			setPaneTitle(ids[i], p.Title)
+		}
+		if p.Label != "" {
+			setPaneLabel(ids[i], p.Label)
+		}
+	}
+	return ids, nil
+}
+
+// restoreLayout recreates the saved windows in the current tmux server and
+// returns the number of panes created.
+func restoreLayout(wins []layoutWindow) (int, error) {
+	self := tmux.CurrentPane()
+	alone := false
+	if panes, err := listPanes(); err == nil && self != "" {
+		var win, count int
+		var session string
+		for _, p := range panes {
+			if p.ID == self {
+				session, win = p.Session, p.Window
+			}
+		}
+		for _, p := range panes {
+			if p.Session == session && p.Window == win {
+				count++
+			}
+		}
+		alone = count == 1
+	}
+	created := 0
+	for _, w := range wins {
+		ids, err := restoreWindow(w, alone)
+		for _, id := range ids {
+			if id != "" && id != self {
+				created++
+			}
+		}
+		if err != nil {
+			return created, err
+		}
+		for _, p := range w.Panes {
+			if p.Grimux {
+				alone = false
+			}
+		}
+	}
+	return created, nil
+}
+
+// layoutCommand implements !layout save|restore|show.
+func layoutCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!layout"].Usage)
+		return
+	}
+	switch args[0] {
+	case "save":
+		wins, err := captureLayout()
+		if err != nil {
+			cmdPrintln("layout error: " + err.Error())
+			return
+		}
+		savedLayout = wins
+		successPrintln(fmt.Sprintf("saved %d window(s)", len(wins)))
+	case "restore":
+		if len(savedLayout) == 0 {
+			cmdPrintln("no saved layout")
+			return
+		}
+		n, err := restoreLayout(savedLayout)
+		if err != nil {
+			cmdPrintln(fmt.Sprintf("layout error after %d pane(s): %v", n, err))
+			return
+		}
+		successPrintln(fmt.Sprintf("restored %d pane(s)", n))
+	case "show":
+		if len(savedLayout) == 0 {
+			cmdPrintln("no saved layout")
+			return
+		}
+		for _, w := range savedLayout {
+			cmdPrintln(colorize(paneColor, fmt.Sprintf("%s (%d pane(s))", w.Name, len(w.Panes))))
+			for _, p := range w.Panes {
+				line := "  " + shortPath(p.Dir)
+				if p.Grimux {
+					line += " [grimux]"
+				}
+				if p.Label != "" {
+					line += " %pane:" + p.Label
+				}
+				if p.Command != "" {
+					line += " $ " + p.Command
+				}
+				cmdPrintln(line)
+			}
+		}
+	default:
+		cmdPrintln("unknown subcommand")
+	}
+}
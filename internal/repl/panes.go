@@ -0,0 +1,321 @@
+package repl
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var listPanes = func() ([]tmux.PaneInfo, error) { return mx.ListPanes() }
+var setPaneLabel = tmux.SetPaneLabel
+var splitWindow = tmux.SplitWindow
+var killPane = tmux.KillPane
+var selectPane = tmux.SelectPane
+
+// namedPanePattern matches pane references by label or title (%pane:web)
+// and by running command (%cmd:gdb).
+var namedPanePattern = regexp.MustCompile(`^%(pane|cmd):([\w.-]+)$`)
+
+var labelPattern = regexp.MustCompile(`^[\w.-]+$`)
+
+// isPaneRef reports whether name is a pane id, a named pane reference or a
+// pane on a remote server (%jump:%3).
+func isPaneRef(name string) bool {
+	return isPaneID(name) || namedPanePattern.MatchString(name) || tmux.IsRemoteTarget(name)
+}
+
+// resolvePane turns a named pane reference into a pane id. Labels take
+// precedence over titles and the active pane wins when several match. Other
+// names are returned unchanged.
+func resolvePane(ref string) (string, error) {
+	m := namedPanePattern.FindStringSubmatch(ref)
+	if m == nil {
+		return ref, nil
+	}
+	panes, err := listPanes()
+	if err != nil {
+		return "", err
+	}
+	var matchers []func(tmux.PaneInfo) bool
+	if m[1] == "cmd" {
+		matchers = append(matchers, func(p tmux.PaneInfo) bool { return p.Command == m[2] })
+	} else {
+		matchers = append(matchers,
+			func(p tmux.PaneInfo) bool { return p.Label == m[2] },
+			func(p tmux.PaneInfo) bool { return p.Title == m[2] })
+	}
+	for _, match := range matchers {
+		found := ""
+		for _, p := range panes {
+			if !match(p) {
+				continue
+			}
+			if found == "" || p.Active {
+				found = p.ID
+			}
+		}
+		if found != "" {
+			return found, nil
+		}
+	}
+	return "", fmt.Errorf("no pane matches %s", ref)
+}
+
+// nameCommand implements !name <pane> <label>. Labels are unique, so the
+// label is removed from any other pane that had it. A label of - clears it.
+func nameCommand(args []string) {
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!name"].Usage)
+		return
+	}
+	pane, err := paneArg(args[0])
+	if err != nil || !isPaneID(pane) {
+		cmdPrintln("invalid pane id")
+		return
+	}
+	label := args[1]
+	if label == "-" {
+		label = ""
+	} else if !labelPattern.MatchString(label) {
+		cmdPrintln("labels may only use letters, digits, _ . and -")
+		return
+	}
+	if label != "" {
+		if panes, err := listPanes(); err == nil {
+			for _, p := range panes {
+				if p.Label == label && p.ID != pane {
+					setPaneLabel(p.ID, "")
+					warnPrintln(fmt.Sprintf("label %s moved from %s", label, p.ID))
+				}
+			}
+		}
+	}
+	if err := setPaneLabel(pane, label); err != nil {
+		cmdPrintln("name error: " + err.Error())
+		return
+	}
+	if label != "" {
+		successPrintln(fmt.Sprintf("%s is now %%pane:%s", pane, label))
+	}
+}
+
+// bufferInfo is a buffer entry in the !ls JSON inventory.
+type bufferInfo struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	Tmux bool   `json:"tmux,omitempty"`
+}
+
+// inventory is what !ls stores when given a buffer.
+type inventory struct {
+	Panes   []tmux.PaneInfo `json:"panes"`
+	Buffers []bufferInfo    `json:"buffers"`
+}
+
+// ago renders how long ago t was in a compact form.
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
+// shortPath replaces the home directory with ~.
+func shortPath(p string) string {
+	home, _ := os.UserHomeDir()
+	if home != "" && (p == home || strings.HasPrefix(p, home+string(filepath.Separator))) {
+		return "~" + p[len(home):]
+	}
+	return p
+}
+
+// formatPane renders one line of the !ls pane table.
+func formatPane(p tmux.PaneInfo) string {
+	loc := fmt.Sprintf("%s:%d.%s", p.Session, p.Window, p.WindowName)
+	id := p.ID
+	if p.Label != "" {
+		id += " [" + p.Label + "]"
+	}
+	line := fmt.Sprintf("%-12s %-20s %-12s %-30s %4dx%-3d %4s", id, loc, p.Command, shortPath(p.Path), p.Width, p.Height, ago(p.Activity))
+	if p.Title != "" {
+		line += "  " + p.Title
+	}
+	if p.Active {
+		line += " *"
+	}
+	return line
+}
+
+// collectBuffers lists tmux and grimux buffers sorted by name.
+func collectBuffers() []bufferInfo {
+	var infos []bufferInfo
+	tmuxBufs := map[string]bool{}
+	if bufs, err := mx.ListBuffers(); err == nil {
+		for _, b := range bufs {
+			tmuxBufs["%"+b.Name] = true
+			infos = append(infos, bufferInfo{Name: "%" + b.Name, Size: b.Size, Tmux: true})
+		}
+	}
+	for k, v := range buffers {
+		if !tmuxBufs[k] {
+			infos = append(infos, bufferInfo{Name: k, Size: len(v)})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// lsCommand implements !ls [buffer]. With a buffer the pane and buffer
+// inventory is stored there as JSON instead of being printed.
+func lsCommand(args []string) {
+	panes, err := listPanes()
+	if err != nil {
+		cmdPrintln("list panes error: " + err.Error())
+	}
+	bufs := collectBuffers()
+	if len(args) > 0 {
+		data, err := json.MarshalIndent(inventory{Panes: panes, Buffers: bufs}, "", "  ")
+		if err != nil {
+			cmdPrintln("json error: " + err.Error())
+			return
+		}
+		writeBuffer(args[0], string(data))
+		successPrintln(fmt.Sprintf("%d pane(s), %d buffer(s) -> %s", len(panes), len(bufs), args[0]))
+		return
+	}
+	lsCmd := exec.Command("ls", "-lh")
+	lsCmd.Stdout = os.Stdout
+	lsCmd.Stderr = os.Stdout
+	lsCmd.Run()
+	forceEnter()
+	cmdPrintln(colorize(paneColor, "Panes:"))
+	for _, p := range panes {
+		cmdPrintln(formatPane(p))
+	}
+	forceEnter()
+	tmuxCount, tmuxTotal, total := 0, 0, 0
+	for _, b := range bufs {
+		if b.Tmux {
+			tmuxCount++
+			tmuxTotal += b.Size
+		} else {
+			total += b.Size
+		}
+	}
+	if tmuxCount > 0 {
+		cmdPrintln(colorize(tmuxBufColor, fmt.Sprintf("Tmux Buffers (%d bytes):", tmuxTotal)))
+		for _, b := range bufs {
+			if b.Tmux {
+				cmdPrintln(fmt.Sprintf("%s (%d bytes)", b.Name, b.Size))
+			}
+		}
+		forceEnter()
+	}
+	cmdPrintln(colorize(bufferColor, fmt.Sprintf("Buffers (%d bytes):", total)))
+	for _, b := range bufs {
+		if !b.Tmux {
+			cmdPrintln(fmt.Sprintf("%s (%d bytes)", b.Name, b.Size))
+		}
+	}
+}
+
+// paneArg resolves a pane argument. Besides pane ids and named references it
+// accepts a buffer holding a pane id, such as the one !spawn fills in.
+func paneArg(name string) (string, error) {
+	if !isPaneRef(name) {
+		if val, ok := buffers[name]; ok && isPaneID(strings.TrimSpace(val)) {
+			return strings.TrimSpace(val), nil
+		}
+		return "", fmt.Errorf("invalid pane %s", name)
+	}
+	return resolvePane(name)
+}
+
+// spawnCommand implements !spawn [-h|-v] [%name] [command]. The new pane id
+// is stored in %spawn and, when a %name is given, in that buffer too while
+// the pane is labelled name for %pane:name references.
+func spawnCommand(args []string) {
+	horizontal := false
+	if len(args) > 0 && (args[0] == "-h" || args[0] == "-v") {
+		horizontal = args[0] == "-h"
+		args = args[1:]
+	}
+	name := ""
+	if len(args) > 0 && strings.HasPrefix(args[0], "%") {
+		name = args[0]
+		if !labelPattern.MatchString(name[1:]) || isPaneRef(name) {
+			cmdPrintln("invalid name " + name)
+			return
+		}
+		args = args[1:]
+	}
+	command := replaceBufferRefs(strings.Join(args, " "))
+	id, err := splitWindow(tmux.SplitOptions{Horizontal: horizontal, Command: command})
+	if err != nil {
+		cmdPrintln("spawn error: " + err.Error())
+		return
+	}
+	buffers["%spawn"] = id
+	if name != "" {
+		buffers[name] = id
+		if err := setPaneLabel(id, name[1:]); err != nil {
+			warnPrintln("label error: " + err.Error())
+		}
+	}
+	successPrintln("spawned " + id)
+}
+
+// killCommand implements !kill <pane>.
+func killCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!kill"].Usage)
+		return
+	}
+	id, err := paneArg(args[0])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	if id == tmux.CurrentPane() {
+		cmdPrintln("refusing to kill the grimux pane")
+		return
+	}
+	if err := killPane(id); err != nil {
+		cmdPrintln("kill error: " + err.Error())
+		return
+	}
+	stopWatchesOn(id)
+}
+
+// focusCommand implements !focus <pane>.
+func focusCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!focus"].Usage)
+		return
+	}
+	id, err := paneArg(args[0])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	if err := selectPane(id); err != nil {
+		cmdPrintln("focus error: " + err.Error())
+	}
+}
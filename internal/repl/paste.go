@@ -0,0 +1,93 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+)
+
+var sendLiteral = func(target, text string) error { return mx.SendLiteral(target, text) }
+var pasteText = func(target, data string) error { return mx.PasteText(target, data) }
+
+// paneWriteMax guards against pasting huge buffers into a pane by accident.
+// !paste -f writes anyway.
+var paneWriteMax = 64 * 1024
+
+// paneEnter decides whether Enter follows text written to a pane: "auto"
+// presses it when the text ends with a newline, "always" and "never" do
+// what they say.
+var paneEnter = "auto"
+
+// wantEnter reports whether writing data should be followed by Enter.
+func wantEnter(data string) bool {
+	switch paneEnter {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return strings.HasSuffix(data, "\n")
+}
+
+// writePane delivers data to pane. A single line is typed literally; more
+// lines are pasted in one piece so REPLs keep indentation and do not run
+// partial input. The final newline is dropped and replaced by Enter when
+// enter is set.
+func writePane(pane, data string, enter, force bool) error {
+	if !force && len(data) > paneWriteMax {
+		return fmt.Errorf("%d bytes exceeds pane_write_max of %d, use !paste -f", len(data), paneWriteMax)
+	}
+	text := strings.TrimSuffix(data, "\n")
+	if text != "" {
+		var err error
+		if strings.Contains(text, "\n") {
+			err = pasteText(pane, text)
+		} else {
+			err = sendLiteral(pane, text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if enter {
+		return sendKeys(pane, "Enter")
+	}
+	return nil
+}
+
+// pasteCommand implements !paste [-r|-n] [-f] <buffer> <pane>.
+func pasteCommand(args []string) {
+	enter := ""
+	force := false
+	var rest []string
+	for _, a := range args {
+		switch a {
+		case "-r", "-n":
+			enter = a
+		case "-f":
+			force = true
+		default:
+			rest = append(rest, a)
+		}
+	}
+	if len(rest) < 2 {
+		cmdPrintln("usage: " + commands["!paste"].Usage)
+		return
+	}
+	data, ok := readBuffer(rest[0])
+	if !ok {
+		cmdPrintln("unknown buffer")
+		return
+	}
+	pane, err := paneArg(rest[1])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	press := wantEnter(data)
+	if enter != "" {
+		press = enter == "-r"
+	}
+	if err := writePane(pane, data, press, force); err != nil {
+		cmdPrintln("paste error: " + err.Error())
+	}
+}
@@ -0,0 +1,462 @@
+package repl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patchHunk is a single @@ section of a unified diff. Lines keep their
+// leading ' ', '-' or '+' marker.
+type patchHunk struct {
+	oldStart int
+	oldLines int
+	newStart int
+	newLines int
+	header   string
+	lines    []string
+}
+
+// filePatch groups the hunks that apply to one file.
+type filePatch struct {
+	oldName string
+	newName string
+	hunks   []patchHunk
+}
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseUnifiedDiff parses a unified diff into per-file patches. Hunk line
+// counts are treated as hints only since models frequently get them wrong;
+// a hunk ends at the next hunk or file header instead. While a hunk still
+// has lines to come by its counts, --- and +++ lines belong to it, so
+// removing "-- x" and adding "++ y" does not start a new file, unless a
+// hunk header follows right away.
+func parseUnifiedDiff(text string) ([]filePatch, error) {
+	if strings.Contains(text, "```") {
+		if code := lastCodeBlock(text); code != "" {
+			text = code
+		}
+	}
+	var patches []filePatch
+	var cur *filePatch
+	var hunk *patchHunk
+	oldLeft, newLeft := 0, 0
+	flushHunk := func() {
+		if cur != nil && hunk != nil {
+			cur.hunks = append(cur.hunks, *hunk)
+		}
+		hunk = nil
+	}
+	flushFile := func() {
+		flushHunk()
+		if cur != nil && len(cur.hunks) > 0 {
+			patches = append(patches, *cur)
+		}
+		cur = nil
+	}
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") &&
+			(hunk == nil || oldLeft <= 0 && newLeft <= 0 || i+2 < len(lines) && strings.HasPrefix(lines[i+2], "@@")):
+			flushFile()
+			cur = &filePatch{oldName: diffFileName(line[4:]), newName: diffFileName(lines[i+1][4:])}
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if cur == nil {
+				return nil, fmt.Errorf("hunk without file header")
+			}
+			flushHunk()
+			m := hunkHeaderPattern.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("bad hunk header: %s", line)
+			}
+			hunk = &patchHunk{header: line, oldLines: 1, newLines: 1}
+			hunk.oldStart, _ = strconv.Atoi(m[1])
+			if m[2] != "" {
+				hunk.oldLines, _ = strconv.Atoi(m[2])
+			}
+			hunk.newStart, _ = strconv.Atoi(m[3])
+			if m[4] != "" {
+				hunk.newLines, _ = strconv.Atoi(m[4])
+			}
+			oldLeft, newLeft = hunk.oldLines, hunk.newLines
+		case hunk != nil && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "-") || strings.HasPrefix(line, "+")):
+			hunk.lines = append(hunk.lines, line)
+			if line[0] != '+' {
+				oldLeft--
+			}
+			if line[0] != '-' {
+				newLeft--
+			}
+		case hunk != nil && line == "":
+			// blank context lines often lose their leading space
+			if i < len(lines)-1 {
+				hunk.lines = append(hunk.lines, " ")
+				oldLeft--
+				newLeft--
+			}
+		case strings.HasPrefix(line, `\`):
+			// "\ No newline at end of file"
+		default:
+			flushHunk()
+		}
+	}
+	flushFile()
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no hunks found")
+	}
+	for pi := range patches {
+		for hi := range patches[pi].hunks {
+			h := &patches[pi].hunks[hi]
+			for len(h.lines) > 0 && h.lines[len(h.lines)-1] == " " {
+				h.lines = h.lines[:len(h.lines)-1]
+			}
+		}
+	}
+	return patches, nil
+}
+
+// diffFileName strips timestamps and the a/ b/ prefixes from a header name.
+func diffFileName(s string) string {
+	if i := strings.Index(s, "\t"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return s
+	}
+	if strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/") {
+		s = s[2:]
+	}
+	return s
+}
+
+// target returns the path the patch writes to.
+func (fp filePatch) target() string {
+	if fp.newName == "/dev/null" {
+		return fp.oldName
+	}
+	return fp.newName
+}
+
+// splitHunk returns the lines a hunk expects and the lines it produces.
+func splitHunk(h patchHunk) (old, new []string) {
+	for _, l := range h.lines {
+		body := l[1:]
+		switch l[0] {
+		case ' ':
+			old = append(old, body)
+			new = append(new, body)
+		case '-':
+			old = append(old, body)
+		case '+':
+			new = append(new, body)
+		}
+	}
+	return old, new
+}
+
+// matchAt reports whether want matches src starting at pos. When loose is
+// set trailing whitespace is ignored.
+func matchAt(src, want []string, pos int, loose bool) bool {
+	if pos < 0 || pos+len(want) > len(src) {
+		return false
+	}
+	for i, w := range want {
+		s := src[pos+i]
+		if loose {
+			s = strings.TrimRight(s, " \t")
+			w = strings.TrimRight(w, " \t")
+		}
+		if s != w {
+			return false
+		}
+	}
+	return true
+}
+
+// findHunk searches outward from the expected position for the hunk's old
+// lines, first exactly and then ignoring trailing whitespace.
+func findHunk(src, want []string, expected int) int {
+	if expected < 0 {
+		expected = 0
+	}
+	if expected > len(src) {
+		expected = len(src)
+	}
+	for _, loose := range []bool{false, true} {
+		for off := 0; off <= len(src); off++ {
+			if matchAt(src, want, expected-off, loose) {
+				return expected - off
+			}
+			if off > 0 && matchAt(src, want, expected+off, loose) {
+				return expected + off
+			}
+		}
+	}
+	return -1
+}
+
+// applyHunks applies hunks to src in order. Hunks that cannot be located are
+// returned as rejected and leave the content untouched.
+func applyHunks(src []string, hunks []patchHunk) ([]string, []patchHunk) {
+	out := append([]string(nil), src...)
+	var rejected []patchHunk
+	delta := 0
+	for _, h := range hunks {
+		old, repl := splitHunk(h)
+		expected := h.oldStart - 1 + delta
+		if h.oldStart == 0 {
+			expected = 0
+		}
+		pos := expected
+		if len(old) > 0 {
+			pos = findHunk(out, old, expected)
+		} else if pos > len(out) {
+			pos = len(out)
+		}
+		if pos < 0 {
+			rejected = append(rejected, h)
+			continue
+		}
+		merged := make([]string, 0, len(out)-len(old)+len(repl))
+		merged = append(merged, out[:pos]...)
+		merged = append(merged, repl...)
+		merged = append(merged, out[pos+len(old):]...)
+		out = merged
+		delta += len(repl) - len(old)
+	}
+	return out, rejected
+}
+
+// splitLines splits file content into lines and reports a trailing newline.
+func splitLines(s string) ([]string, bool) {
+	if s == "" {
+		return nil, false
+	}
+	nl := strings.HasSuffix(s, "\n")
+	s = strings.TrimSuffix(s, "\n")
+	return strings.Split(s, "\n"), nl
+}
+
+// formatHunks renders hunks back into unified diff text.
+func formatHunks(fp filePatch, hunks []patchHunk) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", fp.oldName, fp.newName)
+	for _, h := range hunks {
+		b.WriteString(h.header + "\n")
+		for _, l := range h.lines {
+			b.WriteString(l + "\n")
+		}
+	}
+	return b.String()
+}
+
+// previewPatch prints a colored version of the patch. Hunks that do not
+// apply, as found by preparePatch, are marked.
+func previewPatch(patches []filePatch, results []patchResult) {
+	for i, fp := range patches {
+		cmdPrintln(colorize(cmdColor, "--- "+fp.oldName))
+		cmdPrintln(colorize(cmdColor, "+++ "+fp.newName))
+		for _, h := range fp.hunks {
+			if hunkRejected(h, results[i].rejected) {
+				cmdPrintln(colorize(warnColor, h.header+"  (does not apply, goes to %rej)"))
+			} else {
+				cmdPrintln(colorize(paneColor, h.header))
+			}
+			for _, l := range h.lines {
+				switch l[0] {
+				case '+':
+					cmdPrintln(colorize(successColor, l))
+				case '-':
+					cmdPrintln(colorize(warnColor, l))
+				default:
+					cmdPrintln(l)
+				}
+			}
+		}
+	}
+}
+
+// hunkRejected reports whether h is one of rejected.
+func hunkRejected(h patchHunk, rejected []patchHunk) bool {
+	for _, r := range rejected {
+		if r.header == h.header && len(r.lines) == len(h.lines) {
+			return true
+		}
+	}
+	return false
+}
+
+// patchResult records what happened to one file.
+type patchResult struct {
+	path     string
+	content  string
+	original string
+	exists   bool
+	remove   bool
+	rejected []patchHunk
+}
+
+// patchPath returns where a patch for name writes inside dir. Absolute
+// names and names that climb out of dir are refused since the diff may
+// come from the AI.
+func patchPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s: absolute path in patch", name)
+	}
+	path := filepath.Join(dir, filepath.Clean(name))
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: path outside %s", name, dir)
+	}
+	return path, nil
+}
+
+// preparePatch applies every file patch in memory without touching disk.
+func preparePatch(patches []filePatch, dir string) ([]patchResult, error) {
+	var results []patchResult
+	for _, fp := range patches {
+		path, err := patchPath(dir, fp.target())
+		if err != nil {
+			return nil, err
+		}
+		res := patchResult{path: path, remove: fp.newName == "/dev/null"}
+		if fp.oldName == "/dev/null" {
+			if _, err := os.Lstat(path); err == nil {
+				return nil, fmt.Errorf("%s: file already exists", fp.target())
+			}
+		} else {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			res.exists = true
+			res.original = string(b)
+		}
+		src, nl := splitLines(res.original)
+		if !res.exists {
+			nl = true
+		}
+		out, rej := applyHunks(src, fp.hunks)
+		res.rejected = rej
+		res.content = strings.Join(out, "\n")
+		if nl && len(out) > 0 {
+			res.content += "\n"
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// writePatchResults writes patched files, keeping .orig backups of the
+// originals.
+func writePatchResults(results []patchResult) error {
+	for _, r := range results {
+		if len(r.rejected) > 0 && r.content == r.original {
+			continue
+		}
+		if r.exists {
+			if err := os.WriteFile(r.path+".orig", []byte(r.original), 0644); err != nil {
+				return err
+			}
+		}
+		if r.remove && len(r.rejected) == 0 {
+			if err := os.Remove(r.path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+			return err
+		}
+		mode := os.FileMode(0644)
+		if fi, err := os.Stat(r.path); err == nil {
+			mode = fi.Mode()
+		}
+		if err := os.WriteFile(r.path, []byte(r.content), mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirm asks a yes/no question and reports whether the user agreed.
+func confirm(question string) bool {
+	cprint(question + " [y/N] ")
+	resp, _ := readLine()
+	return strings.ToLower(strings.TrimSpace(resp)) == "y"
+}
+
+// patchCommand implements !patch <buffer> [dir].
+func patchCommand(bufName, dir string) {
+	data, ok := readBuffer(bufName)
+	if !ok {
+		cmdPrintln("unknown buffer")
+		return
+	}
+	patches, err := parseUnifiedDiff(data)
+	if err != nil {
+		cmdPrintln("patch error: " + err.Error())
+		return
+	}
+	results, err := preparePatch(patches, dir)
+	if err != nil {
+		cmdPrintln("patch error: " + err.Error())
+		return
+	}
+	previewPatch(patches, results)
+	added, removed := countPatchLines(patches)
+	question := fmt.Sprintf("Apply patch (+%d -%d) to %d file(s)?", added, removed, len(results))
+	rejected := 0
+	for _, r := range results {
+		rejected += len(r.rejected)
+	}
+	if rejected > 0 {
+		question = fmt.Sprintf("Apply patch (+%d -%d) to %d file(s), %d hunk(s) rejected?", added, removed, len(results), rejected)
+	}
+	if !confirm(question) {
+		cmdPrintln("patch aborted")
+		return
+	}
+	if err := writePatchResults(results); err != nil {
+		cmdPrintln("patch error: " + err.Error())
+		return
+	}
+	var rej strings.Builder
+	for i, r := range results {
+		if len(r.rejected) > 0 {
+			rej.WriteString(formatHunks(patches[i], r.rejected))
+			warnPrintln(fmt.Sprintf("%s: %d hunk(s) rejected", r.path, len(r.rejected)))
+			continue
+		}
+		successPrintln(fmt.Sprintf("patched %s", r.path))
+	}
+	if rej.Len() > 0 {
+		buffers["%rej"] = rej.String()
+		cmdPrintln("rejected hunks stored in %rej")
+	}
+}
+
+// countPatchLines returns the number of added and removed lines.
+func countPatchLines(patches []filePatch) (added, removed int) {
+	for _, fp := range patches {
+		for _, h := range fp.hunks {
+			for _, l := range h.lines {
+				switch l[0] {
+				case '+':
+					added++
+				case '-':
+					removed++
+				}
+			}
+		}
+	}
+	return added, removed
+}
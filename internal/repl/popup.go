@@ -0,0 +1,161 @@
+package repl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/glo0ml34f/grimux/internal/ansi"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var displayPopup = tmux.DisplayPopup
+var tmuxVersion = tmux.Version
+
+// popupOnce guards popupSupported so tmux -V runs once per process.
+var popupOnce sync.Once
+var popupSupported bool
+
+// popupUses lists what opens in a tmux popup instead of taking over the
+// grimux pane: "view" for !view, "edit" for !edit and "answer" for AI
+// replies.
+var popupUses = map[string]bool{}
+
+var popupKinds = []string{"view", "edit", "answer"}
+
+// popupSize is the width and height of popups.
+var popupSize = "80%"
+
+// setPopupUses parses a list such as "view,edit", "all" or "off".
+func setPopupUses(spec string) error {
+	uses := map[string]bool{}
+	for _, f := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		switch f {
+		case "all":
+			for _, k := range popupKinds {
+				uses[k] = true
+			}
+		case "off", "none":
+		case "view", "edit", "answer":
+			uses[f] = true
+		default:
+			return fmt.Errorf("unknown popup use %q (want view, edit, answer, all or off)", f)
+		}
+	}
+	popupUses = uses
+	return nil
+}
+
+// usePopup reports whether kind should open in a popup. Popups need tmux
+// 3.2 or later and a client showing the grimux pane.
+func usePopup(kind string) bool {
+	if !popupUses[kind] || mx.Name() != "tmux" || tmux.CurrentPane() == "" {
+		return false
+	}
+	popupOnce.Do(func() {
+		major, minor, err := tmuxVersion()
+		popupSupported = err == nil && (major > 3 || major == 3 && minor >= 2)
+	})
+	return popupSupported
+}
+
+// runPopup runs a shell command in a popup over the grimux pane and waits
+// for it to close.
+func runPopup(title, command string) error {
+	dir, _ := os.Getwd()
+	return displayPopup(tmux.PopupOptions{
+		Target:  tmux.CurrentPane(),
+		Title:   title,
+		Dir:     dir,
+		Width:   popupSize,
+		Height:  popupSize,
+		Command: command,
+	})
+}
+
+// viewer returns $VIEWER (default batcat), the arguments to page with it
+// and data as the viewer should get it. Text with color escapes makes less
+// and bat show the colors; other viewers get it with the escapes stripped.
+func viewer(data string) (string, []string, string) {
+	name := os.Getenv("VIEWER")
+	if name == "" {
+		name = "batcat"
+	}
+	colored := ansi.Has(data)
+	switch filepath.Base(name) {
+	case "less":
+		if colored {
+			return name, []string{"-R"}, data
+		}
+		return name, nil, data
+	case "bat", "batcat":
+		// bat quits right away on short text unless told to page
+		if colored {
+			return name, []string{"--color=always", "--paging=always"}, data
+		}
+		return name, []string{"-l", "markdown", "--paging=always"}, data
+	}
+	if colored {
+		data = ansi.Strip(data)
+	}
+	return name, []string{"-l", "markdown"}, data
+}
+
+// viewInPopup pages data in a popup. It returns false when the popup could
+// not be shown so the caller can fall back to the pane.
+func viewInPopup(title, data string) bool {
+	name, args, text := viewer(data)
+	tmp, err := os.CreateTemp("", "grimux-view-*.md")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(text)
+	tmp.Close()
+	if err != nil {
+		return false
+	}
+	cmd := shellQuote(name)
+	for _, a := range append(args, tmp.Name()) {
+		cmd += " " + shellQuote(a)
+	}
+	if err := runPopup(title, cmd); err != nil {
+		warnPrintln("popup error: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// editInPopup runs editor on file in a popup and waits for it.
+func editInPopup(title, editor, file string) bool {
+	// the popup reports the editor's exit status, which is not a reason
+	// to edit a second time in the pane
+	if err := runPopup(title, shellQuote(editor)+" "+shellQuote(file)+"; true"); err != nil {
+		warnPrintln("popup error: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// popupCommand implements !popup [view|edit|answer|all|off ...].
+func popupCommand(args []string) {
+	if len(args) > 0 {
+		if err := setPopupUses(strings.Join(args, ",")); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+	}
+	var on []string
+	for _, k := range popupKinds {
+		if popupUses[k] {
+			on = append(on, k)
+		}
+	}
+	if len(on) == 0 {
+		cmdPrintln("popups off")
+		return
+	}
+	cmdPrintln("popups: " + strings.Join(on, ", "))
+}
@@ -29,3 +29,21 @@ func stopRaw(state *syscall.Termios) {
 	fd := int(os.Stdin.Fd())
 	syscall.Syscall6(syscall.SYS_IOCTL, uintptr(fd), uintptr(syscall.TIOCSETA), uintptr(unsafe.Pointer(state)), 0, 0, 0)
 }
+
+// waitInput blocks until fd or the wake descriptor can be read and reports
+// whether fd can.
+func waitInput(fd, wake int) (bool, error) {
+	for {
+		var set syscall.FdSet
+		fdSet(&set, fd)
+		fdSet(&set, wake)
+		err := syscall.Select(max(fd, wake)+1, &set, nil, nil, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return fdIsSet(&set, fd), nil
+	}
+}
@@ -0,0 +1,426 @@
+package repl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/glo0ml34f/grimux/internal/ansi"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+var pipePane = tmux.PipePane
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castEvent is one output event of a recording.
+type castEvent struct {
+	Time float64
+	Data string
+}
+
+// recording streams a pane into an asciicast file. tmux pipes the pane
+// output through cat into a FIFO, which the recorder goroutine reads and
+// timestamps.
+type recording struct {
+	pane  string
+	file  string
+	dir   string
+	start time.Time
+	done  chan struct{}
+	mu    sync.Mutex
+	bytes int
+	err   error
+}
+
+var recordMu sync.Mutex
+var recordings = map[string]*recording{}
+
+// replayMaxIdle caps pauses during playback so long idle stretches of a
+// recording do not stall the replay.
+var replayMaxIdle = 2 * time.Second
+
+// shellQuote quotes s for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fifoOpenTimeout bounds how long a replay waits for the pane to open the
+// FIFO, so a pane that died early does not leave the writer hanging.
+var fifoOpenTimeout = 10 * time.Second
+
+// openFIFOWriter opens fifo for writing once a reader has it open. Opening
+// without a reader fails with ENXIO in non-blocking mode, so it retries
+// until fifoOpenTimeout.
+func openFIFOWriter(fifo string) (*os.File, error) {
+	deadline := time.Now().Add(fifoOpenTimeout)
+	for {
+		w, err := os.OpenFile(fifo, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+		if err == nil {
+			return w, nil
+		}
+		if !errors.Is(err, syscall.ENXIO) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("nothing read %s within %s", fifo, fifoOpenTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// makeFIFO creates a named pipe in a fresh temporary directory.
+func makeFIFO(prefix string) (dir, fifo string, err error) {
+	dir, err = os.MkdirTemp("", prefix)
+	if err != nil {
+		return "", "", err
+	}
+	fifo = filepath.Join(dir, "pipe")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+	return dir, fifo, nil
+}
+
+// writeCastEvent appends an output event to w.
+func writeCastEvent(w io.Writer, ev castEvent) error {
+	line, err := json.Marshal([]any{math.Round(ev.Time*1e6) / 1e6, "o", ev.Data})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// utf8Prefix returns the longest prefix of b that does not end in the
+// middle of a multi-byte character.
+func utf8Prefix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if !utf8.FullRune(b[i:]) {
+			return i
+		}
+		break
+	}
+	return len(b)
+}
+
+// paneSize returns the size of pane, falling back to 80x24.
+func paneSize(pane string) (int, int) {
+	if panes, err := listPanes(); err == nil {
+		for _, p := range panes {
+			if p.ID == pane && p.Width > 0 {
+				return p.Width, p.Height
+			}
+		}
+	}
+	return 80, 24
+}
+
+// startRecording begins recording pane into file. The current screen is
+// stored as the first event so the recording starts with context.
+func startRecording(pane, file string) error {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	if r, ok := recordings[pane]; ok {
+		return fmt.Errorf("%s is already recorded into %s", pane, r.file)
+	}
+	dir, fifo, err := makeFIFO("grimux-rec")
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(file)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	w, h := paneSize(pane)
+	hdr := castHeader{Version: 2, Width: w, Height: h, Timestamp: time.Now().Unix(), Title: pane,
+		Env: map[string]string{"TERM": "tmux-256color", "SHELL": os.Getenv("SHELL")}}
+	line, _ := json.Marshal(hdr)
+	fail := func(err error) error {
+		out.Close()
+		os.Remove(file)
+		os.RemoveAll(dir)
+		return err
+	}
+	if _, err := out.Write(append(line, '\n')); err != nil {
+		return fail(err)
+	}
+	if screen, err := capturePaneANSI(pane); err == nil {
+		// only blank lines go, the prompt keeps its trailing space
+		lines := strings.Split(screen, "\n")
+		for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+			lines = lines[:len(lines)-1]
+		}
+		writeCastEvent(out, castEvent{Data: "\x1b[2J\x1b[H" + strings.Join(lines, "\r\n")})
+	}
+	if err := pipePane(pane, "exec cat > "+shellQuote(fifo)); err != nil {
+		return fail(err)
+	}
+	r := &recording{pane: pane, file: file, dir: dir, start: time.Now(), done: make(chan struct{})}
+	recordings[pane] = r
+	go r.loop(fifo, out)
+	return nil
+}
+
+func (r *recording) loop(fifo string, out *os.File) {
+	defer close(r.done)
+	defer os.RemoveAll(r.dir)
+	defer out.Close()
+	in, err := os.Open(fifo)
+	if err != nil {
+		r.mu.Lock()
+		r.err = err
+		r.mu.Unlock()
+		return
+	}
+	defer in.Close()
+	buf := make([]byte, 32*1024)
+	var rest []byte
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			data := append(rest, buf[:n]...)
+			cut := utf8Prefix(data)
+			rest = append([]byte(nil), data[cut:]...)
+			if cut > 0 {
+				writeCastEvent(out, castEvent{Time: time.Since(r.start).Seconds(), Data: string(data[:cut])})
+				r.mu.Lock()
+				r.bytes += cut
+				r.mu.Unlock()
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				r.mu.Lock()
+				r.err = err
+				r.mu.Unlock()
+			}
+			return
+		}
+	}
+}
+
+// stopRecording ends the recording of pane. Closing the pipe makes cat exit,
+// which ends the recorder at the end of the FIFO.
+func stopRecording(pane string) (*recording, error) {
+	recordMu.Lock()
+	r, ok := recordings[pane]
+	delete(recordings, pane)
+	recordMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not being recorded", pane)
+	}
+	err := pipePane(pane, "")
+	select {
+	case <-r.done:
+	case <-time.After(2 * time.Second):
+		err = fmt.Errorf("recorder of %s did not finish", pane)
+	}
+	return r, err
+}
+
+func recordingPanes() []string {
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	panes := make([]string, 0, len(recordings))
+	for p := range recordings {
+		panes = append(panes, p)
+	}
+	sort.Strings(panes)
+	return panes
+}
+
+func stopAllRecordings() {
+	for _, p := range recordingPanes() {
+		stopRecording(p)
+	}
+}
+
+// recordCommand implements !record <pane> <file>, !record stop [pane] and
+// !record to list active recordings.
+func recordCommand(args []string) {
+	if len(args) == 0 {
+		panes := recordingPanes()
+		if len(panes) == 0 {
+			cmdPrintln("no active recordings")
+			return
+		}
+		for _, p := range panes {
+			recordMu.Lock()
+			r := recordings[p]
+			recordMu.Unlock()
+			if r == nil {
+				continue
+			}
+			r.mu.Lock()
+			n := r.bytes
+			r.mu.Unlock()
+			cmdPrintln(fmt.Sprintf("%s -> %s  %s, %d bytes", colorize(paneColor, p), r.file, time.Since(r.start).Round(time.Second), n))
+		}
+		return
+	}
+	if args[0] == "stop" {
+		panes := args[1:]
+		if len(panes) == 0 {
+			panes = recordingPanes()
+		}
+		for _, p := range panes {
+			id, err := paneArg(p)
+			if err != nil {
+				cmdPrintln(err.Error())
+				continue
+			}
+			r, err := stopRecording(id)
+			if err != nil {
+				cmdPrintln(err.Error())
+			}
+			if r != nil {
+				r.mu.Lock()
+				rerr := r.err
+				r.mu.Unlock()
+				if rerr != nil {
+					warnPrintln(fmt.Sprintf("recording of %s failed: %v", id, rerr))
+				}
+				successPrintln(fmt.Sprintf("saved %s", r.file))
+			}
+		}
+		return
+	}
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!record"].Usage)
+		return
+	}
+	id, err := paneArg(args[0])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	if err := startRecording(id, args[1]); err != nil {
+		cmdPrintln("record error: " + err.Error())
+		return
+	}
+	successPrintln(fmt.Sprintf("recording %s into %s", id, args[1]))
+}
+
+// readCast parses an asciicast v2 file and returns its output events.
+func readCast(r io.Reader) (castHeader, []castEvent, error) {
+	dec := json.NewDecoder(r)
+	var hdr castHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return hdr, nil, fmt.Errorf("bad header: %w", err)
+	}
+	if hdr.Version != 2 {
+		return hdr, nil, fmt.Errorf("unsupported asciicast version %d", hdr.Version)
+	}
+	var events []castEvent
+	for {
+		var raw []any
+		if err := dec.Decode(&raw); err != nil {
+			if errors.Is(err, io.EOF) {
+				return hdr, events, nil
+			}
+			return hdr, events, err
+		}
+		if len(raw) < 3 {
+			continue
+		}
+		t, _ := raw[0].(float64)
+		typ, _ := raw[1].(string)
+		data, _ := raw[2].(string)
+		if typ == "o" {
+			events = append(events, castEvent{Time: t, Data: data})
+		}
+	}
+}
+
+// playCast writes the events to w with their original timing, pauses capped
+// at replayMaxIdle.
+func playCast(w io.Writer, events []castEvent) {
+	last := 0.0
+	for _, ev := range events {
+		wait := time.Duration((ev.Time - last) * float64(time.Second))
+		last = ev.Time
+		time.Sleep(min(wait, replayMaxIdle))
+		if _, err := io.WriteString(w, ev.Data); err != nil {
+			return
+		}
+	}
+}
+
+// replayCommand implements !replay <file> [buffer]. With a buffer the final
+// text of the recording is stored there; otherwise it is played back in a
+// new pane.
+func replayCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!replay"].Usage)
+		return
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		cmdPrintln("replay error: " + err.Error())
+		return
+	}
+	_, events, err := readCast(f)
+	f.Close()
+	if err != nil {
+		cmdPrintln("replay error: " + err.Error())
+		return
+	}
+	if len(args) > 1 {
+		var sb strings.Builder
+		for _, ev := range events {
+			sb.WriteString(ev.Data)
+		}
+		writeBuffer(args[1], ansi.Plain(sb.String()))
+		return
+	}
+	dir, fifo, err := makeFIFO("grimux-replay")
+	if err != nil {
+		cmdPrintln("replay error: " + err.Error())
+		return
+	}
+	cmd := fmt.Sprintf("cat %s; printf '\\n[replay finished, press enter]'; read _", shellQuote(fifo))
+	id, err := splitWindow(tmux.SplitOptions{Command: cmd})
+	if err != nil {
+		os.RemoveAll(dir)
+		cmdPrintln("replay error: " + err.Error())
+		return
+	}
+	go func() {
+		defer os.RemoveAll(dir)
+		w, err := openFIFOWriter(fifo)
+		if err != nil {
+			select {
+			case pluginMsgCh <- pluginMsg{name: "replay", text: "replay stopped, " + id + " never opened the pipe"}:
+			default:
+			}
+			return
+		}
+		defer w.Close()
+		playCast(w, events)
+	}()
+	successPrintln("replaying in " + id)
+}
@@ -0,0 +1,90 @@
+package repl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+// addRemoteSpec registers a remote from a "user@host [socket]" spec as used
+// by remote_<name> keys in ~/.grimuxrc.
+func addRemoteSpec(name, spec string) error {
+	parts := strings.Fields(spec)
+	if len(parts) == 0 {
+		return fmt.Errorf("missing host for remote %s", name)
+	}
+	socket := ""
+	if len(parts) > 1 {
+		socket = parts[1]
+	}
+	return tmux.AddRemote(name, parts[0], socket)
+}
+
+// remoteCommand implements !remote add|rm|ls|panes.
+func remoteCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!remote"].Usage)
+		return
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 3 {
+			cmdPrintln("usage: " + commands["!remote"].Usage)
+			return
+		}
+		if err := addRemoteSpec(args[1], strings.Join(args[2:], " ")); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		successPrintln(fmt.Sprintf("panes on %s are now %%%s:%%N", args[2], args[1]))
+	case "rm":
+		if len(args) < 2 {
+			cmdPrintln("usage: " + commands["!remote"].Usage)
+			return
+		}
+		if !tmux.RemoveRemote(args[1]) {
+			cmdPrintln("unknown remote " + args[1])
+		}
+	case "ls":
+		rs := tmux.Remotes()
+		if len(rs) == 0 {
+			cmdPrintln("no remotes")
+			return
+		}
+		for _, r := range rs {
+			line := fmt.Sprintf("%s %s", colorize(paneColor, "%"+r.Name+":"), r.Host)
+			if r.Socket != "" {
+				line += " " + r.Socket
+			}
+			cmdPrintln(line)
+		}
+	case "panes":
+		if len(args) < 2 {
+			cmdPrintln("usage: " + commands["!remote"].Usage)
+			return
+		}
+		var remote *tmux.Remote
+		for _, r := range tmux.Remotes() {
+			if r.Name == args[1] {
+				remote = &r
+			}
+		}
+		if remote == nil {
+			cmdPrintln("unknown remote " + args[1])
+			return
+		}
+		stop := spinner()
+		panes, err := remote.ListPanes()
+		stop()
+		if err != nil {
+			cmdPrintln("remote error: " + err.Error())
+			return
+		}
+		for _, p := range panes {
+			cmdPrintln(formatPane(p))
+		}
+	default:
+		cmdPrintln("unknown subcommand")
+	}
+}
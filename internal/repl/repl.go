@@ -30,12 +30,21 @@ import (
 	"github.com/chzyer/readline"
 
 	"github.com/glo0ml34f/grimux/internal/input"
+	"github.com/glo0ml34f/grimux/internal/mux"
 	"github.com/glo0ml34f/grimux/internal/openai"
 	"github.com/glo0ml34f/grimux/internal/plugin"
 	"github.com/glo0ml34f/grimux/internal/tmux"
 )
 
-var capturePane = tmux.CapturePane
+// mx is the terminal multiplexer panes are read from and written to. It is
+// picked by loadConfig.
+var mx mux.Multiplexer = mux.Tmux{}
+
+// onScreen reports whether grimux drives GNU screen, which has no colors,
+// cursor positions or layouts to offer.
+func onScreen() bool { return mx.Name() == "screen" }
+
+var capturePane = func(target string) (string, error) { return mx.CapturePane(target) }
 
 const asciiArt = "\033[1;36m" + `
   ____ ____ ____ ____ _________ ____ ____ ____ ____
@@ -74,12 +83,31 @@ var prompts = []string{
 }
 
 type config struct {
-	APIURL    string `yaml:"api_url"`
-	APIKey    string `yaml:"api_key"`
-	AskPrefix string `yaml:"ask_prefix"`
+	APIURL           string            `yaml:"api_url"`
+	APIKey           string            `yaml:"api_key"`
+	AskPrefix        string            `yaml:"ask_prefix"`
+	ExecTimeout      int               `yaml:"exec_timeout"`
+	ExecMaxOutput    int               `yaml:"exec_max_output"`
+	Runners          map[string]string // runner_<lang> keys
+	Remotes          map[string]string // remote_<name> keys
+	CtxBudget        int               `yaml:"ctx_budget"`
+	IndexTopK        int               `yaml:"index_top_k"`
+	WatchMaxBytes    int               `yaml:"watch_max_bytes"`
+	RunOnTimeout     int               `yaml:"run_on_timeout"`
+	ExpectTimeout    int               `yaml:"expect_timeout"`
+	LayoutRestore    bool              `yaml:"layout_restore"`
+	CaptureANSI      bool              `yaml:"capture_ansi"`
+	PaneEnter        string            `yaml:"pane_enter"`
+	PaneWriteMax     int               `yaml:"pane_write_max"`
+	BroadcastTimeout int               `yaml:"broadcast_timeout"`
+	Multiplexer      string            `yaml:"multiplexer"`
+	TmuxSocket       string            `yaml:"tmux_socket"`
+	TmuxSocketName   string            `yaml:"tmux_socket_name"`
+	Popup            string            `yaml:"popup"`
+	TriggerCooldown  int               `yaml:"trigger_cooldown"`
 }
 
-var panePattern = regexp.MustCompile(`\{\%(\d+)\}`)
+var panePattern = regexp.MustCompile(`\{(%\d+|%(?:pane|cmd):[\w.-]+|%[\w.-]+:%\d+)(:new)?\}`)
 
 // bufferPattern matches buffer references like %foo or %@
 var bufferPattern = regexp.MustCompile(`%[@a-zA-Z0-9_]+`)
@@ -142,6 +170,54 @@ func loadConfig() {
 			cfg.APIKey = val
 		case "ask_prefix":
 			cfg.AskPrefix = val
+		case "exec_timeout":
+			cfg.ExecTimeout, _ = strconv.Atoi(val)
+		case "exec_max_output":
+			cfg.ExecMaxOutput, _ = strconv.Atoi(val)
+		case "ctx_budget":
+			cfg.CtxBudget, _ = strconv.Atoi(val)
+		case "index_top_k":
+			cfg.IndexTopK, _ = strconv.Atoi(val)
+		case "watch_max_bytes":
+			cfg.WatchMaxBytes, _ = strconv.Atoi(val)
+		case "run_on_timeout":
+			cfg.RunOnTimeout, _ = strconv.Atoi(val)
+		case "expect_timeout":
+			cfg.ExpectTimeout, _ = strconv.Atoi(val)
+		case "layout_restore":
+			cfg.LayoutRestore, _ = strconv.ParseBool(val)
+		case "capture_ansi":
+			cfg.CaptureANSI, _ = strconv.ParseBool(val)
+		case "pane_enter":
+			cfg.PaneEnter = val
+		case "pane_write_max":
+			cfg.PaneWriteMax, _ = strconv.Atoi(val)
+		case "broadcast_timeout":
+			cfg.BroadcastTimeout, _ = strconv.Atoi(val)
+		case "multiplexer":
+			cfg.Multiplexer = val
+		case "tmux_socket":
+			cfg.TmuxSocket = val
+		case "tmux_socket_name":
+			cfg.TmuxSocketName = val
+		case "popup":
+			cfg.Popup = val
+		case "trigger_cooldown":
+			cfg.TriggerCooldown, _ = strconv.Atoi(val)
+		default:
+			if name := strings.TrimPrefix(key, "remote_"); name != key && name != "" {
+				if cfg.Remotes == nil {
+					cfg.Remotes = map[string]string{}
+				}
+				cfg.Remotes[name] = val
+				continue
+			}
+			if lang := strings.TrimPrefix(key, "runner_"); lang != key && lang != "" {
+				if cfg.Runners == nil {
+					cfg.Runners = map[string]string{}
+				}
+				cfg.Runners[lang] = val
+			}
 		}
 	}
 	if cfg.APIKey != "" && os.Getenv("OPENAI_API_KEY") == "" && openai.GetSessionAPIKey() == "" {
@@ -153,6 +229,70 @@ func loadConfig() {
 	if cfg.AskPrefix != "" {
 		askPrefix = cfg.AskPrefix
 	}
+	if cfg.ExecTimeout > 0 {
+		execTimeout = time.Duration(cfg.ExecTimeout) * time.Second
+	}
+	if cfg.ExecMaxOutput > 0 {
+		execMaxOutput = cfg.ExecMaxOutput
+	}
+	if cfg.CtxBudget > 0 {
+		ctxBudget = cfg.CtxBudget
+	}
+	if cfg.IndexTopK > 0 {
+		indexTopK = cfg.IndexTopK
+	}
+	if cfg.WatchMaxBytes > 0 {
+		watchMaxBytes = cfg.WatchMaxBytes
+	}
+	if cfg.RunOnTimeout > 0 {
+		runOnTimeout = time.Duration(cfg.RunOnTimeout) * time.Second
+	}
+	if cfg.ExpectTimeout > 0 {
+		expectTimeout = time.Duration(cfg.ExpectTimeout) * time.Second
+	}
+	layoutAutoRestore = cfg.LayoutRestore
+	captureANSI = cfg.CaptureANSI
+	switch cfg.PaneEnter {
+	case "auto", "always", "never":
+		paneEnter = cfg.PaneEnter
+	}
+	if cfg.PaneWriteMax > 0 {
+		paneWriteMax = cfg.PaneWriteMax
+	}
+	if cfg.BroadcastTimeout > 0 {
+		broadcastTimeout = time.Duration(cfg.BroadcastTimeout) * time.Second
+	}
+	if cfg.TriggerCooldown > 0 {
+		triggerCooldown = time.Duration(cfg.TriggerCooldown) * time.Second
+	}
+	if cfg.Popup != "" {
+		if err := setPopupUses(cfg.Popup); err != nil {
+			warnPrintln("config: " + err.Error())
+		}
+	}
+	if !tmux.ExplicitServer() {
+		// -tmux-socket and -L win over the config
+		tmux.Socket, tmux.SocketName = cfg.TmuxSocket, cfg.TmuxSocketName
+	}
+	if m, err := mux.Detect(cfg.Multiplexer); err != nil {
+		warnPrintln("config: " + err.Error())
+	} else {
+		mx = m
+	}
+	for name, spec := range cfg.Remotes {
+		if err := addRemoteSpec(name, spec); err != nil {
+			warnPrintln("config: " + err.Error())
+		}
+	}
+	for lang, cmd := range cfg.Runners {
+		r := execRunners[lang]
+		r.cmd = cmd
+		if r.ext == "" {
+			r.ext = "." + lang
+		}
+		execRunners[lang] = r
+		langAliases[lang] = lang
+	}
 }
 
 type session struct {
@@ -167,6 +307,9 @@ type session struct {
 	Summary   string            `json:"summary,omitempty"`
 	ChatCtx   string            `json:"chat_ctx,omitempty"`
 	CtxLimit  int               `json:"ctx_limit,omitempty"`
+	CtxFiles  []string          `json:"ctx_files,omitempty"`
+	Layout    []layoutWindow    `json:"layout,omitempty"`
+	Triggers  []triggerRule     `json:"triggers,omitempty"`
 }
 
 const (
@@ -227,6 +370,7 @@ func pluginPrintln(name, s string) {
 func ok() string { return colorize(successColor, "✅") }
 
 func flushPluginMsgs() {
+	dispatchTmuxEvents()
 	for {
 		select {
 		case pm := <-pluginMsgCh:
@@ -281,6 +425,10 @@ func SetSeriousMode(v bool) { seriousMode = v }
 // SetAuditMode enables or disables audit logging.
 func SetAuditMode(v bool) { auditMode = v }
 
+// SetTmuxServer selects the tmux server by socket path or name instead of
+// $TMUX.
+func SetTmuxServer(socket, name string) { tmux.Socket, tmux.SocketName = socket, name }
+
 // SetBanFile sets the path used to block grimux on startup.
 func SetBanFile(path string) { banFile = path }
 
@@ -302,17 +450,28 @@ type commandInfo struct {
 }
 
 var commandOrder = []string{
-	"!observe", "!ls", "!quit", "!x", "!save",
-	"!gen", "!code", "!load", "!file", "!edit", "!run", "!cat",
-	"!set", "!prefix", "!reset", "!new", "!unset", "!get_prompt", "!session", "!recap", "!md", "!run_on", "!flow",
-	"!grep", "!macro", "!alias", "!model", "!pwd", "!cd", "!setenv", "!getenv", "!env", "!sum", "!rand", "!ascii", "!pipe", "!encode", "!hash", "!socat", "!curl", "!diff", "!eat", "!view", "!clip", "!rm", "!plugin", "!game", "!version", "!help", "!helpme", "!idk",
+	"!observe", "!layout", "!name", "!spawn", "!kill", "!focus", "!remote", "!watch", "!unwatch", "!watches", "!record", "!replay", "!ls", "!quit", "!x", "!save",
+	"!gen", "!code", "!load", "!file", "!edit", "!run", "!cat", "!ctx",
+	"!set", "!prefix", "!reset", "!new", "!unset", "!get_prompt", "!session", "!recap", "!md", "!paste", "!group", "!broadcast", "!run_on", "!on", "!explain", "!expect", "!interact", "!flow",
+	"!grep", "!index", "!macro", "!alias", "!model", "!pwd", "!cd", "!setenv", "!getenv", "!env", "!sum", "!rand", "!ascii", "!pipe", "!encode", "!hash", "!socat", "!curl", "!diff", "!patch", "!exec", "!eat", "!strip", "!shot", "!view", "!popup", "!clip", "!rm", "!plugin", "!game", "!version", "!help", "!helpme", "!idk",
 }
 
 var commands = map[string]commandInfo{
 	"!quit":       {Usage: "!quit", Desc: "save session and quit"},
 	"!x":          {Usage: "!x", Desc: "exit immediately"},
-	"!ls":         {Usage: "!ls", Desc: "list panes and buffers"},
-	"!observe":    {Usage: "!observe <buffer> <pane-id>", Desc: "capture a pane into a buffer", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<pane-id>", "tmux pane id"}}},
+	"!ls":         {Usage: "!ls [buffer]", Desc: "list panes and buffers", Params: []paramInfo{{"[buffer]", "store the inventory as JSON"}}},
+	"!observe":    {Usage: "!observe [-d] [-e|-p] <buffer> <pane-id>", Desc: "capture a pane into a buffer", Params: []paramInfo{{"-d", "only lines since the last capture"}, {"-e", "keep color escapes"}, {"-p", "plain text"}, {"<buffer>", "buffer name"}, {"<pane-id>", "tmux pane id"}}},
+	"!layout":     {Usage: "!layout <save|restore|show>", Desc: "save or recreate tmux windows and panes", Params: []paramInfo{{"<save|restore|show>", "subcommand"}}},
+	"!name":       {Usage: "!name <pane-id> <label>", Desc: "label a pane for %pane:<label> refs", Params: []paramInfo{{"<pane-id>", "tmux pane id"}, {"<label>", "stable name, - clears"}}},
+	"!spawn":      {Usage: "!spawn [-h|-v] [%name] [command]", Desc: "split a new pane running a command", Params: []paramInfo{{"[-h|-v]", "split side by side or stacked"}, {"[%name]", "buffer for the pane id and pane label"}, {"[command]", "command to run"}}},
+	"!kill":       {Usage: "!kill <pane>", Desc: "close a pane", Params: []paramInfo{{"<pane>", "pane id, %pane:name or buffer holding an id"}}},
+	"!focus":      {Usage: "!focus <pane>", Desc: "switch to a pane", Params: []paramInfo{{"<pane>", "pane id, %pane:name or buffer holding an id"}}},
+	"!record":     {Usage: "!record [<pane> <file> | stop [pane]]", Desc: "record a pane to an asciicast file", Params: []paramInfo{{"<pane>", "pane to record"}, {"<file>", "asciicast file"}, {"stop", "end recordings"}}},
+	"!replay":     {Usage: "!replay <file> [buffer]", Desc: "play back a recording or dump its text", Params: []paramInfo{{"<file>", "asciicast file"}, {"[buffer]", "store the final text instead"}}},
+	"!remote":     {Usage: "!remote add|rm|ls|panes [name] [user@host] [socket]", Desc: "manage tmux servers on other hosts", Params: []paramInfo{{"add|rm|ls|panes", "subcommand"}, {"[name]", "remote name, panes are %name:%N"}, {"[user@host]", "ssh destination"}, {"[socket]", "remote tmux socket path or name"}}},
+	"!watch":      {Usage: "!watch <buffer> <pane-id>", Desc: "append new pane output to buffer", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<pane-id>", "tmux pane id"}}},
+	"!unwatch":    {Usage: "!unwatch <buffer|all>", Desc: "stop watching a pane", Params: []paramInfo{{"<buffer|all>", "watched buffer or all"}}},
+	"!watches":    {Usage: "!watches", Desc: "list active pane watches"},
 	"!save":       {Usage: "!save <buffer> <file>", Desc: "save buffer to file", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<file>", "path to file"}}},
 	"!load":       {Usage: "!load <path>", Desc: "load file into %file", Params: []paramInfo{{"<path>", "file path"}}},
 	"!file":       {Usage: "!file <path> [buffer]", Desc: "load file into buffer", Params: []paramInfo{{"<path>", "file path"}, {"[buffer]", "optional buffer"}}},
@@ -321,6 +480,7 @@ var commands = map[string]commandInfo{
 	"!gen":        {Usage: "!gen <buffer> <prompt>", Desc: "AI prompt into buffer", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<prompt>", "text prompt"}}},
 	"!code":       {Usage: "!code <buffer> <prompt>", Desc: "AI prompt, store code", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<prompt>", "text prompt"}}},
 	"!cat":        {Usage: "!cat <buffer>", Desc: "print buffer contents", Params: []paramInfo{{"<buffer>", "buffer name"}}},
+	"!ctx":        {Usage: "!ctx <add|ls|rm|budget> [glob]", Desc: "attach project files to prompts", Params: []paramInfo{{"<add|ls|rm|budget>", "subcommand"}, {"[glob]", "file glob, ** allowed"}}},
 	"!set":        {Usage: "!set <buffer> <text>", Desc: "store text in buffer", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<text>", "text to store"}}},
 	"!prefix":     {Usage: "!prefix <buffer|file>", Desc: "set prefix from buffer or file", Params: []paramInfo{{"<buffer|file>", "buffer name or path"}}},
 	"!reset":      {Usage: "!reset", Desc: "reset session and prefix"},
@@ -330,9 +490,17 @@ var commands = map[string]commandInfo{
 	"!session":    {Usage: "!session", Desc: "store session JSON in %session"},
 	"!recap":      {Usage: "!recap", Desc: "summarize session and buffers"},
 	"!md":         {Usage: "!md <buffer> [source]", Desc: "render markdown from source buffer", Params: []paramInfo{{"<buffer>", "destination"}, {"[source]", "source buffer"}}},
-	"!run_on":     {Usage: "!run_on <buffer> <pane> <cmd>", Desc: "run command using pane capture", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<pane>", "pane to read"}, {"<cmd>", "command"}}},
+	"!paste":      {Usage: "!paste [-r|-n] [-f] <buffer> <pane>", Desc: "paste a buffer into a pane in one piece", Params: []paramInfo{{"-r", "press Enter afterwards"}, {"-n", "do not press Enter"}, {"-f", "ignore pane_write_max"}, {"<buffer>", "buffer name"}, {"<pane>", "target pane"}}},
+	"!group":      {Usage: "!group add|rm|ls [name] [panes...]", Desc: "manage named pane groups", Params: []paramInfo{{"add|rm|ls", "subcommand"}, {"[name]", "group name"}, {"[panes...]", "panes to add or remove"}}},
+	"!broadcast":  {Usage: "!broadcast <group> <cmd>", Desc: "run command on every pane of a group", Params: []paramInfo{{"<group>", "group name"}, {"<cmd>", "command"}}},
+	"!run_on":     {Usage: "!run_on <buffer> <pane> <cmd>", Desc: "run command in pane, store output and exit code", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<pane>", "pane to read"}, {"<cmd>", "command for a POSIX shell"}}},
+	"!on":         {Usage: "!on <pane> </regex/|regex> <command> | ls | rm <id|all>", Desc: "run a command when pane output matches", Params: []paramInfo{{"<pane>", "pane to follow"}, {"</regex/|regex>", "pattern in slashes, or one word; groups go to %match1..n"}, {"<command>", "! command to run"}, {"ls|rm", "list or remove rules"}}},
+	"!explain":    {Usage: "!explain [pane] | on <pane> | off [pane|all] | hook [pane] | ls", Desc: "AI diagnosis of a failed command", Params: []paramInfo{{"[pane]", "pane to explain, default the last error seen"}, {"on|off", "watch a pane for errors or stop"}, {"hook", "exit codes of commands typed into a shell are only seen with this prompt hook; prints it or types it into the pane"}, {"ls", "list watched panes"}}},
+	"!expect":     {Usage: "!expect <pane> </regex/|regex> [timeout]", Desc: "wait for regex in pane output", Params: []paramInfo{{"<pane>", "pane to watch"}, {"</regex/|regex>", "pattern in slashes, or the rest of the line; groups go to %match1..n"}, {"[timeout]", "seconds"}}},
+	"!interact":   {Usage: "!interact <pane> [timeout]", Desc: "macro line: run the rest as an expect script", Params: []paramInfo{{"<pane>", "target pane"}, {"[timeout]", "seconds per wait"}}},
 	"!flow":       {Usage: "!flow <buf1> [buf2 ... buf10]", Desc: "chain prompts using buffers", Params: []paramInfo{{"<buf>", "buffer name"}}},
 	"!grep":       {Usage: "!grep <regex> [buffers...]", Desc: "search buffers for regex", Params: []paramInfo{{"<regex>", "regular expression"}, {"[buffers...]", "optional buffers"}}},
+	"!index":      {Usage: "!index <add|rm|ls|query|auto> [args]", Desc: "offline BM25 search over notes", Params: []paramInfo{{"<add|rm|ls|query|auto>", "subcommand"}, {"[args]", "directory, search terms or k|off"}}},
 	"!macro":      {Usage: "!macro <buffer>", Desc: "run commands from buffer", Params: []paramInfo{{"<buffer>", "source buffer"}}},
 	"!alias":      {Usage: "!alias <name> <buffer>", Desc: "create macro alias", Params: []paramInfo{{"<name>", "alias name"}, {"<buffer>", "source buffer"}}},
 	"!model":      {Usage: "!model <name>", Desc: "set OpenAI model", Params: []paramInfo{{"<name>", "model name"}}},
@@ -350,8 +518,13 @@ var commands = map[string]commandInfo{
 	"!socat":      {Usage: "!socat <buffer> <args>", Desc: "pipe buffer to socat", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<args>", "socat arguments"}}},
 	"!curl":       {Usage: "!curl <url> [buffer] [headers]", Desc: "HTTP GET and store body", Params: []paramInfo{{"<url>", "target URL"}, {"[buffer]", "optional buffer"}, {"[headers]", "buffer with JSON headers"}}},
 	"!diff":       {Usage: "!diff <left> <right> [buffer]", Desc: "diff two buffers or files", Params: []paramInfo{{"<left>", "buffer or file"}, {"<right>", "buffer or file"}, {"[buffer]", "optional output"}}},
-	"!eat":        {Usage: "!eat <buffer> <pane>", Desc: "capture full scrollback", Params: []paramInfo{{"<buffer>", "buffer name"}, {"<pane>", "pane id"}}},
+	"!patch":      {Usage: "!patch <buffer> [dir]", Desc: "apply unified diff from buffer", Params: []paramInfo{{"<buffer>", "buffer with diff"}, {"[dir]", "base directory"}}},
+	"!exec":       {Usage: "!exec <buffer> [lang]", Desc: "run code buffer in a sandbox dir", Params: []paramInfo{{"<buffer>", "buffer with code"}, {"[lang]", "python|bash|go|c"}}},
+	"!eat":        {Usage: "!eat [-d] [-e|-p] <buffer> <pane>", Desc: "capture full scrollback", Params: []paramInfo{{"-d", "only lines since the last capture"}, {"-e", "keep color escapes"}, {"-p", "plain text"}, {"<buffer>", "buffer name"}, {"<pane>", "pane id"}}},
+	"!shot":       {Usage: "!shot [-r regex] <pane|buffer> <file.svg|file.png>", Desc: "render a colored capture as an image", Params: []paramInfo{{"-r regex", "black out matching lines"}, {"<pane|buffer>", "what to render"}, {"<file>", "svg or png file"}}},
+	"!strip":      {Usage: "!strip <buffer> [dest]", Desc: "remove color escapes", Params: []paramInfo{{"<buffer>", "buffer name"}, {"[dest]", "buffer for the result"}}},
 	"!view":       {Usage: "!view <buffer>", Desc: "show buffer in $VIEWER", Params: []paramInfo{{"<buffer>", "buffer name"}}},
+	"!popup":      {Usage: "!popup [view|edit|answer|all|off]", Desc: "open viewer, editor or answers in tmux popups", Params: []paramInfo{{"[view|edit|answer|all|off]", "what to show in popups"}}},
 	"!clip":       {Usage: "!clip <buffer>", Desc: "copy buffer to clipboard", Params: []paramInfo{{"<buffer>", "buffer name"}}},
 	"!rm":         {Usage: "!rm <buffer>", Desc: "remove a buffer", Params: []paramInfo{{"<buffer>", "buffer name"}}},
 	"!plugin":     {Usage: "!plugin <list|unload|reload|mute> [name]", Desc: "manage plugins"},
@@ -390,12 +563,24 @@ func replacePaneRefs(text string) string {
 		if len(m) < 2 {
 			return tok
 		}
-		id := "%" + m[1]
-		content, err := capturePane(id)
+		id, err := resolvePane(m[1])
+		if err != nil {
+			return fmt.Sprintf("[capture error: %v]", err)
+		}
+		// only {%1:new} moves the delta mark, a plain reference just reads
+		var content string
+		if m[2] != "" {
+			content, err = captureSince(id, false, false, true)
+		} else {
+			content, err = capturePaneText(id, false, false)
+		}
 		if err != nil {
 			return fmt.Sprintf("[capture error: %v]", err)
 		}
 		content = strings.TrimSpace(content)
+		if content == "" && m[2] != "" {
+			content = "(no new output)"
+		}
 		return "\n```\n" + content + "\n```\n"
 	})
 }
@@ -404,7 +589,7 @@ func replaceBufferRefs(text string) string {
 	return bufferPattern.ReplaceAllStringFunc(text, func(tok string) string {
 		if strings.HasPrefix(tok, "%") && len(tok) > 1 {
 			if isTmuxBuffer(tok) {
-				out, err := tmux.ShowBuffer(tmuxBufferName(tok))
+				out, err := mx.ShowBuffer(tmuxBufferName(tok))
 				if err == nil {
 					return out
 				}
@@ -469,7 +654,7 @@ func isTmuxBuffer(name string) bool {
 	if !strings.HasPrefix(name, "%") || len(name) < 2 {
 		return false
 	}
-	bufs, err := tmux.ListBuffers()
+	bufs, err := mx.ListBuffers()
 	if err != nil {
 		return false
 	}
@@ -492,7 +677,7 @@ func readBuffer(name string) (string, bool) {
 		return "", true
 	}
 	if isTmuxBuffer(name) {
-		out, err := tmux.ShowBuffer(tmuxBufferName(name))
+		out, err := mx.ShowBuffer(tmuxBufferName(name))
 		if err == nil {
 			out = plugin.GetManager().RunHook("after_read", name, out)
 			return out, true
@@ -502,11 +687,12 @@ func readBuffer(name string) (string, bool) {
 		val = plugin.GetManager().RunHook("after_read", name, val)
 		return val, true
 	}
-	if isPaneID(name) {
-		out, err := capturePane(name)
-		if err == nil {
-			out = plugin.GetManager().RunHook("after_read", name, out)
-			return out, true
+	if isPaneRef(name) {
+		if id, err := resolvePane(name); err == nil {
+			if out, err := capturePane(id); err == nil {
+				out = plugin.GetManager().RunHook("after_read", name, out)
+				return out, true
+			}
 		}
 	}
 	return "", false
@@ -517,12 +703,18 @@ func writeBuffer(name, data string) {
 	if name == "%null" {
 		return
 	}
-	if isPaneID(name) {
-		tmux.SendKeys(name, data)
+	if isPaneRef(name) {
+		id, err := resolvePane(name)
+		if err == nil {
+			err = writePane(id, data, wantEnter(data), false)
+		}
+		if err != nil {
+			warnPrintln("pane write error: " + err.Error())
+		}
 		return
 	}
 	if isTmuxBuffer(name) {
-		tmux.SetBuffer(tmuxBufferName(name), data)
+		mx.SetBuffer(tmuxBufferName(name), data)
 		return
 	}
 	data = plugin.GetManager().RunHook("before_write", name, data)
@@ -534,7 +726,7 @@ func validateBufferName(name string) error {
 	if !strings.HasPrefix(name, "%") {
 		return fmt.Errorf("buffer must start with %%")
 	}
-	if isPaneID(name) {
+	if isPaneRef(name) {
 		return fmt.Errorf("cannot use pane id as buffer")
 	}
 	if _, exists := buffers[name]; exists {
@@ -733,7 +925,7 @@ func sessionSnapshot() session {
 		}
 		bufCopy[k] = v
 	}
-	return session{History: history, Buffers: bufCopy, Prompt: askPrefix, APIKey: openai.GetSessionAPIKey(), APIURL: openai.GetSessionAPIURL(), Model: openai.GetModelName(), HighScore: highScore, Audit: auditLog, Summary: auditSummary, ChatCtx: string(chatCtx), CtxLimit: chatLimit}
+	return session{History: history, Buffers: bufCopy, Prompt: askPrefix, APIKey: openai.GetSessionAPIKey(), APIURL: openai.GetSessionAPIURL(), Model: openai.GetModelName(), HighScore: highScore, Audit: auditLog, Summary: auditSummary, ChatCtx: string(chatCtx), CtxLimit: chatLimit, CtxFiles: ctxFiles, Layout: savedLayout, Triggers: triggerRules()}
 }
 
 func loadSessionFromBuffer() {
@@ -783,6 +975,15 @@ func loadSessionFromBuffer() {
 	if s.CtxLimit != 0 {
 		chatLimit = s.CtxLimit
 	}
+	if len(s.CtxFiles) > 0 {
+		ctxFiles = s.CtxFiles
+	}
+	if len(s.Layout) > 0 {
+		savedLayout = s.Layout
+	}
+	if len(s.Triggers) > 0 {
+		restoreTriggers(s.Triggers)
+	}
 }
 
 func updateSessionBuffer() {
@@ -921,6 +1122,9 @@ func Run() error {
 			}
 			auditLog = s.Audit
 			auditSummary = s.Summary
+			ctxFiles = s.CtxFiles
+			savedLayout = s.Layout
+			restoreTriggers(s.Triggers)
 		}
 	}
 	if sessionFile != "" && sessionName == "" {
@@ -972,6 +1176,17 @@ func Run() error {
 	})
 	plugin.SetCommandAddFunc(addPluginCommand)
 	plugin.SetCommandRemoveFunc(removePluginCommand)
+	stopControl := startTmuxControl()
+	defer stopControl()
+	defer stopAllWatches()
+	defer stopAllRecordings()
+	defer tmux.CloseRemotes()
+	defer removeStatus()
+	defer stopAllTriggers()
+	defer stopExplain("")
+	if layoutAutoRestore && len(savedLayout) > 0 {
+		layoutCommand([]string{"restore"})
+	}
 	if err := plugin.GetManager().LoadAll(); err != nil {
 		cprintln("plugin load error: " + err.Error())
 	}
@@ -1009,6 +1224,9 @@ func Run() error {
 		AutoComplete:           &autoCompleter{},
 		Listener:               &helpListener{},
 	}
+	if stdin, err := newPromptStdin(os.Stdin); err == nil {
+		cfg.Stdin = stdin
+	}
 	rl, err := readline.NewEx(&cfg)
 	if err != nil {
 		return err
@@ -1030,6 +1248,7 @@ func Run() error {
 		}
 		fmt.Println(cwdLine)
 		rl.SetPrompt(basePrompt)
+		writeStatus()
 	}
 
 	if !seriousMode {
@@ -1082,7 +1301,7 @@ func Run() error {
 	setPrompt()
 	for {
 		flushPluginMsgs()
-		line, err := rl.Readline()
+		line, err := readPrompt(rl)
 		if err == readline.ErrInterrupt {
 			if len(line) == 0 {
 				cprintln("")
@@ -1096,6 +1315,7 @@ func Run() error {
 		}
 		line = strings.TrimSpace(line)
 		loadSessionFromBuffer()
+		runQueued()
 		if line == "" {
 			emptyCount++
 			if emptyCount >= 3 {
@@ -1121,7 +1341,7 @@ func Run() error {
 				cmdPrintln(err.Error())
 			} else {
 				userPrompt := replaceBufferRefs(replacePaneRefs(line))
-				promptText := userPrompt
+				promptText := withIndexContext(withFileContext(userPrompt), line)
 				ctx := getChatContext()
 				if ctx != "" {
 					promptText = "Context:\n" + ctx + "\n---\n" + promptText
@@ -1142,6 +1362,9 @@ func Run() error {
 						maybeSummarizeAudit()
 					}
 					appendChatHistory(userPrompt, reply)
+					if usePopup("answer") {
+						viewInPopup("grimux", reply)
+					}
 					forceEnter()
 				}
 			}
@@ -1187,7 +1410,10 @@ func saveSession() {
 		pwd, _ := readPassword()
 		sessionPass = pwd
 	}
-	s := session{History: history, Buffers: buffers, Prompt: askPrefix, APIKey: openai.GetSessionAPIKey(), APIURL: openai.GetSessionAPIURL(), Model: openai.GetModelName(), HighScore: highScore, Audit: auditLog, Summary: auditSummary}
+	if wins, err := captureLayout(); err == nil && len(wins) > 0 {
+		savedLayout = wins
+	}
+	s := session{History: history, Buffers: buffers, Prompt: askPrefix, APIKey: openai.GetSessionAPIKey(), APIURL: openai.GetSessionAPIURL(), Model: openai.GetModelName(), HighScore: highScore, Audit: auditLog, Summary: auditSummary, CtxFiles: ctxFiles, Layout: savedLayout, Triggers: triggerRules()}
 	if b, err := json.MarshalIndent(s, "", "  "); err == nil {
 		if sessionPass == "" {
 			os.WriteFile(sessionFile, b, 0644)
@@ -1251,66 +1477,53 @@ func handleCommand(cmd string) bool {
 	case "!x":
 		return true
 	case "!ls":
-		lsCmd := exec.Command("ls", "-lh")
-		lsCmd.Stdout = os.Stdout
-		lsCmd.Stderr = os.Stdout
-		lsCmd.Run()
-		forceEnter()
-		cmdPrintln(colorize(paneColor, "Panes:"))
-		c := exec.Command("tmux", "list-panes", "-F", "#{pane_id} #{pane_title} #{pane_current_command}")
-		c.Stdout = os.Stdout
-		c.Run()
-		forceEnter()
-		var tmuxBufSet map[string]struct{}
-		if bufs, err := tmux.ListBuffers(); err == nil && len(bufs) > 0 {
-			tmuxBufSet = make(map[string]struct{}, len(bufs))
-			total := 0
-			for _, b := range bufs {
-				tmuxBufSet["%"+b.Name] = struct{}{}
-				total += b.Size
-			}
-			cmdPrintln(colorize(tmuxBufColor, fmt.Sprintf("Tmux Buffers (%d bytes):", total)))
-			for _, b := range bufs {
-				cmdPrintln(fmt.Sprintf("%%%s (%d bytes)", b.Name, b.Size))
-			}
-			forceEnter()
-		}
-		total := 0
-		for k, v := range buffers {
-			if tmuxBufSet != nil {
-				if _, ok := tmuxBufSet[k]; ok {
-					continue
-				}
-			}
-			total += len(v)
-		}
-		cmdPrintln(colorize(bufferColor, fmt.Sprintf("Buffers (%d bytes):", total)))
-		for k, v := range buffers {
-			if tmuxBufSet != nil {
-				if _, ok := tmuxBufSet[k]; ok {
-					continue
-				}
-			}
-			cmdPrintln(fmt.Sprintf("%s (%d bytes)", k, len(v)))
-		}
+		lsCommand(fields[1:])
 	case "!observe":
-		if len(fields) < 3 {
+		args, keep, delta := captureFlags(fields[1:])
+		if len(args) < 2 {
 			usage("!observe")
 			return false
 		}
-		if _, ok := buffers[fields[1]]; !ok {
-			if err := validateBufferName(fields[1]); err != nil {
+		if _, ok := buffers[args[0]]; !ok {
+			if err := validateBufferName(args[0]); err != nil {
 				cmdPrintln(err.Error())
 				return false
 			}
 		}
-		out, err := capturePane(fields[2])
+		pane, err := paneArg(args[1])
+		if err != nil {
+			cmdPrintln(err.Error())
+			return false
+		}
+		out, err := captureSince(pane, false, keep, delta)
 		if err != nil {
 			cmdPrintln("capture error: " + err.Error())
 			return false
 		}
-		writeBuffer(fields[1], out)
-		cprint(out)
+		writeBuffer(args[0], out)
+		printColored(out)
+	case "!layout":
+		layoutCommand(fields[1:])
+	case "!name":
+		nameCommand(fields[1:])
+	case "!spawn":
+		spawnCommand(fields[1:])
+	case "!kill":
+		killCommand(fields[1:])
+	case "!focus":
+		focusCommand(fields[1:])
+	case "!record":
+		recordCommand(fields[1:])
+	case "!replay":
+		replayCommand(fields[1:])
+	case "!remote":
+		remoteCommand(fields[1:])
+	case "!watch":
+		watchCommand(fields[1:])
+	case "!unwatch":
+		unwatchCommand(fields[1:])
+	case "!watches":
+		watchesCommand()
 	case "!save":
 		if len(fields) < 3 {
 			usage("!save")
@@ -1365,7 +1578,7 @@ func handleCommand(cmd string) bool {
 		var data string
 		if fields[1] != "%null" {
 			if isTmuxBuffer(fields[1]) {
-				out, err := tmux.ShowBuffer(tmuxBufferName(fields[1]))
+				out, err := mx.ShowBuffer(tmuxBufferName(fields[1]))
 				if err == nil {
 					data = out
 				}
@@ -1392,17 +1605,19 @@ func handleCommand(cmd string) bool {
 		if editor == "" {
 			editor = "vim"
 		}
-		cmd := exec.Command(editor, tmp.Name())
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			cmdPrintln("vim error: " + err.Error())
+		if !usePopup("edit") || !editInPopup(fields[1], editor, tmp.Name()) {
+			cmd := exec.Command(editor, tmp.Name())
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				cmdPrintln("vim error: " + err.Error())
+			}
 		}
 		if b, err := os.ReadFile(tmp.Name()); err == nil {
 			if fields[1] != "%null" {
 				if isTmuxBuffer(fields[1]) {
-					tmux.SetBuffer(tmuxBufferName(fields[1]), string(b))
+					mx.SetBuffer(tmuxBufferName(fields[1]), string(b))
 				} else {
 					buffers[fields[1]] = string(b)
 				}
@@ -1446,7 +1661,7 @@ func handleCommand(cmd string) bool {
 			cmdPrintln(err.Error())
 			return false
 		}
-		promptText := replaceBufferRefs(replacePaneRefs(strings.Join(fields[2:], " ")))
+		promptText := withFileContext(replaceBufferRefs(replacePaneRefs(strings.Join(fields[2:], " "))))
 		stop := spinner()
 		reply, err := client.SendPrompt(promptText)
 		stop()
@@ -1473,7 +1688,7 @@ func handleCommand(cmd string) bool {
 			cprintln(err.Error())
 			return false
 		}
-		promptText := replaceBufferRefs(replacePaneRefs(strings.Join(fields[2:], " ")))
+		promptText := withFileContext(replaceBufferRefs(replacePaneRefs(strings.Join(fields[2:], " "))))
 		stop := spinner()
 		reply, err := client.SendPrompt(promptText)
 		stop()
@@ -1496,11 +1711,13 @@ func handleCommand(cmd string) bool {
 		}
 		for i := 1; i < len(fields); i++ {
 			if val, ok := readBuffer(fields[i]); ok {
-				cprint(val)
+				printColored(val)
 			} else {
 				cmdPrintln("unknown buffer")
 			}
 		}
+	case "!ctx":
+		ctxCommand(fields[1:])
 	case "!set":
 		if len(fields) < 3 {
 			usage("!set")
@@ -1548,6 +1765,12 @@ func handleCommand(cmd string) bool {
 		openai.SetSessionAPIURL("")
 		auditLog = nil
 		auditSummary = ""
+		ctxFiles = nil
+		savedLayout = nil
+		captureMarks = map[string]captureMark{}
+		paneGroups = map[string][]string{}
+		stopAllTriggers()
+		stopExplain("")
 		cmdPrintln("session reset")
 	case "!new":
 		chatCtx = nil
@@ -1630,23 +1853,19 @@ func handleCommand(cmd string) bool {
 	// !run_on sends a command to a different tmux pane, waits briefly and
 	// captures that pane's output back into a buffer. It allows automation
 	// against tools running in other panes.
+	case "!paste":
+		pasteCommand(fields[1:])
+	case "!group":
+		groupCommand(fields[1:])
+	case "!broadcast":
+		broadcastCommand(fields[1:])
 	case "!run_on":
 		if len(fields) < 4 {
 			usage("!run_on")
 			return false
 		}
 		cmdStr := replaceBufferRefs(replacePaneRefs(strings.Join(fields[3:], " ")))
-		if err := tmux.SendKeys(fields[2], cmdStr, "Enter"); err != nil {
-			cmdPrintln("run_on error: " + err.Error())
-			return false
-		}
-		time.Sleep(200 * time.Millisecond)
-		out, err := capturePane(fields[2])
-		if err != nil {
-			cmdPrintln("capture error: " + err.Error())
-			return false
-		}
-		buffers[fields[1]] = out
+		runOnCommand(fields[1], fields[2], cmdStr)
 		forceEnter()
 	case "!flow":
 		if len(fields) < 2 || len(fields) > 11 {
@@ -1722,6 +1941,8 @@ func handleCommand(cmd string) bool {
 				lineNo++
 			}
 		}
+	case "!index":
+		indexCommand(fields[1:])
 	case "!macro":
 		if len(fields) < 2 {
 			usage("!macro")
@@ -1733,13 +1954,26 @@ func handleCommand(cmd string) bool {
 			return false
 		}
 		lines := strings.Split(strings.TrimSpace(data), "\n")
-		for _, l := range lines {
+		for i, l := range lines {
 			l = strings.TrimSpace(l)
 			if l == "" {
 				continue
 			}
+			if f := strings.Fields(l); f[0] == "!interact" {
+				// the rest of the macro is an interact script
+				interactCommand(f[1:], lines[i+1:])
+				break
+			}
 			handleCommand(l)
 		}
+	case "!on":
+		onCommand(fields[1:], strings.TrimPrefix(strings.TrimSpace(cmd), "!on"))
+	case "!explain":
+		explainCommand(fields[1:])
+	case "!expect":
+		expectCommand(fields[1:], strings.TrimPrefix(strings.TrimSpace(cmd), "!expect"))
+	case "!interact":
+		cmdPrintln("!interact only works inside a macro")
 	case "!alias":
 		if len(fields) < 3 {
 			usage("!alias")
@@ -2111,17 +2345,49 @@ func handleCommand(cmd string) bool {
 			cmdPrintln(result)
 		}
 		forceEnter()
+	case "!patch":
+		if len(fields) < 2 {
+			usage("!patch")
+			return false
+		}
+		dir := "."
+		if len(fields) >= 3 {
+			dir = fields[2]
+		}
+		patchCommand(fields[1], dir)
+	case "!exec":
+		if len(fields) < 2 {
+			usage("!exec")
+			return false
+		}
+		lang := ""
+		if len(fields) >= 3 {
+			lang = fields[2]
+		}
+		execCommand(fields[1], lang)
 	case "!eat":
-		if len(fields) < 3 {
+		args, keep, delta := captureFlags(fields[1:])
+		if len(args) < 2 {
 			usage("!eat")
 			return false
 		}
-		out, err := tmux.CapturePaneFull(fields[2])
+		pane, err := paneArg(args[1])
+		if err != nil {
+			cmdPrintln(err.Error())
+			return false
+		}
+		out, err := captureSince(pane, true, keep, delta)
 		if err != nil {
 			cmdPrintln("capture error: " + err.Error())
 			return false
 		}
-		writeBuffer(fields[1], out)
+		writeBuffer(args[0], out)
+	case "!shot":
+		shotCommand(fields[1:])
+	case "!popup":
+		popupCommand(fields[1:])
+	case "!strip":
+		stripCommand(fields[1:])
 	case "!view":
 		if len(fields) < 2 {
 			usage("!view")
@@ -2132,17 +2398,18 @@ func handleCommand(cmd string) bool {
 			cmdPrintln("unknown buffer")
 			return false
 		}
-		viewer := os.Getenv("VIEWER")
-		if viewer == "" {
-			viewer = "batcat"
+		if usePopup("view") && viewInPopup(fields[1], data) {
+			writeBuffer("%viewer", data)
+			return false
 		}
-		cmd := exec.Command(viewer, "-l", "markdown")
-		cmd.Stdin = strings.NewReader(data)
+		name, args, text := viewer(data)
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = strings.NewReader(text)
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		viewerRunning = true
 		if err := cmd.Run(); err != nil {
-			cmdPrintln(viewer + " error: " + err.Error())
+			cmdPrintln(name + " error: " + err.Error())
 		}
 		viewerRunning = false
 		if pendingGrass {
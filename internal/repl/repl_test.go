@@ -2,12 +2,22 @@ package repl
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/glo0ml34f/grimux/internal/mux"
+	"github.com/glo0ml34f/grimux/internal/tmux"
 )
 
 func TestReplacePaneRefs(t *testing.T) {
@@ -65,6 +75,15 @@ func TestLastCodeBlock(t *testing.T) {
 	}
 }
 
+func TestSnippet(t *testing.T) {
+	if got := snippet("héllo  wörld", 2); got != "h..." {
+		t.Fatalf("unexpected snippet: %q", got)
+	}
+	if got := snippet("héllo\nwörld", 20); got != "héllo wörld" {
+		t.Fatalf("unexpected snippet: %q", got)
+	}
+}
+
 func TestNullBuffer(t *testing.T) {
 	writeBuffer("%null", "ignored")
 	if val, ok := readBuffer("%null"); !ok || val != "" {
@@ -164,3 +183,1324 @@ func TestReadBufferTmuxRefresh(t *testing.T) {
 		t.Fatalf("unexpected args: %q", args)
 	}
 }
+
+func TestParseUnifiedDiff(t *testing.T) {
+	diff := "Here you go:\n```diff\n--- a/foo.txt\n+++ b/foo.txt\n@@ -1,3 +1,3 @@\n one\n-two\n+TWO\n three\n```\n"
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(patches) != 1 || patches[0].target() != "foo.txt" || len(patches[0].hunks) != 1 {
+		t.Fatalf("unexpected patches: %+v", patches)
+	}
+	if len(patches[0].hunks[0].lines) != 4 {
+		t.Fatalf("unexpected hunk lines: %q", patches[0].hunks[0].lines)
+	}
+}
+
+func TestParseDiffDashLines(t *testing.T) {
+	// a removed "-- note" and an added "++ x" line look like a file header
+	diff := "--- a/q.sql\n+++ b/q.sql\n@@ -1,2 +1,2 @@\n--- note\n+++ x\n select 1;\n" +
+		"--- a/r.sql\n+++ b/r.sql\n@@ -1 +1 @@\n-a\n+b\n"
+	patches, err := parseUnifiedDiff(diff)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(patches) != 2 || patches[1].target() != "r.sql" {
+		t.Fatalf("unexpected patches: %+v", patches)
+	}
+	if got := strings.Join(patches[0].hunks[0].lines, "|"); got != "--- note|+++ x| select 1;" {
+		t.Fatalf("hunk cut short: %q", got)
+	}
+}
+
+func TestApplyHunksFuzzy(t *testing.T) {
+	src := []string{"header", "extra", "one", "two", "three"}
+	hunks := []patchHunk{{oldStart: 1, lines: []string{" one", "-two", "+TWO", " three"}}}
+	out, rej := applyHunks(src, hunks)
+	if len(rej) != 0 {
+		t.Fatalf("unexpected rejects: %v", rej)
+	}
+	if strings.Join(out, ",") != "header,extra,one,TWO,three" {
+		t.Fatalf("unexpected result: %q", out)
+	}
+
+	hunks = []patchHunk{{oldStart: 1, lines: []string{" missing", "-two", "+2"}}}
+	out, rej = applyHunks(src, hunks)
+	if len(rej) != 1 || strings.Join(out, ",") != strings.Join(src, ",") {
+		t.Fatalf("expected rejected hunk, got %q %v", out, rej)
+	}
+}
+
+func TestPatchWritesBackup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foo.txt")
+	if err := os.WriteFile(path, []byte("one\ntwo\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	patches, err := parseUnifiedDiff("--- a/foo.txt\n+++ b/foo.txt\n@@ -1,2 +1,2 @@\n one\n-two\n+2\n")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	results, err := preparePatch(patches, dir)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if err := writePatchResults(results); err != nil {
+		t.Fatalf("write results: %v", err)
+	}
+	if b, _ := os.ReadFile(path); string(b) != "one\n2\n" {
+		t.Fatalf("unexpected patched file: %q", b)
+	}
+	if b, _ := os.ReadFile(path + ".orig"); string(b) != "one\ntwo\n" {
+		t.Fatalf("unexpected backup: %q", b)
+	}
+}
+
+func TestPatchStaysInDir(t *testing.T) {
+	dir := t.TempDir()
+	for _, diff := range []string{
+		"--- a/x\n+++ b/../../.ssh/authorized_keys\n@@ -0,0 +1 @@\n+key\n",
+		"--- /dev/null\n+++ /etc/passwd\n@@ -0,0 +1 @@\n+root\n",
+	} {
+		patches, err := parseUnifiedDiff(diff)
+		if err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+		if _, err := preparePatch(patches, dir); err == nil {
+			t.Fatalf("patch outside dir accepted: %q", diff)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "new.txt"), []byte("keep\n"), 0644)
+	patches, _ := parseUnifiedDiff("--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+clobber\n")
+	if _, err := preparePatch(patches, dir); err == nil {
+		t.Fatal("new file patch overwrote an existing file")
+	}
+}
+
+func TestDetectCode(t *testing.T) {
+	code, lang := detectCode("try this:\n```py\nprint('hi')\n```\n")
+	if code != "print('hi')" || lang != "python" {
+		t.Fatalf("unexpected detection: %q %q", code, lang)
+	}
+	_, lang = detectCode("#!/usr/bin/env bash\necho hi\n")
+	if lang != "bash" {
+		t.Fatalf("shebang not detected: %q", lang)
+	}
+}
+
+func TestExecCommand(t *testing.T) {
+	buffers["%prog"] = "```bash\necho out; echo err >&2; exit 3\n```"
+	defer delete(buffers, "%prog")
+	handleCommand("!exec %prog")
+	if buffers["%exec_out"] != "out\n" || buffers["%exec_err"] != "err\n" || buffers["%exec_status"] != "3" {
+		t.Fatalf("unexpected exec buffers: %q %q %q", buffers["%exec_out"], buffers["%exec_err"], buffers["%exec_status"])
+	}
+
+	old := execTimeout
+	execTimeout = 200 * time.Millisecond
+	defer func() { execTimeout = old }()
+	buffers["%prog"] = "sleep 5"
+	handleCommand("!exec %prog bash")
+	if buffers["%exec_status"] != "timeout" {
+		t.Fatalf("expected timeout, got %q", buffers["%exec_status"])
+	}
+}
+
+func TestCtxFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	os.MkdirAll(filepath.Join(dir, "src", "gen"), 0755)
+	os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("gen/\n*.log\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "a.go"), []byte("package a\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "gen", "b.go"), []byte("package b\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "debug.log"), []byte("noise\n"), 0644)
+	old, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(old)
+	defer func() { ctxFiles = nil }()
+
+	handleCommand("!ctx add src/**/*")
+	if len(ctxFiles) != 1 || ctxDisplayName(ctxFiles[0]) != filepath.Join("src", "a.go") {
+		t.Fatalf("unexpected ctx files: %v", ctxFiles)
+	}
+	got := withFileContext("question")
+	if !strings.Contains(got, "==> src/a.go <==") || !strings.HasSuffix(got, "question") {
+		t.Fatalf("unexpected prompt: %q", got)
+	}
+
+	oldBudget := ctxBudget
+	ctxBudget = 1
+	defer func() { ctxBudget = oldBudget }()
+	if _, dropped := buildFileContext(); len(dropped) != 1 {
+		t.Fatalf("expected file dropped over budget, got %v", dropped)
+	}
+
+	handleCommand("!ctx rm src/*.go")
+	if len(ctxFiles) != 0 {
+		t.Fatalf("ctx file not removed: %v", ctxFiles)
+	}
+
+	// plain globs skip ignored directories and nested .gitignore files count
+	os.WriteFile(filepath.Join(dir, "src", ".gitignore"), []byte("a.go\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "src", "c.go"), []byte("package c\n"), 0644)
+	handleCommand("!ctx add src/gen/*.go")
+	handleCommand("!ctx add src/*.go")
+	if len(ctxFiles) != 1 || ctxDisplayName(ctxFiles[0]) != filepath.Join("src", "c.go") {
+		t.Fatalf("unexpected ctx files: %v", ctxFiles)
+	}
+}
+
+func TestNewLines(t *testing.T) {
+	prev := []string{"a", "b", "c"}
+	if got := newLines(prev, []string{"b", "c", "d"}, nil); strings.Join(got, ",") != "d" {
+		t.Fatalf("scroll: %v", got)
+	}
+	recent := map[string]bool{"a": true, "b": true}
+	if got := newLines(prev, []string{"b", "x", "a"}, recent); strings.Join(got, ",") != "x" {
+		t.Fatalf("redraw: %v", got)
+	}
+}
+
+func TestWatchAppends(t *testing.T) {
+	screens := []string{"a\nb\n$ ", "a\nb\nc\n$ ", "b\nc\nd\ne\n$ ", "c\nd\ny\n$ "}
+	var mu sync.Mutex
+	i := 0
+	old := capturePane
+	capturePane = func(target string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s := screens[i]
+		if i < len(screens)-1 {
+			i++
+		}
+		return s, nil
+	}
+	oldInterval := watchInterval
+	watchInterval = time.Millisecond
+	defer func() { capturePane = old; watchInterval = oldInterval; delete(buffers, "%tail") }()
+
+	handleCommand("!watch %tail %3")
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := i == len(screens)-1
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	handleCommand("!unwatch %tail")
+	if buffers["%tail"] != "c\nd\ne\ny\n" {
+		t.Fatalf("unexpected watch buffer: %q", buffers["%tail"])
+	}
+	if len(watchNames()) != 0 {
+		t.Fatalf("watch not removed")
+	}
+}
+
+func TestWatchWakesPrompt(t *testing.T) {
+	screens := []string{"a\n$ ", "a\nb\n$ ", "a\nb\nc\n$ "}
+	var mu sync.Mutex
+	i := 0
+	old := capturePane
+	capturePane = func(target string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		s := screens[i]
+		if i < len(screens)-1 {
+			i++
+		}
+		return s, nil
+	}
+	oldInterval := watchInterval
+	watchInterval = time.Millisecond
+	in, typed, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := newPromptStdin(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := readline.NewEx(&readline.Config{
+		Stdin:          stdin,
+		Stdout:         io.Discard,
+		Stderr:         io.Discard,
+		FuncIsTerminal: func() bool { return true },
+		FuncMakeRaw:    func() error { return nil },
+		FuncExitRaw:    func() error { return nil },
+		FuncGetWidth:   func() int { return 80 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		typed.Close()
+		rl.Close()
+		in.Close()
+		wakeR.Close()
+		wakeW.Close()
+		wakeR, wakeW = nil, nil
+		capturePane = old
+		watchInterval = oldInterval
+		delete(buffers, "%idle")
+	}()
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		line, err := readPrompt(rl)
+		done <- result{line, err}
+	}()
+	typed.Write([]byte("!ls"))
+	for !atPrompt.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	handleCommand("!watch %idle %3")
+	watchMu.Lock()
+	w := watches["%idle"]
+	watchMu.Unlock()
+	// the watched lines are appended while the prompt is still waiting
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w.mu.Lock()
+		n := w.lines
+		w.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("prompt not woken, %d line(s) appended", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	typed.Write([]byte(" %idle\r"))
+	r := <-done
+	if r.err != nil || r.line != "!ls %idle" {
+		t.Fatalf("unfinished line lost: %q %v", r.line, r.err)
+	}
+	// as the main loop does before running the line
+	loadSessionFromBuffer()
+	if buffers["%idle"] != "b\nc\n" {
+		t.Fatalf("unexpected watch buffer: %q", buffers["%idle"])
+	}
+	handleCommand("!unwatch %idle")
+}
+
+func TestRunOnMarkers(t *testing.T) {
+	var typed string
+	oldSend, oldCap := sendKeys, capturePaneFull
+	sendKeys = func(target string, keys ...string) error {
+		typed = keys[0]
+		return nil
+	}
+	calls := 0
+	capturePaneFull = func(target string) (string, error) {
+		calls++
+		id := regexp.MustCompile(`START_([0-9a-f]+)__`).FindStringSubmatch(strings.ReplaceAll(typed, "''", ""))[1]
+		screen := "$ " + typed + "\n__GRIMUX_START_" + id + "__\nline one\n"
+		if calls < 3 {
+			return screen, nil
+		}
+		return screen + "partial\n__GRIMUX_END_" + id + "_2__\n$ ", nil
+	}
+	oldPoll := runOnPoll
+	runOnPoll = time.Millisecond
+	defer func() { sendKeys, capturePaneFull, runOnPoll = oldSend, oldCap, oldPoll; delete(buffers, "%ro") }()
+
+	handleCommand("!run_on %ro %1 make test")
+	if !strings.Contains(typed, "{\nmake test\n}") {
+		t.Fatalf("command not wrapped: %q", typed)
+	}
+	if buffers["%ro"] != "line one\npartial" || buffers["%run_on_status"] != "2" {
+		t.Fatalf("unexpected run_on result: %q %q", buffers["%ro"], buffers["%run_on_status"])
+	}
+}
+
+func TestRunOnMarkersShell(t *testing.T) {
+	for _, tc := range []struct{ cmd, out, code string }{
+		{"echo hi; (exit 3)", "hi\n", "3"},
+		{"true &", "", "0"},
+		{"echo hi # why not", "hi\n", "0"},
+	} {
+		wrapped, start, end := runOnMarkers(tc.cmd)
+		b, err := exec.Command("sh", "-c", wrapped).Output()
+		if err != nil {
+			t.Fatalf("%q: %v", tc.cmd, err)
+		}
+		out, code, done := extractRunOutput(string(b), start, end)
+		if !done || out != tc.out || code != tc.code {
+			t.Fatalf("%q: got %q %q %v", tc.cmd, out, code, done)
+		}
+	}
+}
+
+func TestRunOnNoShell(t *testing.T) {
+	oldSend, oldCap, oldTimeout := sendKeys, capturePaneFull, runOnTimeout
+	sendKeys = func(target string, keys ...string) error { return nil }
+	capturePaneFull = func(target string) (string, error) { return "fish: Unsupported use of '{'\n> ", nil }
+	runOnTimeout = time.Millisecond
+	defer func() { sendKeys, capturePaneFull, runOnTimeout = oldSend, oldCap, oldTimeout }()
+	if _, _, err := runOn("%1", "ls"); err == nil || !strings.Contains(err.Error(), "POSIX shell") {
+		t.Fatalf("expected a shell error, got %v", err)
+	}
+}
+
+func TestInteractScript(t *testing.T) {
+	var mu sync.Mutex
+	screen := "$ "
+	oldSend, oldLiteral, oldCap := sendKeys, sendLiteral, capturePaneFull
+	sendKeys = func(target string, keys ...string) error { return nil }
+	sendLiteral = func(target, text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch text {
+		case "ssh box":
+			screen += "ssh box\nAre you sure (yes/no)? "
+		case "yes":
+			screen += "yes\nroot@box's password: "
+		case "hunter2":
+			screen += "\nLast login: from 10.0.0.7\n# "
+		}
+		return nil
+	}
+	capturePaneFull = func(target string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return screen + "\n\n", nil
+	}
+	oldPoll := expectPoll
+	expectPoll = time.Millisecond
+	defer func() {
+		sendKeys, sendLiteral, capturePaneFull, expectPoll = oldSend, oldLiteral, oldCap, oldPoll
+		for _, b := range []string{"%script", "%pw", "%match", "%match1", "%match_ip", "%done"} {
+			delete(buffers, b)
+		}
+	}()
+
+	buffers["%pw"] = "hunter2"
+	buffers["%script"] = `!interact %5 1
+send ssh box
+:loop
+on password: => login
+on \(yes/no\)\? => hostkey
+timeout => fail
+:hostkey
+send yes
+goto loop
+:login
+send %pw
+expect /from (?P<ip>[0-9.]+)/
+!set %done ok
+end
+:fail
+!set %done failed`
+	handleCommand("!macro %script")
+	if buffers["%done"] != "ok" || buffers["%match_ip"] != "10.0.0.7" || buffers["%match1"] != "10.0.0.7" {
+		t.Fatalf("unexpected script result: done=%q ip=%q", buffers["%done"], buffers["%match_ip"])
+	}
+
+	handleCommand("!expect %5 nothing 0.05")
+	if buffers["%match"] != "" {
+		t.Fatalf("expected no match, got %q", buffers["%match"])
+	}
+}
+
+func TestParseExpect(t *testing.T) {
+	for _, tc := range []struct {
+		in, pattern string
+		timeout     time.Duration
+	}{
+		{" /a  b/ 2", "a  b", 2 * time.Second},
+		{" a\tb  c", "a\tb  c", expectTimeout},
+		{" port  0.5", "port", 500 * time.Millisecond},
+		{` /x\/y/`, `x\/y`, expectTimeout},
+	} {
+		pattern, timeout, err := parseExpect(tc.in)
+		if err != nil || pattern != tc.pattern || timeout != tc.timeout {
+			t.Fatalf("%q: got %q %s %v", tc.in, pattern, timeout, err)
+		}
+	}
+	if _, _, err := parseExpect("/open"); err == nil {
+		t.Fatal("expected an error for a missing slash")
+	}
+}
+
+func TestExpectAfterTrim(t *testing.T) {
+	var mu sync.Mutex
+	lines := []string{"old 1", "flag one", "old 2", "old 3", "$ run"}
+	oldCap := capturePaneFull
+	capturePaneFull = func(target string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+	defer func() {
+		capturePaneFull = oldCap
+		for _, b := range []string{"%match", "%match1", "%match_session"} {
+			delete(buffers, b)
+		}
+	}()
+	re := regexp.MustCompile(`flag (?P<session>\w+)`)
+	from, err := expectStart("%5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// history-limit drops two lines while new output arrives
+	mu.Lock()
+	lines = append(lines[2:], "flag two", "$ ")
+	mu.Unlock()
+	idx, end, err := expectWait("%5", []*regexp.Regexp{re}, 0, from)
+	if err != nil || idx != 0 || buffers["%match1"] != "two" {
+		t.Fatalf("unexpected match %d %q %v", idx, buffers["%match1"], err)
+	}
+	if buffers["%session"] == "two" || buffers["%match_session"] != "two" {
+		t.Fatalf("named group stored in the wrong buffer")
+	}
+	// after the history is cleared old text on screen is not matched again
+	mu.Lock()
+	lines = []string{"flag two", "$ "}
+	mu.Unlock()
+	if idx, _, _ := expectWait("%5", []*regexp.Regexp{re}, 0, end); idx != -1 {
+		t.Fatal("matched output from before the clear")
+	}
+}
+
+func TestLsJSON(t *testing.T) {
+	old := listPanes
+	listPanes = func() ([]tmux.PaneInfo, error) {
+		return []tmux.PaneInfo{{ID: "%4", Session: "main", Window: 1, Command: "gdb"}}, nil
+	}
+	defer func() { listPanes = old; delete(buffers, "%inv") }()
+
+	handleCommand("!ls %inv")
+	var inv inventory
+	if err := json.Unmarshal([]byte(buffers["%inv"]), &inv); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if len(inv.Panes) != 1 || inv.Panes[0].ID != "%4" || inv.Panes[0].Command != "gdb" {
+		t.Fatalf("unexpected panes: %+v", inv.Panes)
+	}
+	if !strings.Contains(formatPane(inv.Panes[0]), "main:1.") {
+		t.Fatalf("unexpected pane line: %q", formatPane(inv.Panes[0]))
+	}
+}
+
+func TestNamedPaneRefs(t *testing.T) {
+	labels := map[string]string{"%2": "web"}
+	oldList, oldLabel, oldCap := listPanes, setPaneLabel, capturePane
+	listPanes = func() ([]tmux.PaneInfo, error) {
+		var panes []tmux.PaneInfo
+		for _, id := range []string{"%2", "%5", "%9"} {
+			p := tmux.PaneInfo{ID: id, Label: labels[id], Command: "bash"}
+			if id == "%5" {
+				p.Command = "gdb"
+				p.Title = "debugger"
+			}
+			if id == "%9" {
+				p.Active = true
+			}
+			panes = append(panes, p)
+		}
+		return panes, nil
+	}
+	setPaneLabel = func(target, label string) error {
+		for id, l := range labels {
+			if id == target || (label != "" && l == label) {
+				delete(labels, id)
+			}
+		}
+		if label != "" {
+			labels[target] = label
+		}
+		return nil
+	}
+	capturePane = func(target string) (string, error) { return "screen of " + target, nil }
+	defer func() { listPanes, setPaneLabel, capturePane = oldList, oldLabel, oldCap; delete(buffers, "%shot") }()
+
+	for ref, want := range map[string]string{"%pane:web": "%2", "%pane:debugger": "%5", "%cmd:gdb": "%5", "%cmd:bash": "%9", "%7": "%7"} {
+		if got, err := resolvePane(ref); err != nil || got != want {
+			t.Fatalf("resolvePane(%s) = %q, %v", ref, got, err)
+		}
+	}
+	if _, err := resolvePane("%pane:nope"); err == nil {
+		t.Fatalf("expected error for unknown label")
+	}
+	if got := replacePaneRefs("{%cmd:gdb}"); !strings.Contains(got, "screen of %5") {
+		t.Fatalf("unexpected capture: %q", got)
+	}
+
+	handleCommand("!name %9 web")
+	if labels["%9"] != "web" || labels["%2"] != "" {
+		t.Fatalf("label not moved: %v", labels)
+	}
+	handleCommand("!observe %shot %pane:web")
+	if buffers["%shot"] != "screen of %9" {
+		t.Fatalf("unexpected observe result: %q", buffers["%shot"])
+	}
+	// references outside pane arguments are left alone
+	handleCommand("!set %shot ssh to %pane:nope")
+	if buffers["%shot"] != "ssh to %pane:nope" {
+		t.Fatalf("unexpected set result: %q", buffers["%shot"])
+	}
+}
+
+func TestSpawnKillFocus(t *testing.T) {
+	var split, killed, focused, labelled string
+	oldSplit, oldKill, oldSel, oldLabel := splitWindow, killPane, selectPane, setPaneLabel
+	splitWindow = func(opts tmux.SplitOptions) (string, error) {
+		split = fmt.Sprintf("%v %s", opts.Horizontal, opts.Command)
+		return "%12", nil
+	}
+	killPane = func(target string) error { killed = target; return nil }
+	selectPane = func(target string) error { focused = target; return nil }
+	setPaneLabel = func(target, label string) error { labelled = target + " " + label; return nil }
+	defer func() {
+		splitWindow, killPane, selectPane, setPaneLabel = oldSplit, oldKill, oldSel, oldLabel
+		for _, b := range []string{"%spawn", "%listener", "%port"} {
+			delete(buffers, b)
+		}
+	}()
+
+	buffers["%port"] = "4444"
+	handleCommand("!spawn -h %listener nc -lvnp %port")
+	if split != "true nc -lvnp 4444" || buffers["%listener"] != "%12" || buffers["%spawn"] != "%12" || labelled != "%12 listener" {
+		t.Fatalf("unexpected spawn: %q %q %q", split, buffers["%listener"], labelled)
+	}
+	handleCommand("!focus %listener")
+	handleCommand("!kill %12")
+	if focused != "%12" || killed != "%12" {
+		t.Fatalf("unexpected focus/kill: %q %q", focused, killed)
+	}
+}
+
+func TestRestoreLayout(t *testing.T) {
+	t.Setenv("TMUX_PANE", "%0")
+	var calls []string
+	next := 10
+	oldSplit, oldNew, oldSel, oldTitle, oldLabel, oldList := splitWindow, newWindow, selectLayout, setPaneTitle, setPaneLabel, listPanes
+	splitWindow = func(opts tmux.SplitOptions) (string, error) {
+		next++
+		calls = append(calls, fmt.Sprintf("split %s %v %s %q -> %%%d", opts.Target, opts.Before, opts.Dir, opts.Command, next))
+		return fmt.Sprintf("%%%d", next), nil
+	}
+	newWindow = func(name, dir, command string) (string, error) {
+		next++
+		calls = append(calls, fmt.Sprintf("new %s %s %q -> %%%d", name, dir, command, next))
+		return fmt.Sprintf("%%%d", next), nil
+	}
+	selectLayout = func(target, layout string) error {
+		if layout != "tiled" {
+			calls = append(calls, "layout "+target+" "+layout)
+		}
+		return nil
+	}
+	setPaneTitle = func(target, title string) error { return nil }
+	setPaneLabel = func(target, label string) error { calls = append(calls, "label "+target+" "+label); return nil }
+	listPanes = func() ([]tmux.PaneInfo, error) { return []tmux.PaneInfo{{ID: "%0", Session: "s"}}, nil }
+	defer func() {
+		splitWindow, newWindow, selectLayout, setPaneTitle, setPaneLabel, listPanes = oldSplit, oldNew, oldSel, oldTitle, oldLabel, oldList
+	}()
+
+	wins := []layoutWindow{
+		{Name: "main", Layout: "L1", Panes: []layoutPane{{Dir: "/a"}, {Dir: "/b", Grimux: true}, {Dir: "/c", Command: "sleep 9", Label: "sleeper"}}},
+		{Name: "logs", Layout: "L2", Panes: []layoutPane{{Dir: "/var"}, {Dir: "/d", Command: "tail -f x"}}},
+	}
+	n, err := restoreLayout(wins)
+	if err != nil || n != 4 {
+		t.Fatalf("restoreLayout = %d, %v", n, err)
+	}
+	want := []string{
+		`split %0 true /a "" -> %11`,
+		`split %0 false /c "sleep 9" -> %12`,
+		"layout %11 L1",
+		"label %12 sleeper",
+		`new logs /var "" -> %13`,
+		`split %13 false /d "tail -f x" -> %14`,
+		"layout %13 L2",
+	}
+	if strings.Join(calls, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected calls:\n%s", strings.Join(calls, "\n"))
+	}
+}
+
+func TestObserveColorsAndStrip(t *testing.T) {
+	oldCap, oldANSI := capturePane, capturePaneANSI
+	capturePane = func(target string) (string, error) { return "plain\n", nil }
+	capturePaneANSI = func(target string) (string, error) { return "\x1b[31merror\x1b[0m: bad\n", nil }
+	defer func() {
+		capturePane, capturePaneANSI = oldCap, oldANSI
+		delete(buffers, "%col")
+		delete(buffers, "%flat")
+	}()
+
+	handleCommand("!observe %col %1")
+	if buffers["%col"] != "plain\n" {
+		t.Fatalf("expected plain capture, got %q", buffers["%col"])
+	}
+	handleCommand("!observe -e %col %1")
+	if buffers["%col"] != "\x1b[31merror\x1b[0m: bad\n" {
+		t.Fatalf("escapes not kept: %q", buffers["%col"])
+	}
+	handleCommand("!strip %col %flat")
+	if buffers["%flat"] != "error: bad\n" || buffers["%col"] == buffers["%flat"] {
+		t.Fatalf("unexpected strip result: %q", buffers["%flat"])
+	}
+	handleCommand("!strip %col")
+	if buffers["%col"] != "error: bad\n" {
+		t.Fatalf("strip in place failed: %q", buffers["%col"])
+	}
+}
+
+func TestObserveDelta(t *testing.T) {
+	lines := []string{"$ make", "cc a.c", "$ "}
+	history := 0
+	oldPos, oldRange, oldCap := panePosition, capturePaneRange, capturePane
+	panePosition = func(target string) (int, int, error) { return history, len(lines) - 1 - history, nil }
+	capturePaneRange = func(target string, start, end int, escapes bool) (string, error) {
+		return strings.Join(lines[history+start:history+end+1], "\n") + "\n", nil
+	}
+	capturePane = func(target string) (string, error) { return strings.Join(lines[history:], "\n") + "\n", nil }
+	defer func() {
+		panePosition, capturePaneRange, capturePane = oldPos, oldRange, oldCap
+		captureMarks = map[string]captureMark{}
+		delete(buffers, "%d")
+	}()
+
+	handleCommand("!observe -d %d %1")
+	if buffers["%d"] != "$ make\ncc a.c\n$ \n" {
+		t.Fatalf("first delta should capture the screen, got %q", buffers["%d"])
+	}
+	lines[2] = "$ ls"
+	lines = append(lines, "a.c", "b.c", "$ ")
+	history = 2
+	handleCommand("!observe -d %d %1")
+	if buffers["%d"] != "$ ls\na.c\nb.c\n$\n" {
+		t.Fatalf("unexpected delta: %q", buffers["%d"])
+	}
+	if got := replacePaneRefs("{%1:new}"); got != "\n```\n$\n```\n" {
+		t.Fatalf("unexpected prompt delta: %q", got)
+	}
+	// a plain {%1} leaves the mark for the next {%1:new} alone
+	lines[len(lines)-1] = "$ id"
+	lines = append(lines, "uid=0", "$ ")
+	if got := replacePaneRefs("{%1}"); !strings.Contains(got, "a.c\nb.c\n$ id\nuid=0") {
+		t.Fatalf("unexpected prompt capture: %q", got)
+	}
+	if got := replacePaneRefs("{%1:new}"); got != "\n```\n$ id\nuid=0\n$\n```\n" {
+		t.Fatalf("plain capture moved the mark: %q", got)
+	}
+	// a cleared pane no longer has the anchor line, so the screen is captured
+	lines = []string{"$ "}
+	history = 0
+	handleCommand("!observe -d %d %1")
+	if buffers["%d"] != "$ \n" {
+		t.Fatalf("expected full capture after clear, got %q", buffers["%d"])
+	}
+}
+
+func TestPasteToPane(t *testing.T) {
+	var calls []string
+	oldKeys, oldLiteral, oldPaste := sendKeys, sendLiteral, pasteText
+	sendKeys = func(target string, keys ...string) error {
+		calls = append(calls, "keys "+strings.Join(keys, " "))
+		return nil
+	}
+	sendLiteral = func(target, text string) error {
+		calls = append(calls, "literal "+text)
+		return nil
+	}
+	pasteText = func(target, data string) error {
+		calls = append(calls, "paste "+data)
+		return nil
+	}
+	oldMax := paneWriteMax
+	defer func() {
+		sendKeys, sendLiteral, pasteText, paneWriteMax = oldKeys, oldLiteral, oldPaste, oldMax
+		delete(buffers, "%py")
+	}()
+
+	writeBuffer("%3", "Enter\n")
+	buffers["%py"] = "def f():\n    return 1\n\n"
+	handleCommand("!paste %py %3")
+	handleCommand("!paste -n %py %3")
+	paneWriteMax = 4
+	handleCommand("!paste %py %3")
+	handleCommand("!paste -f -n %py %3")
+	want := []string{
+		"literal Enter", "keys Enter",
+		"paste def f():\n    return 1\n", "keys Enter",
+		"paste def f():\n    return 1\n",
+		"paste def f():\n    return 1\n",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Fatalf("unexpected pane writes:\n%q\nwant\n%q", calls, want)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var mu sync.Mutex
+	screens := map[string][]string{"%3": {"a$ "}, "%4": {"b$ "}}
+	oldPos, oldRange, oldCap := panePosition, capturePaneRange, capturePane
+	oldKeys, oldLiteral := sendKeys, sendLiteral
+	panePosition = func(target string) (int, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return 0, len(screens[target]) - 1, nil
+	}
+	capturePaneRange = func(target string, start, end int, escapes bool) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(screens[target][start:end+1], "\n") + "\n", nil
+	}
+	capturePane = func(target string) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(screens[target], "\n") + "\n", nil
+	}
+	sendLiteral = func(target, text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		s := screens[target]
+		prompt := s[len(s)-1]
+		s[len(s)-1] += text
+		screens[target] = append(s, "uid=0("+target+")", prompt)
+		return nil
+	}
+	sendKeys = func(target string, keys ...string) error { return nil }
+	oldSettle, oldPoll := broadcastSettle, broadcastPoll
+	broadcastSettle, broadcastPoll = 20*time.Millisecond, time.Millisecond
+	defer func() {
+		panePosition, capturePaneRange, capturePane = oldPos, oldRange, oldCap
+		sendKeys, sendLiteral = oldKeys, oldLiteral
+		broadcastSettle, broadcastPoll = oldSettle, oldPoll
+		captureMarks = map[string]captureMark{}
+		paneGroups = map[string][]string{}
+		delete(buffers, "%lat_3")
+		delete(buffers, "%lat_4")
+	}()
+
+	handleCommand("!group add lat %3 %4 %3")
+	if fmt.Sprint(paneGroups["lat"]) != "[%3 %4]" {
+		t.Fatalf("unexpected group: %v", paneGroups["lat"])
+	}
+	handleCommand("!broadcast lat id")
+	if buffers["%lat_3"] != "a$ id\nuid=0(%3)\na$\n" || buffers["%lat_4"] != "b$ id\nuid=0(%4)\nb$\n" {
+		t.Fatalf("unexpected output: %q %q", buffers["%lat_3"], buffers["%lat_4"])
+	}
+	handleCommand("!group rm lat %3")
+	if fmt.Sprint(paneGroups["lat"]) != "[%4]" {
+		t.Fatalf("unexpected group after rm: %v", paneGroups["lat"])
+	}
+	// panes are resolved like for add, unknown ones are reported and skipped
+	buffers["%who"] = "%4"
+	defer delete(buffers, "%who")
+	handleCommand("!group rm lat %9 %who")
+	if _, ok := paneGroups["lat"]; ok {
+		t.Fatalf("pane from buffer not removed: %v", paneGroups["lat"])
+	}
+}
+
+func TestOpenFIFOWriter(t *testing.T) {
+	dir, fifo, err := makeFIFO("grimux-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	old := fifoOpenTimeout
+	fifoOpenTimeout = 100 * time.Millisecond
+	defer func() { fifoOpenTimeout = old }()
+
+	// the pane died before cat opened the pipe
+	if _, err := openFIFOWriter(fifo); err == nil {
+		t.Fatal("opened a FIFO nobody reads")
+	}
+	got := make(chan string)
+	go func() {
+		r, err := os.Open(fifo)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer r.Close()
+		b, _ := io.ReadAll(r)
+		got <- string(b)
+	}()
+	fifoOpenTimeout = 2 * time.Second
+	w, err := openFIFOWriter(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("cast"))
+	w.Close()
+	if s := <-got; s != "cast" {
+		t.Fatalf("reader got %q", s)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	var w *os.File
+	opened := make(chan struct{})
+	oldPipe, oldANSI, oldList := pipePane, capturePaneANSI, listPanes
+	pipePane = func(target, command string) error {
+		if command == "" {
+			w.Close()
+			return nil
+		}
+		fifo := strings.Trim(strings.TrimPrefix(command, "exec cat > "), "'")
+		go func() {
+			w, _ = os.OpenFile(fifo, os.O_WRONLY, 0)
+			close(opened)
+		}()
+		return nil
+	}
+	capturePaneANSI = func(target string) (string, error) { return "$ \n\n", nil }
+	listPanes = func() ([]tmux.PaneInfo, error) { return []tmux.PaneInfo{{ID: "%4", Width: 100, Height: 30}}, nil }
+	defer func() {
+		pipePane, capturePaneANSI, listPanes = oldPipe, oldANSI, oldList
+		delete(buffers, "%rec")
+	}()
+
+	file := filepath.Join(t.TempDir(), "shell.cast")
+	handleCommand("!record %4 " + file)
+	<-opened
+	w.Write([]byte("id\r\n\x1b[1muid=0\x1b[0m \xc3"))
+	w.Write([]byte("\xa9\r\n$ "))
+	handleCommand("!record stop %4")
+	if len(recordingPanes()) != 0 {
+		t.Fatalf("recording still active")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, events, err := readCast(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("readCast: %v", err)
+	}
+	if hdr.Width != 100 || hdr.Height != 30 || len(events) < 2 || events[0].Data != "\x1b[2J\x1b[H$ " {
+		t.Fatalf("unexpected recording: %+v %+v", hdr, events)
+	}
+	handleCommand("!replay " + file + " %rec")
+	if buffers["%rec"] != "$ id\nuid=0 é\n$ " {
+		t.Fatalf("unexpected replay text: %q", buffers["%rec"])
+	}
+
+	// a pane that cannot be piped leaves no empty recording behind
+	pipePane = func(target, command string) error { return errors.New("no such pane") }
+	failed := filepath.Join(t.TempDir(), "gone.cast")
+	if err := startRecording("%9", failed); err == nil {
+		t.Fatal("expected pipe error")
+	}
+	if _, err := os.Stat(failed); !os.IsNotExist(err) {
+		t.Fatalf("recording file left behind: %v", err)
+	}
+}
+
+func TestShotFromBuffer(t *testing.T) {
+	buffers["%scan"] = "22/tcp \x1b[32mopen\x1b[0m ssh\nkey: secret\n"
+	defer delete(buffers, "%scan")
+	file := filepath.Join(t.TempDir(), "scan.svg")
+	handleCommand("!shot -r ^key %scan " + file)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("no image written: %v", err)
+	}
+	if !strings.Contains(string(data), `fill="#0dbc79"`) || strings.Contains(string(data), "secret") {
+		t.Fatalf("unexpected svg:\n%s", data)
+	}
+}
+
+func TestRemotePaneRefs(t *testing.T) {
+	// removing the remote closes its ssh connection, keep that local
+	bin := t.TempDir()
+	os.WriteFile(filepath.Join(bin, "ssh"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	var captured []string
+	oldCap, oldPos := capturePane, panePosition
+	capturePane = func(target string) (string, error) {
+		captured = append(captured, target)
+		return "remote screen", nil
+	}
+	panePosition = func(target string) (int, int, error) { return 0, 0, errors.New("no position") }
+	defer func() {
+		capturePane, panePosition = oldCap, oldPos
+		tmux.RemoveRemote("jump")
+		delete(buffers, "%r")
+	}()
+
+	handleCommand("!remote add jump op@10.0.0.5 /tmp/ops.sock")
+	if rs := tmux.Remotes(); len(rs) != 1 || rs[0].Host != "op@10.0.0.5" || rs[0].Socket != "/tmp/ops.sock" {
+		t.Fatalf("unexpected remotes: %+v", rs)
+	}
+	if validateBufferName("%jump:%3") == nil {
+		t.Fatalf("remote pane accepted as buffer name")
+	}
+	handleCommand("!observe %r %jump:%3")
+	if buffers["%r"] != "remote screen" {
+		t.Fatalf("unexpected capture: %q", buffers["%r"])
+	}
+	if got := replacePaneRefs("see {%jump:%3}"); !strings.Contains(got, "remote screen") {
+		t.Fatalf("prompt reference not expanded: %q", got)
+	}
+	if fmt.Sprint(captured) != "[%jump:%3 %jump:%3]" {
+		t.Fatalf("unexpected capture targets: %v", captured)
+	}
+}
+
+// useFakeMux points grimux at an in-memory multiplexer for the test.
+func useFakeMux(t *testing.T) *mux.Fake {
+	t.Helper()
+	f := mux.NewFake()
+	old := mx
+	mx = f
+	t.Cleanup(func() { mx = old })
+	return f
+}
+
+func TestFakeMultiplexer(t *testing.T) {
+	f := useFakeMux(t)
+	f.SetBuffer("foo", "hello")
+	p := f.AddPane("%5", "$ ")
+	p.Respond = func(p *mux.FakePane, in string) {
+		if in == "\n" {
+			p.Screen[len(p.Screen)-1] += "echo hi"
+			p.Print("hi", "$ ")
+		}
+	}
+	defer delete(buffers, "%out")
+
+	if out, ok := readBuffer("%foo"); !ok || out != "hello" {
+		t.Fatalf("unexpected buffer %q %v", out, ok)
+	}
+	writeBuffer("%foo", "bye")
+	if out, _ := f.ShowBuffer("foo"); out != "bye" {
+		t.Fatalf("buffer not written: %q", out)
+	}
+	writeBuffer("%5", "echo hi\n")
+	if typed := f.Typed("%5"); typed != "echo hi\n" {
+		t.Fatalf("unexpected input %q", typed)
+	}
+	handleCommand("!eat %out %5")
+	if buffers["%out"] != "$ echo hi\nhi\n$ \n" {
+		t.Fatalf("unexpected capture %q", buffers["%out"])
+	}
+	var found bool
+	for _, b := range collectBuffers() {
+		found = found || (b.Name == "%foo" && b.Tmux)
+	}
+	if !found {
+		t.Fatalf("%%foo missing from buffer list")
+	}
+	if _, ok := readBuffer("%7"); ok {
+		t.Fatal("missing pane should not read")
+	}
+}
+
+func TestViewer(t *testing.T) {
+	colored := "\x1b[31mred\x1b[0m\n"
+	for _, tc := range []struct{ env, name, args, data string }{
+		{"", "batcat", "-l markdown --paging=always", "# x\n"},
+		{"/usr/bin/less", "/usr/bin/less", "-R", colored},
+		{"bat", "bat", "--color=always --paging=always", colored},
+		{"glow", "glow", "-l markdown", "red\n"},
+	} {
+		t.Setenv("VIEWER", tc.env)
+		in := colored
+		if tc.env == "" {
+			in = "# x\n"
+		}
+		name, args, data := viewer(in)
+		if name != tc.name || strings.Join(args, " ") != tc.args || data != tc.data {
+			t.Fatalf("VIEWER=%q: got %q %q %q", tc.env, name, args, data)
+		}
+	}
+}
+
+func TestViewInPopup(t *testing.T) {
+	t.Setenv("TMUX", "/tmp/grimux-test.sock,1,0")
+	t.Setenv("TMUX_PANE", "%2")
+	t.Setenv("VIEWER", "bat")
+	oldPopup, oldVersion, oldUses := displayPopup, tmuxVersion, popupUses
+	var got tmux.PopupOptions
+	var shown string
+	displayPopup = func(opts tmux.PopupOptions) error {
+		got = opts
+		f := strings.Fields(opts.Command)
+		b, _ := os.ReadFile(strings.Trim(f[len(f)-1], "'"))
+		shown = string(b)
+		return nil
+	}
+	major, calls := 3, 0
+	tmuxVersion = func() (int, int, error) { calls++; return major, 1, nil }
+	popupOnce = sync.Once{}
+	defer func() {
+		popupOnce = sync.Once{}
+		displayPopup, tmuxVersion, popupUses = oldPopup, oldVersion, oldUses
+		delete(buffers, "%notes")
+	}()
+
+	handleCommand("!popup view answer")
+	if !popupUses["view"] || !popupUses["answer"] || popupUses["edit"] {
+		t.Fatalf("unexpected popup uses %v", popupUses)
+	}
+	if usePopup("view") || usePopup("answer") || calls != 1 {
+		t.Fatalf("tmux 3.1 has no popups, version asked %d times", calls)
+	}
+	major = 4
+	popupOnce = sync.Once{}
+	buffers["%notes"] = "# loot\n"
+	handleCommand("!view %notes")
+	if got.Target != "%2" || got.Title != "%notes" || !strings.HasPrefix(got.Command, "'bat' '-l' 'markdown' '--paging=always' ") {
+		t.Fatalf("unexpected popup %+v", got)
+	}
+	if shown != "# loot\n" || buffers["%viewer"] != "# loot\n" {
+		t.Fatalf("popup showed %q", shown)
+	}
+	if err := setPopupUses("view,bogus"); err == nil {
+		t.Fatal("expected error for unknown popup use")
+	}
+	handleCommand("!popup off")
+	if usePopup("view") {
+		t.Fatal("popups should be off")
+	}
+}
+
+func TestStatusFile(t *testing.T) {
+	oldDir, oldName, oldCtx := statusDir, sessionName, chatCtx
+	statusDir = t.TempDir()
+	defer func() { statusDir, sessionName, chatCtx = oldDir, oldName, oldCtx }()
+	t.Setenv("TMUX", "")
+
+	if _, err := ReadStatus(""); err == nil {
+		t.Fatal("expected no running grimux")
+	}
+	sessionName = "ops"
+	chatCtx = nil
+	appendChatHistory("hi", "hello")
+	appendChatHistory("again", "sure")
+	writeStatus()
+	// a file left behind by an instance that is gone
+	os.WriteFile(filepath.Join(statusDir, "999999999.json"), []byte(`{"pid":999999999,"updated":"2999-01-01T00:00:00Z"}`), 0600)
+
+	st, err := ReadStatus("")
+	if err != nil {
+		t.Fatalf("ReadStatus: %v", err)
+	}
+	if st.PID != os.Getpid() || st.Session != "ops" || st.Turns != 2 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if !strings.HasPrefix(st.Line(), "grimux ops · ") || !strings.HasSuffix(st.Line(), "2 turns") {
+		t.Fatalf("unexpected line %q", st.Line())
+	}
+	if _, err := os.Stat(filepath.Join(statusDir, "999999999.json")); err == nil {
+		t.Fatal("stale status file was not removed")
+	}
+	if _, err := ReadStatus("%9"); err == nil {
+		t.Fatal("expected no grimux in %9")
+	}
+	removeStatus()
+	if _, err := ReadStatus(""); err == nil {
+		t.Fatal("status should be gone")
+	}
+}
+
+func TestOnTriggers(t *testing.T) {
+	f := useFakeMux(t)
+	p := f.AddPane("%5", "$ nc -lvp 4444")
+	p.Info.Label = "web"
+	oldInterval, oldCooldown := watchInterval, triggerCooldown
+	watchInterval = 10 * time.Millisecond
+	defer func() {
+		stopAllTriggers()
+		watchInterval, triggerCooldown = oldInterval, oldCooldown
+		delete(buffers, "%loot")
+	}()
+	waitFire := func() bool {
+		deadline := time.Now().Add(2 * time.Second)
+		for len(triggerCh) == 0 {
+			if time.Now().After(deadline) {
+				return false
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return true
+	}
+
+	handleCommand(`!on %pane:web /got  flag\{(\w+)\} !/ !set %loot %match1`)
+	handleCommand("!on %5 nothing")
+	if rules := triggerRules(); len(rules) != 1 || rules[0].Pane != "%pane:web" || rules[0].Pattern != `got  flag\{(\w+)\} !` || rules[0].Command != "!set %loot %match1" {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	// give the follower its first snapshot before printing
+	time.Sleep(30 * time.Millisecond)
+	f.Update(func() { p.Print("got  flag{s3cr3t} !", "$ ") })
+	if !waitFire() {
+		t.Fatal("rule did not fire")
+	}
+	runTriggers()
+	if buffers["%loot"] != "s3cr3t" || buffers["%match1"] != "s3cr3t" {
+		t.Fatalf("unexpected loot %q", buffers["%loot"])
+	}
+
+	// a second match inside the cooldown is dropped
+	f.Update(func() { p.Print("got  flag{again} !", "$ ") })
+	time.Sleep(50 * time.Millisecond)
+	if len(triggerCh) != 0 {
+		t.Fatal("rule fired during cooldown")
+	}
+
+	var s session
+	json.Unmarshal([]byte(buffers["%session"]), &s)
+	if len(s.Triggers) != 1 || s.Triggers[0].ID != 1 {
+		t.Fatalf("rules not in session: %+v", s.Triggers)
+	}
+	handleCommand("!on rm 1")
+	if len(triggerRules()) != 0 {
+		t.Fatal("rule not removed")
+	}
+	loadSessionFromBuffer()
+	if len(triggerRules()) != 0 {
+		t.Fatal("session buffer brought the rule back")
+	}
+	// the label follows the pane to a new id in a later run
+	q := f.AddPane("%8")
+	f.Update(func() { p.Info.Label, q.Info.Label = "", "web" })
+	restoreTriggers(s.Triggers)
+	triggerMu.Lock()
+	id := triggers[0].id
+	triggerMu.Unlock()
+	if rules := triggerRules(); len(rules) != 1 || rules[0].Pane != "%pane:web" || id != "%8" {
+		t.Fatalf("rules not restored: %+v on %s", rules, id)
+	}
+}
+
+func TestExplainWatch(t *testing.T) {
+	for line, want := range map[string]bool{
+		"exploit.c:12:5: error: 'buf' undeclared":       true,
+		"main.go:7:2: undefined: foo":                   true,
+		"error[E0425]: cannot find value `x`":           true,
+		"Traceback (most recent call last):":            true,
+		"panic: runtime error: index out of range":      true,
+		"Segmentation fault (core dumped)":              true,
+		"make: *** [Makefile:3: all] Error 1":           true,
+		"exit status 2":                                 true,
+		"exit status 0":                                 false,
+		"compiled exploit.c without errors":             false,
+		"/usr/bin/ld: undefined reference to `pthread'": true,
+	} {
+		if _, got := detectError([]string{line}); got != want {
+			t.Errorf("detectError(%q) = %v", line, got)
+		}
+	}
+
+	f := useFakeMux(t)
+	p := f.AddPane("%6", "$ python3 sploit.py")
+	oldInterval := watchInterval
+	watchInterval = 10 * time.Millisecond
+	defer func() {
+		stopExplain("")
+		watchInterval = oldInterval
+		for len(explainNotices) > 0 {
+			<-explainNotices
+		}
+	}()
+
+	handleCommand("!explain on %6")
+	if jobs := backgroundJobs(); len(jobs) != 1 || jobs[0] != "explain %6" {
+		t.Fatalf("unexpected jobs %v", jobs)
+	}
+	time.Sleep(30 * time.Millisecond)
+	f.Update(func() {
+		p.Print("Traceback (most recent call last):", "  File \"sploit.py\", line 3", "NameError: name 'p' is not defined", "$ ")
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for len(explainNotices) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("error not detected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	e := <-explainNotices
+	if e.pane != "%6" || e.line != "Traceback (most recent call last):" {
+		t.Fatalf("unexpected error %+v", e)
+	}
+	out, err := recentOutput("%6")
+	if err != nil || !strings.Contains(explainPrompt(out, e.line), "NameError: name 'p'") {
+		t.Fatalf("prompt misses the output: %q %v", out, err)
+	}
+
+	// more errors right after the first are remembered but not announced
+	f.Update(func() { p.Print("Segmentation fault", "$ ") })
+	time.Sleep(50 * time.Millisecond)
+	if len(explainNotices) != 0 {
+		t.Fatal("error announced during cooldown")
+	}
+	explainMu.Lock()
+	last := lastError.line
+	explainMu.Unlock()
+	if last != "Segmentation fault" {
+		t.Fatalf("last error %q", last)
+	}
+
+	// exit codes come from tmux for dead panes and from !run_on markers
+	explainCooldown = 0
+	defer func() { explainCooldown = 10 * time.Second }()
+	noteExitStatus("%6", "3")
+	if e := <-explainNotices; e.line != "exit status 3" {
+		t.Fatalf("unexpected run_on error %+v", e)
+	}
+	checkErrors("%6", []string{"$ make", "__GRIMUX_EXIT_2__"})
+	if e := <-explainNotices; e.line != "exit status 2" {
+		t.Fatalf("prompt hook marker missed: %+v", e)
+	}
+	handleCommand("!explain off %6")
+	if len(backgroundJobs()) != 0 {
+		t.Fatal("watch not stopped")
+	}
+	noteExitStatus("%6", "3")
+	if len(explainNotices) != 0 {
+		t.Fatal("exit status of an unwatched pane reported")
+	}
+
+	var mu sync.Mutex
+	dead := false
+	oldDead := paneDeadStatus
+	paneDeadStatus = func(target string) (bool, int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return dead, 139, nil
+	}
+	defer func() { paneDeadStatus = oldDead }()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchExit("%6", stop)
+		close(done)
+	}()
+	mu.Lock()
+	dead = true
+	mu.Unlock()
+	select {
+	case e := <-explainNotices:
+		if e.line != "exit status 139" {
+			t.Fatalf("unexpected exit error %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead pane not reported")
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	<-done
+	if len(explainNotices) != 0 {
+		t.Fatal("dead pane reported twice")
+	}
+}
@@ -0,0 +1,103 @@
+package repl
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var sendKeys = func(target string, keys ...string) error { return mx.SendKeys(target, keys...) }
+var capturePaneFull = func(target string) (string, error) { return mx.CapturePaneFull(target) }
+
+// runOnTimeout bounds how long !run_on waits for the end marker.
+var runOnTimeout = 30 * time.Second
+
+// runOnPoll is the delay between captures while waiting.
+var runOnPoll = 100 * time.Millisecond
+
+// runOnMarkers wraps cmd with start and end sentinels. The markers are
+// split by empty quotes so the echoed command line never matches them. cmd
+// goes in a group on a line of its own, so a trailing & or comment stays
+// part of it. This needs a POSIX shell.
+func runOnMarkers(cmd string) (wrapped, start string, end *regexp.Regexp) {
+	id := fmt.Sprintf("%08x", rand.Uint32())
+	start = "__GRIMUX_START_" + id + "__"
+	wrapped = fmt.Sprintf("echo __GRIMUX_S''TART_%s__; {\n%s\n}; printf '\\n__GRIMUX_E''ND_%s_%%s__\\n' \"$?\"", id, cmd, id)
+	end = regexp.MustCompile(`(?m)^__GRIMUX_END_` + id + `_(\d+)__$`)
+	return wrapped, start, end
+}
+
+// extractRunOutput returns the text between the markers in capture and the
+// exit code. done is false while the end marker has not appeared yet.
+func extractRunOutput(capture, start string, end *regexp.Regexp) (out, code string, done bool) {
+	i := strings.LastIndex(capture, start+"\n")
+	if i < 0 {
+		return "", "", false
+	}
+	body := capture[i+len(start)+1:]
+	m := end.FindStringSubmatchIndex(body)
+	if m == nil {
+		return body, "", false
+	}
+	// drop the newline printf puts in front of the end marker
+	return strings.TrimSuffix(body[:m[0]], "\n"), body[m[2]:m[3]], true
+}
+
+// runOn types cmd into pane and waits until it finishes. The output between
+// the markers is returned with the exit status, or "timeout" when the end
+// marker did not show up within runOnTimeout. It fails when not even the
+// start marker showed up.
+func runOn(pane, cmd string) (string, string, error) {
+	wrapped, start, end := runOnMarkers(cmd)
+	if err := sendKeys(pane, wrapped, "Enter"); err != nil {
+		return "", "", err
+	}
+	deadline := time.Now().Add(runOnTimeout)
+	var out string
+	for {
+		capture, err := capturePaneFull(pane)
+		if err != nil {
+			return "", "", err
+		}
+		var code string
+		var done bool
+		out, code, done = extractRunOutput(capture, start, end)
+		if done {
+			return out, code, nil
+		}
+		if time.Now().After(deadline) {
+			if !strings.Contains(capture, start+"\n") {
+				return "", "", fmt.Errorf("%s never echoed the start marker, it needs a POSIX shell such as sh, bash or zsh", pane)
+			}
+			return out, "timeout", nil
+		}
+		time.Sleep(runOnPoll)
+	}
+}
+
+// runOnCommand implements !run_on <buffer> <pane> <cmd>.
+func runOnCommand(buf, ref, cmd string) {
+	pane, err := paneArg(ref)
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	stop := spinner()
+	out, code, err := runOn(pane, cmd)
+	stop()
+	if err != nil {
+		cmdPrintln("run_on error: " + err.Error())
+		return
+	}
+	writeBuffer(buf, out)
+	buffers["%run_on_status"] = code
+	if code == "timeout" {
+		warnPrintln(fmt.Sprintf("run_on: no end marker after %s, partial output stored", runOnTimeout))
+	} else if code != "0" {
+		warnPrintln("run_on: exit status " + code)
+		noteExitStatus(pane, code)
+		announceErrors()
+	}
+}
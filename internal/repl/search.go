@@ -0,0 +1,146 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/glo0ml34f/grimux/internal/index"
+)
+
+// noteIndex is the offline BM25 index, loaded on first use.
+var noteIndex *index.Index
+var indexPath = index.DefaultPath()
+
+// indexTopK is how many passages are attached to plain prompts. Zero
+// disables automatic attachment.
+var indexTopK int
+
+func getIndex() (*index.Index, error) {
+	if noteIndex != nil {
+		return noteIndex, nil
+	}
+	idx, err := index.Load(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	noteIndex = idx
+	return noteIndex, nil
+}
+
+// snippet shortens passage text for listings without splitting a
+// character.
+func snippet(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) > max {
+		cut := text[:max]
+		return cut[:utf8Prefix([]byte(cut))] + "..."
+	}
+	return text
+}
+
+// withIndexContext prepends the best matching passages for query to prompt
+// when automatic attachment is enabled.
+func withIndexContext(prompt, query string) string {
+	if indexTopK <= 0 {
+		return prompt
+	}
+	idx, err := getIndex()
+	if err != nil {
+		warnPrintln("index error: " + err.Error())
+		return prompt
+	}
+	results := idx.Search(query, indexTopK)
+	if len(results) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("Sources (cite as [n] when used):\n")
+	for i, r := range results {
+		fmt.Fprintf(&b, "[%d] %s:%d\n```\n%s\n```\n", i+1, r.Passage.Path, r.Passage.Line, r.Passage.Text)
+	}
+	b.WriteString("---\n")
+	return b.String() + prompt
+}
+
+// indexCommand implements !index add|rm|ls|query|auto.
+func indexCommand(args []string) {
+	if len(args) == 0 {
+		cmdPrintln("usage: " + commands["!index"].Usage)
+		return
+	}
+	idx, err := getIndex()
+	if err != nil {
+		cmdPrintln("index error: " + err.Error())
+		return
+	}
+	switch args[0] {
+	case "add":
+		if len(args) < 2 {
+			cmdPrintln("usage: !index add <dir>")
+			return
+		}
+		for _, dir := range args[1:] {
+			n, err := idx.AddDir(dir)
+			if err != nil {
+				cmdPrintln("index error: " + err.Error())
+				return
+			}
+			cmdPrintln(fmt.Sprintf("indexed %d file(s) from %s", n, dir))
+		}
+		if err := idx.Save(indexPath); err != nil {
+			cmdPrintln("index save error: " + err.Error())
+		}
+	case "rm":
+		if len(args) < 2 {
+			cmdPrintln("usage: !index rm <dir>")
+			return
+		}
+		if !idx.RemoveDir(args[1]) {
+			cmdPrintln("directory not indexed")
+			return
+		}
+		if err := idx.Save(indexPath); err != nil {
+			cmdPrintln("index save error: " + err.Error())
+		}
+	case "ls":
+		for _, d := range idx.Dirs {
+			cmdPrintln(d)
+		}
+		cmdPrintln(fmt.Sprintf("%d passage(s), auto attach %d", len(idx.Passages), indexTopK))
+	case "query":
+		if len(args) < 2 {
+			cmdPrintln("usage: !index query <terms>")
+			return
+		}
+		results := idx.Search(strings.Join(args[1:], " "), 5)
+		if len(results) == 0 {
+			cmdPrintln("no matches")
+			return
+		}
+		var full strings.Builder
+		for i, r := range results {
+			cmdPrintln(colorize(bufferColor, fmt.Sprintf("[%d] %s:%d (%.2f)", i+1, r.Passage.Path, r.Passage.Line, r.Score)))
+			cmdPrintln("    " + snippet(r.Passage.Text, 160))
+			fmt.Fprintf(&full, "[%d] %s:%d\n%s\n\n", i+1, r.Passage.Path, r.Passage.Line, r.Passage.Text)
+		}
+		buffers["%index"] = full.String()
+	case "auto":
+		if len(args) < 2 {
+			cmdPrintln(fmt.Sprintf("auto attach %d", indexTopK))
+			return
+		}
+		if args[1] == "off" {
+			indexTopK = 0
+			return
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			cmdPrintln("usage: !index auto <k|off>")
+			return
+		}
+		indexTopK = n
+	default:
+		cmdPrintln("unknown subcommand")
+	}
+}
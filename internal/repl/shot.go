@@ -0,0 +1,77 @@
+package repl
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/glo0ml34f/grimux/internal/shot"
+)
+
+// shotCommand implements !shot [-r regex] <pane|buffer> <file.svg|file.png>.
+// Panes are captured with colors; lines matching the regex are blacked out
+// before rendering.
+func shotCommand(args []string) {
+	var redact *regexp.Regexp
+	if len(args) > 1 && args[0] == "-r" {
+		re, err := regexp.Compile(args[1])
+		if err != nil {
+			cmdPrintln("regex error: " + err.Error())
+			return
+		}
+		redact = re
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!shot"].Usage)
+		return
+	}
+	src, file := args[0], args[1]
+	ext := strings.ToLower(filepath.Ext(file))
+	if ext != ".svg" && ext != ".png" {
+		cmdPrintln("file must end in .svg or .png")
+		return
+	}
+	var data string
+	if isPaneRef(src) {
+		id, err := resolvePane(src)
+		if err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		if data, err = capturePaneANSI(id); err != nil {
+			cmdPrintln("capture error: " + err.Error())
+			return
+		}
+	} else {
+		val, ok := readBuffer(src)
+		if !ok {
+			cmdPrintln("unknown buffer")
+			return
+		}
+		data = val
+	}
+	scr := shot.Parse(data)
+	scr.Title = src
+	if redact != nil {
+		if n := scr.Redact(redact); n > 0 {
+			warnPrintln(fmt.Sprintf("redacted %d line(s)", n))
+		}
+	}
+	var buf bytes.Buffer
+	render := shot.SVG
+	if ext == ".png" {
+		render = shot.PNG
+	}
+	if err := render(scr, &buf); err != nil {
+		cmdPrintln("render error: " + err.Error())
+		return
+	}
+	if err := writePath(file, buf.Bytes()); err != nil {
+		cmdPrintln("save error: " + err.Error())
+		return
+	}
+	successPrintln(fmt.Sprintf("saved %s (%d lines)", file, len(scr.Lines)))
+}
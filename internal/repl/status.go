@@ -0,0 +1,161 @@
+package repl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/glo0ml34f/grimux/internal/openai"
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+// Status is what a running grimux publishes for "grimux status", which
+// tmux status lines call through #(...).
+type Status struct {
+	PID     int       `json:"pid"`
+	Pane    string    `json:"pane,omitempty"`
+	Session string    `json:"session,omitempty"`
+	Model   string    `json:"model,omitempty"`
+	Turns   int       `json:"turns"`
+	Jobs    []string  `json:"jobs,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// statusDir holds one state file per running instance.
+var statusDir = filepath.Join(os.TempDir(), fmt.Sprintf("grimux-%d", os.Getuid()))
+
+func statusFile(pid int) string {
+	return filepath.Join(statusDir, fmt.Sprintf("%d.json", pid))
+}
+
+// chatTurns counts the exchanges in the chat context.
+func chatTurns() int {
+	if len(chatCtx) == 0 {
+		return 0
+	}
+	n := strings.Count(string(chatCtx), "\nUser: ")
+	if strings.HasPrefix(string(chatCtx), "User: ") {
+		n++
+	}
+	return n
+}
+
+// backgroundJobs names the watches, recordings and error watchers that are
+// running.
+func backgroundJobs() []string {
+	var jobs []string
+	watchMu.Lock()
+	for buf, w := range watches {
+		jobs = append(jobs, "watch "+w.pane+">"+buf)
+	}
+	watchMu.Unlock()
+	recordMu.Lock()
+	for pane := range recordings {
+		jobs = append(jobs, "record "+pane)
+	}
+	recordMu.Unlock()
+	explainMu.Lock()
+	for _, w := range explainWatches {
+		jobs = append(jobs, "explain "+w.pane)
+	}
+	explainMu.Unlock()
+	sort.Strings(jobs)
+	return jobs
+}
+
+// writeStatus publishes the current state. Errors are ignored since the
+// status line is a convenience.
+func writeStatus() {
+	st := Status{
+		PID:     os.Getpid(),
+		Pane:    tmux.CurrentPane(),
+		Session: sessionName,
+		Model:   openai.GetModelName(),
+		Turns:   chatTurns(),
+		Jobs:    backgroundJobs(),
+		Updated: time.Now(),
+	}
+	b, err := json.Marshal(st)
+	if err != nil || os.MkdirAll(statusDir, 0700) != nil {
+		return
+	}
+	// write and rename so readers never see half a file
+	name := statusFile(st.PID)
+	if os.WriteFile(name+".tmp", b, 0600) == nil {
+		os.Rename(name+".tmp", name)
+	}
+}
+
+func removeStatus() {
+	os.Remove(statusFile(os.Getpid()))
+}
+
+// alive reports whether a process exists.
+func alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// ReadStatus returns the state of the grimux running in pane, or of the
+// most recently active instance when pane is empty. Files left behind by
+// instances that are gone are removed.
+func ReadStatus(pane string) (*Status, error) {
+	files, _ := filepath.Glob(filepath.Join(statusDir, "*.json"))
+	var best *Status
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		var st Status
+		if json.Unmarshal(b, &st) != nil {
+			continue
+		}
+		if !alive(st.PID) {
+			os.Remove(f)
+			continue
+		}
+		if pane != "" && st.Pane != pane {
+			continue
+		}
+		if best == nil || st.Updated.After(best.Updated) {
+			best = &st
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no running grimux")
+	}
+	return best, nil
+}
+
+// Line formats the state for a status line, e.g.
+// "grimux ops · gpt-4o · 3 turns · 2 jobs".
+func (s *Status) Line() string {
+	parts := []string{"grimux"}
+	if s.Session != "" {
+		parts[0] += " " + s.Session
+	}
+	if s.Model != "" {
+		parts = append(parts, s.Model)
+	}
+	if s.Turns > 0 {
+		parts = append(parts, plural(s.Turns, "turn"))
+	}
+	if len(s.Jobs) > 0 {
+		parts = append(parts, plural(len(s.Jobs), "job"))
+	}
+	return strings.Join(parts, " · ")
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return "1 " + word
+	}
+	return fmt.Sprintf("%d %ss", n, word)
+}
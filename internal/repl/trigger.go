@@ -0,0 +1,331 @@
+package repl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// triggerRule is an !on rule as stored in the session. Pane is kept as
+// typed so %pane:<label> rules survive pane ids changing between runs.
+type triggerRule struct {
+	ID      int    `json:"id"`
+	Pane    string `json:"pane"`
+	Pattern string `json:"pattern"`
+	Command string `json:"command"`
+}
+
+type trigger struct {
+	triggerRule
+	re    *regexp.Regexp
+	id    string // resolved pane id
+	last  time.Time
+	fired int
+}
+
+// triggerFire is a match waiting to run its command on the main goroutine.
+type triggerFire struct {
+	t    *trigger
+	line string
+	loc  []int
+}
+
+// paneFollower feeds new output of one pane to the triggers on it.
+type paneFollower struct {
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+var triggerMu sync.Mutex
+var triggers []*trigger
+var followers = map[string]*paneFollower{}
+var nextTriggerID = 1
+
+// triggerCooldown is the minimum time between two firings of a rule so a
+// noisy pane cannot flood the REPL.
+var triggerCooldown = 10 * time.Second
+
+// triggerCh queues fired rules. When it is full further matches are
+// dropped.
+var triggerCh = make(chan triggerFire, 64)
+
+// matchTriggers checks new lines of pane against its rules.
+func matchTriggers(pane string, lines []string) {
+	triggerMu.Lock()
+	now := time.Now()
+	queued := false
+	for _, t := range triggers {
+		if t.id != pane || now.Sub(t.last) < triggerCooldown {
+			continue
+		}
+		for _, l := range lines {
+			loc := t.re.FindStringSubmatchIndex(l)
+			if loc == nil {
+				continue
+			}
+			select {
+			case triggerCh <- triggerFire{t: t, line: l, loc: loc}:
+				t.last = now
+				t.fired++
+				queued = true
+			default:
+			}
+			break
+		}
+	}
+	triggerMu.Unlock()
+	if queued {
+		wakePrompt()
+	}
+}
+
+// runTriggers runs the commands of fired rules. Only call it from the
+// goroutine that owns the REPL state.
+func runTriggers() {
+	for {
+		select {
+		case f := <-triggerCh:
+			storeMatch(f.t.re, f.line, f.loc)
+			cprintln(fmt.Sprintf("on %s #%d: %s", f.t.Pane, f.t.ID, f.line))
+			handleCommand(f.t.Command)
+		default:
+			return
+		}
+	}
+}
+
+// wakeTriggers asks the follower of pane to look for output right away.
+func wakeTriggers(pane string) {
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	if f := followers[pane]; f != nil {
+		select {
+		case f.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// follow starts a follower for pane unless one runs. Call with triggerMu
+// held.
+func follow(pane string) {
+	if followers[pane] != nil {
+		return
+	}
+	f := &paneFollower{wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	followers[pane] = f
+	go func() {
+		defer close(f.done)
+		err := followPane(pane, f.wake, f.stop, func(lines []string) { matchTriggers(pane, lines) })
+		if err != nil {
+			select {
+			case pluginMsgCh <- pluginMsg{name: "on", text: fmt.Sprintf("stopped following %s: %v", pane, err)}:
+			default:
+			}
+		}
+	}()
+}
+
+// unfollowIdle stops followers of panes without rules. Call with triggerMu
+// held.
+func unfollowIdle() {
+	used := map[string]bool{}
+	for _, t := range triggers {
+		used[t.id] = true
+	}
+	for pane, f := range followers {
+		if !used[pane] {
+			close(f.stop)
+			delete(followers, pane)
+		}
+	}
+}
+
+// addTrigger compiles and registers a rule. A zero ID gets the next one.
+func addTrigger(r triggerRule) (*trigger, error) {
+	if !strings.HasPrefix(r.Command, "!") {
+		return nil, fmt.Errorf("command must be a ! command")
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regex error: %w", err)
+	}
+	id, err := resolvePane(r.Pane)
+	if err != nil {
+		return nil, err
+	}
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	if r.ID == 0 {
+		r.ID = nextTriggerID
+	}
+	nextTriggerID = max(nextTriggerID, r.ID+1)
+	t := &trigger{triggerRule: r, re: re, id: id}
+	triggers = append(triggers, t)
+	follow(id)
+	return t, nil
+}
+
+// removeTriggers drops the rule with the given id, or all rules when id is
+// zero. It returns the number removed.
+func removeTriggers(id int) int {
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	kept := triggers[:0]
+	n := 0
+	for _, t := range triggers {
+		if id == 0 || t.ID == id {
+			n++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	triggers = kept
+	if len(triggers) == 0 {
+		nextTriggerID = 1
+	}
+	unfollowIdle()
+	return n
+}
+
+// stopAllTriggers removes every rule and waits for the followers to end.
+func stopAllTriggers() {
+	triggerMu.Lock()
+	var fs []*paneFollower
+	for _, f := range followers {
+		fs = append(fs, f)
+	}
+	triggerMu.Unlock()
+	removeTriggers(0)
+	for _, f := range fs {
+		<-f.done
+	}
+	for len(triggerCh) > 0 {
+		<-triggerCh
+	}
+}
+
+// triggerRules returns the rules for saving in the session.
+func triggerRules() []triggerRule {
+	triggerMu.Lock()
+	defer triggerMu.Unlock()
+	var out []triggerRule
+	for _, t := range triggers {
+		out = append(out, t.triggerRule)
+	}
+	return out
+}
+
+// restoreTriggers replaces the rules with those of a session. The session
+// buffer is reloaded after every command, so identical rules are left
+// running.
+func restoreTriggers(rules []triggerRule) {
+	cur := triggerRules()
+	if fmt.Sprint(cur) == fmt.Sprint(rules) {
+		return
+	}
+	removeTriggers(0)
+	for _, r := range rules {
+		if _, err := addTrigger(r); err != nil {
+			warnPrintln(fmt.Sprintf("on #%d: %v", r.ID, err))
+		}
+	}
+}
+
+// parseOnRule splits the text after !on into pane, regex and command. A
+// regex between slashes is taken verbatim, spaces included, with \/ for a
+// slash; otherwise it is the single word after the pane.
+func parseOnRule(text string) (triggerRule, bool) {
+	var r triggerRule
+	text = strings.TrimSpace(text)
+	i := strings.IndexAny(text, " \t")
+	if i < 0 {
+		return r, false
+	}
+	r.Pane, text = text[:i], strings.TrimLeft(text[i:], " \t")
+	if strings.HasPrefix(text, "/") {
+		var ok bool
+		if r.Pattern, text, ok = cutSlashed(text); !ok {
+			return r, false
+		}
+	} else {
+		i = strings.IndexAny(text, " \t")
+		if i < 0 {
+			return r, false
+		}
+		r.Pattern, text = text[:i], text[i:]
+	}
+	r.Command = strings.TrimSpace(text)
+	return r, r.Pattern != "" && r.Command != ""
+}
+
+// cutSlashed splits text starting with /regex/ into the regex, with \/
+// left for the regex engine, and what follows the closing slash.
+func cutSlashed(text string) (pattern, rest string, ok bool) {
+	for j := 1; j < len(text); j++ {
+		if text[j] == '\\' {
+			j++
+		} else if text[j] == '/' {
+			return text[1:j], text[j+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// onCommand implements !on <pane> <regex> <command>, !on ls and !on rm.
+// line is the text after !on as typed, so regexes keep their spacing.
+func onCommand(args []string, line string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!on"].Usage)
+		return
+	}
+	switch args[0] {
+	case "ls":
+		triggerMu.Lock()
+		defer triggerMu.Unlock()
+		if len(triggers) == 0 {
+			cmdPrintln("no rules")
+			return
+		}
+		for _, t := range triggers {
+			cmdPrintln(fmt.Sprintf("#%d %s /%s/ %s (fired %d)", t.ID, colorize(paneColor, t.Pane), t.Pattern, t.Command, t.fired))
+		}
+		return
+	case "rm":
+		if len(args) < 2 {
+			cmdPrintln("usage: " + commands["!on"].Usage)
+			return
+		}
+		id := 0
+		if args[1] != "all" {
+			n, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+			if err != nil || n <= 0 {
+				cmdPrintln("rule id must be a number or all")
+				return
+			}
+			id = n
+		}
+		if removeTriggers(id) == 0 {
+			cmdPrintln("no such rule")
+		}
+		// keep the session buffer from bringing removed rules back
+		updateSessionBuffer()
+		return
+	}
+	r, ok := parseOnRule(line)
+	if !ok {
+		cmdPrintln("usage: " + commands["!on"].Usage)
+		return
+	}
+	t, err := addTrigger(r)
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	updateSessionBuffer()
+	successPrintln(fmt.Sprintf("rule #%d watches %s", t.ID, r.Pane))
+}
@@ -0,0 +1,126 @@
+package repl
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/chzyer/readline"
+)
+
+// atPrompt is set while the main loop waits in Readline for a command.
+var atPrompt atomic.Bool
+
+// woken tells the main loop that Readline returned because of wakePrompt
+// and the line is unfinished input to hand back, not a command.
+var woken atomic.Bool
+
+// wakeWanted is set by background work until runQueued picks it up.
+var wakeWanted atomic.Bool
+
+var wakePending atomic.Bool
+var wakeR, wakeW *os.File
+
+// promptStdin is the stdin readline reads from. It waits on the terminal
+// and on a wake pipe together, so background work can end an idle
+// Readline and get handled on the main goroutine without anything being
+// typed into a pane. A wake ends the line with a carriage return, which
+// also makes readline stop reading stdin until the next prompt.
+type promptStdin struct {
+	in *os.File
+}
+
+// newPromptStdin sets up the wake pipe for reading in. Without it
+// wakePrompt does nothing and queued work waits for the next line entered.
+func newPromptStdin(in *os.File) (*promptStdin, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	wakeR, wakeW = r, w
+	return &promptStdin{in: in}, nil
+}
+
+func (s *promptStdin) Read(p []byte) (int, error) {
+	for {
+		ready, err := waitInput(int(s.in.Fd()), int(wakeR.Fd()))
+		if err != nil || ready {
+			return s.in.Read(p)
+		}
+		var b [1]byte
+		wakeR.Read(b[:])
+		wakePending.Store(false)
+		// a wake meant for the prompt must not answer a confirmation, and
+		// one whose work was done already must not end the line
+		if atPrompt.Load() && wakeWanted.Load() && len(p) > 0 {
+			woken.Store(true)
+			p[0] = '\r'
+			return 1, nil
+		}
+	}
+}
+
+func (s *promptStdin) Close() error { return nil }
+
+// wakePrompt ends an idle Readline so the main loop runs fired triggers,
+// announces errors and appends watched output. While a command runs the
+// main loop does all that afterwards anyway.
+func wakePrompt() {
+	wakeWanted.Store(true)
+	if atPrompt.Load() {
+		signalWake()
+	}
+}
+
+func signalWake() {
+	if wakeW == nil || wakePending.Swap(true) {
+		return
+	}
+	if _, err := wakeW.Write([]byte{0}); err != nil {
+		wakePending.Store(false)
+	}
+}
+
+// runQueued does the work background goroutines left for the main
+// goroutine. %session is refreshed after it so the appended output is not
+// rolled back by the next loadSessionFromBuffer.
+func runQueued() {
+	wakeWanted.Store(false)
+	flushWatches()
+	runTriggers()
+	announceErrors()
+	updateSessionBuffer()
+}
+
+// readPrompt reads a command line. Work that wakes the prompt meanwhile is
+// done on the way and a half typed line is handed back for editing.
+func readPrompt(rl *readline.Instance) (string, error) {
+	unfinished := ""
+	for {
+		atPrompt.Store(true)
+		// work that came in since runQueued last ran
+		if wakeWanted.Load() {
+			signalWake()
+		}
+		line, err := rl.ReadlineWithDefault(unfinished)
+		atPrompt.Store(false)
+		if !woken.Swap(false) || err != nil {
+			return line, err
+		}
+		unfinished = line
+		runQueued()
+	}
+}
+
+// fdSet adds fd to set.
+func fdSet(set *syscall.FdSet, fd int) {
+	n := int(unsafe.Sizeof(set.Bits[0]) * 8)
+	set.Bits[fd/n] |= 1 << uint(fd%n)
+}
+
+// fdIsSet reports whether fd is in set.
+func fdIsSet(set *syscall.FdSet, fd int) bool {
+	n := int(unsafe.Sizeof(set.Bits[0]) * 8)
+	return set.Bits[fd/n]&(1<<uint(fd%n)) != 0
+}
@@ -0,0 +1,332 @@
+package repl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/glo0ml34f/grimux/internal/tmux"
+)
+
+// paneWatch tails a pane in the background. New lines are collected by the
+// watcher goroutine, which wakes the prompt to have them appended to the
+// buffer on the main goroutine by flushWatches, so buffers are never
+// written concurrently.
+type paneWatch struct {
+	buf     string
+	pane    string
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+	pending []string
+	lines   int
+	err     error
+}
+
+var watchMu sync.Mutex
+var watches = map[string]*paneWatch{}
+
+// watchInterval is how often panes are polled. With control mode active
+// pane output wakes the watcher immediately and polling is only a fallback.
+var watchInterval = 500 * time.Millisecond
+
+// watchMaxBytes caps the size of a watched buffer. Older lines are dropped
+// once it is exceeded.
+var watchMaxBytes = 256 * 1024
+
+// watchRecent bounds how many appended lines are remembered to suppress
+// redraws of content that was already captured.
+const watchRecent = 500
+
+// completeLines splits a capture and drops trailing blank lines and the
+// final line, which usually holds the cursor and may still be changing.
+func completeLines(capture string) []string {
+	lines := strings.Split(strings.TrimRight(capture, "\n"), "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) > 0 {
+		lines = lines[:len(lines)-1]
+	}
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " ")
+	}
+	return lines
+}
+
+// newLines returns the lines of cur that were not on screen in prev. When
+// the screen scrolled, the longest suffix of prev that starts cur marks
+// where the new output begins. Otherwise the pane was redrawn and only lines
+// not seen recently are kept.
+func newLines(prev, cur []string, recent map[string]bool) []string {
+	for k := min(len(prev), len(cur)); k > 0; k-- {
+		if equalLines(prev[len(prev)-k:], cur[:k]) {
+			return cur[k:]
+		}
+	}
+	var out []string
+	for _, l := range cur {
+		if !recent[l] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
+
+func equalLines(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *paneWatch) loop() {
+	defer close(w.done)
+	err := followPane(w.pane, w.wake, w.stop, func(fresh []string) {
+		w.mu.Lock()
+		w.pending = append(w.pending, fresh...)
+		w.mu.Unlock()
+		wakePrompt()
+	})
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
+
+// followPane polls pane until stop is closed and hands new complete lines
+// to emit. Lines already on screen when it starts are not new. wake asks
+// for a capture before the next tick.
+func followPane(pane string, wake, stop <-chan struct{}, emit func([]string)) error {
+	var prev []string
+	recent := map[string]bool{}
+	var order []string
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	first := true
+	for {
+		out, err := capturePane(pane)
+		if err != nil {
+			return err
+		}
+		cur := completeLines(out)
+		var fresh []string
+		if first {
+			// lines already on screen are part of the snapshot, not new output
+			first = false
+		} else {
+			fresh = newLines(prev, cur, recent)
+		}
+		prev = cur
+		if len(fresh) > 0 {
+			emit(fresh)
+		}
+		for _, l := range cur {
+			if !recent[l] {
+				recent[l] = true
+				order = append(order, l)
+			}
+		}
+		for len(order) > watchRecent {
+			delete(recent, order[0])
+			order = order[1:]
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// notifyWatches wakes the watchers, trigger followers and error watchers of
+// the pane an %output event belongs to.
+func notifyWatches(ev tmux.Event) {
+	if ev.Name != "output" {
+		return
+	}
+	wakeTriggers(ev.Pane)
+	wakeExplain(ev.Pane)
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	for _, w := range watches {
+		if w.pane == ev.Pane {
+			select {
+			case w.wake <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// startWatch begins tailing pane into buf.
+func startWatch(buf, pane string) error {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	if w, ok := watches[buf]; ok {
+		return fmt.Errorf("%s already watches %s", buf, w.pane)
+	}
+	w := &paneWatch{buf: buf, pane: pane, wake: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+	watches[buf] = w
+	go w.loop()
+	return nil
+}
+
+// stopWatch ends the watch on buf after appending what it collected.
+func stopWatch(buf string) bool {
+	watchMu.Lock()
+	w, ok := watches[buf]
+	delete(watches, buf)
+	watchMu.Unlock()
+	if !ok {
+		return false
+	}
+	close(w.stop)
+	<-w.done
+	flushWatch(w)
+	return true
+}
+
+// stopWatchesOn ends every watch tailing pane.
+func stopWatchesOn(pane string) {
+	for _, buf := range watchNames() {
+		watchMu.Lock()
+		w := watches[buf]
+		watchMu.Unlock()
+		if w != nil && w.pane == pane {
+			stopWatch(buf)
+		}
+	}
+}
+
+func stopAllWatches() {
+	for _, buf := range watchNames() {
+		stopWatch(buf)
+	}
+}
+
+func watchNames() []string {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	names := make([]string, 0, len(watches))
+	for name := range watches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// flushWatch appends pending lines to the watch buffer, trimming the oldest
+// lines once watchMaxBytes is exceeded.
+func flushWatch(w *paneWatch) {
+	w.mu.Lock()
+	lines := w.pending
+	w.pending = nil
+	w.lines += len(lines)
+	w.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	data := buffers[w.buf] + strings.Join(lines, "\n") + "\n"
+	if len(data) > watchMaxBytes {
+		data = data[len(data)-watchMaxBytes:]
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	writeBuffer(w.buf, data)
+}
+
+// flushWatches appends collected output for every watch and drops watches
+// whose pane went away.
+func flushWatches() {
+	for _, name := range watchNames() {
+		watchMu.Lock()
+		w := watches[name]
+		watchMu.Unlock()
+		if w == nil {
+			continue
+		}
+		flushWatch(w)
+		w.mu.Lock()
+		err := w.err
+		w.mu.Unlock()
+		if err != nil {
+			watchMu.Lock()
+			delete(watches, name)
+			watchMu.Unlock()
+			warnPrintln(fmt.Sprintf("watch %s stopped: %v", name, err))
+		}
+	}
+}
+
+// watchCommand implements !watch <buffer> <pane>.
+func watchCommand(args []string) {
+	if len(args) < 2 {
+		cmdPrintln("usage: " + commands["!watch"].Usage)
+		return
+	}
+	buf := args[0]
+	pane, err := paneArg(args[1])
+	if err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	if isTmuxBuffer(buf) {
+		cmdPrintln("watch target must be a grimux buffer")
+		return
+	}
+	if _, ok := buffers[buf]; !ok {
+		if err := validateBufferName(buf); err != nil {
+			cmdPrintln(err.Error())
+			return
+		}
+		buffers[buf] = ""
+	}
+	if err := startWatch(buf, pane); err != nil {
+		cmdPrintln(err.Error())
+		return
+	}
+	successPrintln(fmt.Sprintf("watching %s into %s", pane, buf))
+}
+
+// unwatchCommand implements !unwatch <buffer|all>.
+func unwatchCommand(args []string) {
+	if len(args) < 1 {
+		cmdPrintln("usage: " + commands["!unwatch"].Usage)
+		return
+	}
+	if args[0] == "all" {
+		stopAllWatches()
+		return
+	}
+	if !stopWatch(args[0]) {
+		cmdPrintln("no watch on " + args[0])
+	}
+}
+
+// watchesCommand implements !watches.
+func watchesCommand() {
+	names := watchNames()
+	if len(names) == 0 {
+		cmdPrintln("no active watches")
+		return
+	}
+	for _, name := range names {
+		watchMu.Lock()
+		w := watches[name]
+		watchMu.Unlock()
+		if w == nil {
+			continue
+		}
+		w.mu.Lock()
+		lines := w.lines + len(w.pending)
+		w.mu.Unlock()
+		cmdPrintln(fmt.Sprintf("%s <- %s  %d line(s), %d bytes", colorize(bufferColor, name), colorize(paneColor, w.pane), lines, len(buffers[name])))
+	}
+}
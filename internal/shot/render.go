@@ -0,0 +1,160 @@
+package shot
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	padding  = 16
+	titleBar = 28
+	svgCellW = 8.4
+	svgCellH = 18
+	svgFont  = 14
+	// pngScale enlarges the 7x13 bitmap font so screenshots stay legible.
+	pngScale = 2
+)
+
+// run is a stretch of cells sharing a style.
+type run struct {
+	col   int
+	text  string
+	width int
+	style Style
+}
+
+func runs(line []Cell) []run {
+	var out []run
+	for i := 0; i < len(line); {
+		j := i
+		var sb strings.Builder
+		for j < len(line) && line[j].Style == line[i].Style {
+			sb.WriteRune(line[j].Rune)
+			j++
+		}
+		out = append(out, run{col: i, text: sb.String(), width: j - i, style: line[i].Style})
+		i = j
+	}
+	return out
+}
+
+var xmlEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+// SVG renders the screen as a terminal window in SVG.
+func SVG(s *Screen, w io.Writer) error {
+	cols := max(s.Width(), 20)
+	width := float64(cols)*svgCellW + 2*padding
+	height := float64(len(s.Lines))*svgCellH + 2*padding + titleBar
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f">`+"\n", width, height, width, height)
+	fmt.Fprintf(bw, `<rect width="100%%" height="100%%" rx="8" fill="%s"/>`+"\n", hex(defaultBG))
+	fmt.Fprintf(bw, `<path d="M0 8a8 8 0 0 1 8-8h%.0fa8 8 0 0 1 8 8v%dH0z" fill="%s"/>`+"\n", width-16, titleBar-8, hex(titleBG))
+	for i, c := range dots {
+		fmt.Fprintf(bw, `<circle cx="%d" cy="%d" r="6" fill="%s"/>`+"\n", padding+i*20, titleBar/2, hex(c))
+	}
+	if s.Title != "" {
+		fmt.Fprintf(bw, `<text x="%.1f" y="%d" fill="%s" font-family="monospace" font-size="12" text-anchor="middle">%s</text>`+"\n", width/2, titleBar/2+4, hex(defaultFG), xmlEscaper.Replace(s.Title))
+	}
+	fmt.Fprintf(bw, `<g font-family="'DejaVu Sans Mono',Menlo,Consolas,monospace" font-size="%d" xml:space="preserve">`+"\n", svgFont)
+	for row, line := range s.Lines {
+		y := float64(titleBar+padding) + float64(row)*svgCellH
+		for _, r := range runs(line) {
+			fg, bg := r.style.colors()
+			x := padding + float64(r.col)*svgCellW
+			w := float64(r.width) * svgCellW
+			if bg != defaultBG {
+				fmt.Fprintf(bw, `<rect x="%.1f" y="%.1f" width="%.1f" height="%d" fill="%s"/>`+"\n", x, y, w, svgCellH, hex(bg))
+			}
+			if strings.TrimSpace(r.text) == "" && !r.style.Underline {
+				continue
+			}
+			attrs := ""
+			if r.style.Bold {
+				attrs += ` font-weight="bold"`
+			}
+			if r.style.Underline {
+				attrs += ` text-decoration="underline"`
+			}
+			fmt.Fprintf(bw, `<text x="%.1f" y="%.1f" fill="%s" textLength="%.1f" lengthAdjust="spacingAndGlyphs"%s>%s</text>`+"\n",
+				x, y+svgCellH-5, hex(fg), w, attrs, xmlEscaper.Replace(r.text))
+		}
+	}
+	fmt.Fprintln(bw, "</g>\n</svg>")
+	return bw.Flush()
+}
+
+// PNG renders the screen as a terminal window in PNG using the built-in
+// 7x13 bitmap font. Characters the font lacks are left blank.
+func PNG(s *Screen, w io.Writer) error {
+	face := basicfont.Face7x13
+	cw, ch := 7, 13
+	pad, bar := padding/pngScale, titleBar/pngScale
+	cols := max(s.Width(), 20)
+	width := cols*cw + 2*pad
+	height := len(s.Lines)*ch + 2*pad + bar
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fill := func(r image.Rectangle, c color.RGBA) {
+		draw.Draw(img, r, &image.Uniform{c}, image.Point{}, draw.Src)
+	}
+	fill(img.Bounds(), defaultBG)
+	fill(image.Rect(0, 0, width, bar), titleBG)
+	for i, c := range dots {
+		cx, cy := pad+i*10, bar/2
+		for y := -3; y <= 3; y++ {
+			for x := -3; x <= 3; x++ {
+				if x*x+y*y <= 9 {
+					img.SetRGBA(cx+x, cy+y, c)
+				}
+			}
+		}
+	}
+	d := &font.Drawer{Dst: img, Face: face}
+	if s.Title != "" {
+		d.Src = &image.Uniform{defaultFG}
+		d.Dot = fixed.P((width-d.MeasureString(s.Title).Ceil())/2, (bar+face.Ascent)/2)
+		d.DrawString(s.Title)
+	}
+	for row, line := range s.Lines {
+		y := bar + pad + row*ch
+		for _, r := range runs(line) {
+			fg, bg := r.style.colors()
+			x := pad + r.col*cw
+			if bg != defaultBG {
+				fill(image.Rect(x, y, x+r.width*cw, y+ch), bg)
+			}
+			d.Src = &image.Uniform{fg}
+			for i, c := range []rune(r.text) {
+				if c == ' ' {
+					continue
+				}
+				if c == '█' {
+					fill(image.Rect(x+i*cw, y, x+(i+1)*cw, y+ch), fg)
+					continue
+				}
+				d.Dot = fixed.P(x+i*cw, y+face.Ascent)
+				d.DrawString(string(c))
+				if r.style.Bold {
+					d.Dot = fixed.P(x+i*cw+1, y+face.Ascent)
+					d.DrawString(string(c))
+				}
+			}
+			if r.style.Underline {
+				fill(image.Rect(x, y+ch-1, x+r.width*cw, y+ch), fg)
+			}
+		}
+	}
+	big := image.NewRGBA(image.Rect(0, 0, width*pngScale, height*pngScale))
+	xdraw.NearestNeighbor.Scale(big, big.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+	return png.Encode(w, big)
+}
@@ -0,0 +1,246 @@
+package shot
+
+import (
+	"fmt"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Style holds the attributes of a cell. A nil color means the default.
+type Style struct {
+	FG        *color.RGBA
+	BG        *color.RGBA
+	Bold      bool
+	Underline bool
+	Inverse   bool
+}
+
+// Cell is one character of the terminal grid.
+type Cell struct {
+	Rune  rune
+	Style Style
+}
+
+// Screen is a parsed capture, one slice of cells per line.
+type Screen struct {
+	Title string
+	Lines [][]Cell
+}
+
+var (
+	defaultFG = color.RGBA{0xd0, 0xd0, 0xd0, 0xff}
+	defaultBG = color.RGBA{0x1e, 0x1e, 0x1e, 0xff}
+	titleBG   = color.RGBA{0x32, 0x32, 0x32, 0xff}
+	dots      = []color.RGBA{{0xff, 0x5f, 0x56, 0xff}, {0xff, 0xbd, 0x2e, 0xff}, {0x27, 0xc9, 0x3f, 0xff}}
+)
+
+// base16 are the first 16 entries of the xterm palette.
+var base16 = []color.RGBA{
+	{0x00, 0x00, 0x00, 0xff}, {0xcd, 0x31, 0x31, 0xff}, {0x0d, 0xbc, 0x79, 0xff}, {0xe5, 0xe5, 0x10, 0xff},
+	{0x24, 0x72, 0xc8, 0xff}, {0xbc, 0x3f, 0xbc, 0xff}, {0x11, 0xa8, 0xcd, 0xff}, {0xe5, 0xe5, 0xe5, 0xff},
+	{0x66, 0x66, 0x66, 0xff}, {0xf1, 0x4c, 0x4c, 0xff}, {0x23, 0xd1, 0x8b, 0xff}, {0xf5, 0xf5, 0x43, 0xff},
+	{0x3b, 0x8e, 0xea, 0xff}, {0xd6, 0x70, 0xd6, 0xff}, {0x29, 0xb8, 0xdb, 0xff}, {0xff, 0xff, 0xff, 0xff},
+}
+
+// Palette returns color n of the xterm 256-color palette.
+func Palette(n int) color.RGBA {
+	switch {
+	case n < 16:
+		return base16[n]
+	case n < 232:
+		n -= 16
+		level := func(v int) uint8 {
+			if v == 0 {
+				return 0
+			}
+			return uint8(55 + v*40)
+		}
+		return color.RGBA{level(n / 36), level(n / 6 % 6), level(n % 6), 0xff}
+	}
+	g := uint8(8 + (n-232)*10)
+	return color.RGBA{g, g, g, 0xff}
+}
+
+// escapes matches any escape sequence; only SGR sequences ending in m are
+// interpreted, the rest are dropped.
+var escapes = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_]`)
+
+// Parse reads a capture made with capture-pane -e into a screen. Tabs are
+// expanded to eight columns and trailing blank lines are dropped.
+func Parse(s string) *Screen {
+	scr := &Screen{}
+	var st Style
+	var line []Cell
+	flush := func() {
+		scr.Lines = append(scr.Lines, line)
+		line = nil
+	}
+	put := func(text string) {
+		for _, r := range text {
+			switch r {
+			case '\n':
+				flush()
+			case '\r':
+			case '\t':
+				for n := 8 - len(line)%8; n > 0; n-- {
+					line = append(line, Cell{Rune: ' ', Style: st})
+				}
+			default:
+				if r < ' ' {
+					continue
+				}
+				line = append(line, Cell{Rune: r, Style: st})
+			}
+		}
+	}
+	last := 0
+	for _, loc := range escapes.FindAllStringIndex(s, -1) {
+		put(s[last:loc[0]])
+		last = loc[1]
+		seq := s[loc[0]:loc[1]]
+		if strings.HasPrefix(seq, "\x1b[") && strings.HasSuffix(seq, "m") {
+			applySGR(&st, seq[2:len(seq)-1])
+		}
+	}
+	put(s[last:])
+	if len(line) > 0 {
+		flush()
+	}
+	for len(scr.Lines) > 0 && blank(scr.Lines[len(scr.Lines)-1]) {
+		scr.Lines = scr.Lines[:len(scr.Lines)-1]
+	}
+	return scr
+}
+
+func blank(line []Cell) bool {
+	for _, c := range line {
+		if c.Rune != ' ' || c.Style.BG != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// applySGR updates st with the parameters of a select graphic rendition
+// sequence.
+func applySGR(st *Style, params string) {
+	if params == "" {
+		*st = Style{}
+		return
+	}
+	ps := strings.Split(strings.ReplaceAll(params, ":", ";"), ";")
+	num := func(i int) int {
+		if i >= len(ps) {
+			return 0
+		}
+		n, _ := strconv.Atoi(ps[i])
+		return n
+	}
+	for i := 0; i < len(ps); i++ {
+		n := num(i)
+		switch {
+		case n == 0:
+			*st = Style{}
+		case n == 1:
+			st.Bold = true
+		case n == 4:
+			st.Underline = true
+		case n == 7:
+			st.Inverse = true
+		case n == 22:
+			st.Bold = false
+		case n == 24:
+			st.Underline = false
+		case n == 27:
+			st.Inverse = false
+		case n >= 30 && n <= 37:
+			c := Palette(n - 30)
+			st.FG = &c
+		case n >= 90 && n <= 97:
+			c := Palette(n - 90 + 8)
+			st.FG = &c
+		case n >= 40 && n <= 47:
+			c := Palette(n - 40)
+			st.BG = &c
+		case n >= 100 && n <= 107:
+			c := Palette(n - 100 + 8)
+			st.BG = &c
+		case n == 39:
+			st.FG = nil
+		case n == 49:
+			st.BG = nil
+		case n == 38 || n == 48:
+			var c color.RGBA
+			switch num(i + 1) {
+			case 5:
+				c = Palette(num(i+2) & 0xff)
+				i += 2
+			case 2:
+				c = color.RGBA{uint8(num(i + 2)), uint8(num(i + 3)), uint8(num(i + 4)), 0xff}
+				i += 4
+			default:
+				continue
+			}
+			if n == 38 {
+				st.FG = &c
+			} else {
+				st.BG = &c
+			}
+		}
+	}
+}
+
+// colors resolves the foreground and background of a style.
+func (st Style) colors() (fg, bg color.RGBA) {
+	fg, bg = defaultFG, defaultBG
+	if st.FG != nil {
+		fg = *st.FG
+	}
+	if st.BG != nil {
+		bg = *st.BG
+	}
+	if st.Inverse {
+		fg, bg = bg, fg
+	}
+	return fg, bg
+}
+
+// Redact blanks out every line matching re with solid blocks so secrets
+// never reach the image. It returns the number of redacted lines.
+func (s *Screen) Redact(re *regexp.Regexp) int {
+	count := 0
+	for i, line := range s.Lines {
+		var sb strings.Builder
+		for _, c := range line {
+			sb.WriteRune(c.Rune)
+		}
+		text := strings.TrimRight(sb.String(), " ")
+		if !re.MatchString(text) {
+			continue
+		}
+		n := utf8.RuneCountInString(text)
+		red := make([]Cell, n)
+		for j := range red {
+			red[j] = Cell{Rune: '█'}
+		}
+		s.Lines[i] = red
+		count++
+	}
+	return count
+}
+
+// Width returns the number of columns of the widest line.
+func (s *Screen) Width() int {
+	w := 0
+	for _, l := range s.Lines {
+		w = max(w, len(l))
+	}
+	return w
+}
+
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,53 @@
+package shot
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	scr := Parse("\x1b[1;31merr\x1b[0m ok\n\x1b[38;5;208mor\x1b[48;2;1;2;3mbg\x1b[m\ta\n\n\n")
+	if len(scr.Lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d", len(scr.Lines))
+	}
+	first := scr.Lines[0]
+	if first[0].Rune != 'e' || !first[0].Style.Bold || *first[0].Style.FG != Palette(1) || first[3].Style.FG != nil {
+		t.Fatalf("unexpected first line: %+v", first)
+	}
+	second := scr.Lines[1]
+	if *second[0].Style.FG != (color.RGBA{0xff, 0x87, 0x00, 0xff}) || *second[2].Style.BG != (color.RGBA{1, 2, 3, 0xff}) {
+		t.Fatalf("unexpected colors: %+v", second)
+	}
+	if len(second) != 9 || second[8].Rune != 'a' {
+		t.Fatalf("tab not expanded: %d cells", len(second))
+	}
+}
+
+func TestRedactAndRender(t *testing.T) {
+	scr := Parse("user: admin\npassword: \x1b[33mhunter2\x1b[0m\n")
+	if n := scr.Redact(regexp.MustCompile(`password`)); n != 1 {
+		t.Fatalf("expected 1 redacted line, got %d", n)
+	}
+	var svg bytes.Buffer
+	if err := SVG(scr, &svg); err != nil {
+		t.Fatalf("SVG: %v", err)
+	}
+	if strings.Contains(svg.String(), "hunter2") || !strings.Contains(svg.String(), ">user: admin</text>") {
+		t.Fatalf("unexpected svg:\n%s", svg.String())
+	}
+	var out bytes.Buffer
+	if err := PNG(scr, &out); err != nil {
+		t.Fatalf("PNG: %v", err)
+	}
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != (20*7+16)*2 || b.Dy() != (2*13+16+14)*2 {
+		t.Fatalf("unexpected size %v", b)
+	}
+}
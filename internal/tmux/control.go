@@ -0,0 +1,377 @@
+package tmux
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrControlClosed is returned when the control mode connection has gone away.
+var ErrControlClosed = errors.New("tmux control connection closed")
+
+// controlTimeout bounds how long a command waits for its reply.
+var controlTimeout = 10 * time.Second
+
+// Event is a control mode notification such as %output or %window-add. Name
+// omits the leading '%'. Pane is set when the notification refers to a pane
+// and Data holds the decoded payload of %output lines.
+type Event struct {
+	Name string
+	Pane string
+	Args []string
+	Data string
+}
+
+type controlReply struct {
+	lines []string
+	err   error
+}
+
+// Control is a persistent tmux control mode (tmux -C) connection. Commands
+// are multiplexed over a single tmux process and notifications are delivered
+// to subscribers.
+type Control struct {
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex // keeps queue order in step with writes
+	mu      sync.Mutex
+	queue   []chan controlReply
+	subs    map[int]func(Event)
+	nextID  int
+	panes   map[string]bool
+	done    chan struct{}
+	closed  bool
+}
+
+var activeMu sync.Mutex
+var active *Control
+
+// activeControl returns the control connection used by the helpers in this
+// package, or nil when commands should fork a tmux process.
+func activeControl() *Control {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	if active != nil && active.isClosed() {
+		active = nil
+	}
+	return active
+}
+
+// StartControl attaches a control mode client to the session grimux runs in,
+// or to the most recent session of a server picked with Socket, and routes
+// the package helpers through it until Close is called.
+func StartControl() (*Control, error) {
+	socket, err := socketPath()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-S", socket, "-C", "attach-session"}
+	if parts := strings.Split(os.Getenv("TMUX"), ","); inServer() && len(parts) >= 3 && parts[2] != "" {
+		args = append(args, "-t", "$"+parts[2])
+	}
+	debugf("running: tmux %s", strings.Join(args, " "))
+	cmd := exec.Command("tmux", args...)
+	// tmux refuses to attach from inside a session unless $TMUX is unset
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "TMUX=") {
+			cmd.Env = append(cmd.Env, e)
+		}
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("tmux control: %w", err)
+	}
+	c := newControl(stdout, stdin)
+	c.cmd = cmd
+	// make sure the connection works before handing it out
+	if _, err := c.Run("display-message", "-p", "ok"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.refreshPanes(false)
+	activeMu.Lock()
+	active = c
+	activeMu.Unlock()
+	return c, nil
+}
+
+// newControl wires a control connection to the given streams.
+func newControl(r io.Reader, w io.WriteCloser) *Control {
+	c := &Control{stdin: w, subs: map[int]func(Event){}, panes: map[string]bool{}, done: make(chan struct{})}
+	go c.readLoop(r)
+	return c
+}
+
+func (c *Control) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Close detaches the control client.
+func (c *Control) Close() error {
+	activeMu.Lock()
+	if active == c {
+		active = nil
+	}
+	activeMu.Unlock()
+	c.stdin.Close()
+	if c.cmd != nil {
+		done := make(chan struct{})
+		go func() { c.cmd.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			c.cmd.Process.Kill()
+		}
+	}
+	<-c.done
+	return nil
+}
+
+// quoteArg quotes a command argument for the tmux command parser.
+func quoteArg(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// Run executes a tmux command over the control connection and returns its
+// output lines joined with newlines.
+func (c *Control) Run(args ...string) (string, error) {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = quoteArg(a)
+	}
+	ch := make(chan controlReply, 1)
+	c.writeMu.Lock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		c.writeMu.Unlock()
+		return "", ErrControlClosed
+	}
+	c.queue = append(c.queue, ch)
+	c.mu.Unlock()
+	_, err := io.WriteString(c.stdin, strings.Join(quoted, " ")+"\n")
+	c.writeMu.Unlock()
+	if err != nil {
+		return "", ErrControlClosed
+	}
+	select {
+	case rep := <-ch:
+		if rep.err != nil {
+			return "", rep.err
+		}
+		if len(rep.lines) == 0 {
+			return "", nil
+		}
+		return strings.Join(rep.lines, "\n") + "\n", nil
+	case <-time.After(controlTimeout):
+		return "", fmt.Errorf("tmux control: timeout waiting for %s", args[0])
+	}
+}
+
+// Subscribe registers fn for every notification. Callbacks run on the reader
+// goroutine so they must not block or issue commands synchronously. The
+// returned function removes the subscription.
+func (c *Control) Subscribe(fn func(Event)) func() {
+	c.mu.Lock()
+	id := c.nextID
+	c.nextID++
+	c.subs[id] = fn
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+	}
+}
+
+// Subscribe registers fn with the active control connection. It returns an
+// error when control mode is not running.
+func Subscribe(fn func(Event)) (func(), error) {
+	c := activeControl()
+	if c == nil {
+		return nil, errors.New("tmux control mode not active")
+	}
+	return c.Subscribe(fn), nil
+}
+
+// ControlActive reports whether commands are routed over control mode.
+func ControlActive() bool { return activeControl() != nil }
+
+func (c *Control) emit(ev Event) {
+	c.mu.Lock()
+	fns := make([]func(Event), 0, len(c.subs))
+	for _, fn := range c.subs {
+		fns = append(fns, fn)
+	}
+	c.mu.Unlock()
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
+
+func (c *Control) readLoop(r io.Reader) {
+	br := bufio.NewReader(r)
+	var block []string
+	var guard []string
+	inBlock := false
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+		if err != nil && line == "" {
+			break
+		}
+		switch {
+		case inBlock && (strings.HasPrefix(line, "%end ") || strings.HasPrefix(line, "%error ")) && sameGuard(line, guard):
+			inBlock = false
+			// flags of 1 mark replies to commands sent by this client
+			if len(guard) >= 3 && guard[2] == "1" {
+				var rep controlReply
+				if strings.HasPrefix(line, "%error ") {
+					rep.err = fmt.Errorf("tmux command: %s", strings.Join(block, "; "))
+				} else {
+					rep.lines = block
+				}
+				c.mu.Lock()
+				if len(c.queue) > 0 {
+					c.queue[0] <- rep
+					c.queue = c.queue[1:]
+				}
+				c.mu.Unlock()
+			}
+		case inBlock:
+			block = append(block, line)
+		case strings.HasPrefix(line, "%begin "):
+			inBlock = true
+			block = nil
+			guard = strings.Fields(line)[1:]
+		case strings.HasPrefix(line, "%"):
+			ev := ParseEvent(line)
+			c.emit(ev)
+			switch ev.Name {
+			case "layout-change", "window-close", "unlinked-window-close", "window-add", "unlinked-window-add":
+				go c.refreshPanes(true)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	c.mu.Lock()
+	c.closed = true
+	for _, ch := range c.queue {
+		ch <- controlReply{err: ErrControlClosed}
+	}
+	c.queue = nil
+	c.mu.Unlock()
+	// unblock writers stuck on a connection nobody reads anymore
+	c.stdin.Close()
+	close(c.done)
+}
+
+func sameGuard(line string, guard []string) bool {
+	f := strings.Fields(line)[1:]
+	if len(f) != len(guard) {
+		return false
+	}
+	for i := range f {
+		if f[i] != guard[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshPanes reloads the known pane set and, when notify is set, emits a
+// synthetic pane-exited event for every pane that disappeared. tmux has no
+// native notification for this.
+func (c *Control) refreshPanes(notify bool) {
+	out, err := c.Run("list-panes", "-a", "-F", "#{pane_id}")
+	if err != nil {
+		return
+	}
+	now := map[string]bool{}
+	for _, id := range strings.Fields(out) {
+		now[id] = true
+	}
+	c.mu.Lock()
+	var gone []string
+	for id := range c.panes {
+		if !now[id] {
+			gone = append(gone, id)
+		}
+	}
+	c.panes = now
+	c.mu.Unlock()
+	if notify {
+		for _, id := range gone {
+			c.emit(Event{Name: "pane-exited", Pane: id, Args: []string{id}})
+		}
+	}
+}
+
+// ParseEvent decodes a control mode notification line.
+func ParseEvent(line string) Event {
+	line = strings.TrimPrefix(line, "%")
+	name, rest, _ := strings.Cut(line, " ")
+	ev := Event{Name: name}
+	switch name {
+	case "output":
+		pane, data, _ := strings.Cut(rest, " ")
+		ev.Pane = pane
+		ev.Args = []string{pane}
+		ev.Data = UnescapeOutput(data)
+		return ev
+	case "extended-output":
+		head, data, _ := strings.Cut(rest, " : ")
+		ev.Args = strings.Fields(head)
+		if len(ev.Args) > 0 {
+			ev.Pane = ev.Args[0]
+		}
+		ev.Data = UnescapeOutput(data)
+		return ev
+	}
+	ev.Args = strings.Fields(rest)
+	for _, a := range ev.Args {
+		if strings.HasPrefix(a, "%") {
+			ev.Pane = a
+			break
+		}
+	}
+	return ev
+}
+
+// UnescapeOutput decodes the octal escapes tmux uses in %output payloads.
+func UnescapeOutput(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
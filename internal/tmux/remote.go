@@ -0,0 +1,229 @@
+package tmux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Remote is a tmux server on another host reached over ssh. Panes on it are
+// addressed as %name:%3.
+type Remote struct {
+	Name   string `json:"name"`
+	Host   string `json:"host"`
+	Socket string `json:"socket,omitempty"`
+}
+
+var remoteMu sync.Mutex
+var remotes = map[string]*Remote{}
+
+// RemoteNamePattern restricts remote names so %name:%3 stays unambiguous.
+var RemoteNamePattern = regexp.MustCompile(`^[\w.-]+$`)
+
+// remoteTarget matches a remote pane reference.
+var remoteTarget = regexp.MustCompile(`^%([\w.-]+):(%\d+)$`)
+
+// AddRemote registers a remote tmux server. socket is a socket path (-S) or
+// a socket name (-L); empty uses the default server of the remote user.
+func AddRemote(name, host, socket string) error {
+	if !RemoteNamePattern.MatchString(name) || name == "pane" || name == "cmd" {
+		return fmt.Errorf("invalid remote name %q", name)
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if strings.HasPrefix(host, "-") {
+		// ssh would take it as an option
+		return fmt.Errorf("invalid host %q", host)
+	}
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	remotes[name] = &Remote{Name: name, Host: host, Socket: socket}
+	return nil
+}
+
+// RemoveRemote forgets a remote and closes its shared ssh connection.
+func RemoveRemote(name string) bool {
+	remoteMu.Lock()
+	r, ok := remotes[name]
+	delete(remotes, name)
+	remoteMu.Unlock()
+	if ok {
+		r.close()
+	}
+	return ok
+}
+
+// Remotes returns the registered remotes sorted by name.
+func Remotes() []Remote {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+	out := make([]Remote, 0, len(remotes))
+	for _, r := range remotes {
+		out = append(out, *r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// CloseRemotes ends the shared ssh connections of all remotes.
+func CloseRemotes() {
+	for _, r := range Remotes() {
+		r.close()
+	}
+}
+
+// IsRemoteTarget reports whether target looks like %name:%3.
+func IsRemoteTarget(target string) bool {
+	return remoteTarget.MatchString(target)
+}
+
+// splitRemote returns the remote and the pane id on it for a remote pane
+// reference. ok is false for local targets.
+func splitRemote(target string) (r *Remote, pane string, ok bool, err error) {
+	m := remoteTarget.FindStringSubmatch(target)
+	if m == nil {
+		return nil, target, false, nil
+	}
+	remoteMu.Lock()
+	r = remotes[m[1]]
+	remoteMu.Unlock()
+	if r == nil {
+		return nil, "", true, fmt.Errorf("unknown remote %s", m[1])
+	}
+	return r, m[2], true, nil
+}
+
+// routeRemote looks for a remote pane after -t in args. When there is one
+// it returns the remote and args with the local pane id on that host.
+func routeRemote(args []string) (*Remote, []string, error) {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "-t" {
+			continue
+		}
+		r, pane, ok, err := splitRemote(args[i+1])
+		if !ok || err != nil {
+			return nil, args, err
+		}
+		out := append([]string(nil), args...)
+		out[i+1] = pane
+		return r, out, nil
+	}
+	return nil, args, nil
+}
+
+// controlDir holds the ssh control sockets shared between commands.
+func controlDir() string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("grimux-ssh-%d", os.Getuid()))
+}
+
+// sshArgs returns the ssh options that reuse one connection per host.
+func (r *Remote) sshArgs() []string {
+	return []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(controlDir(), "%C"),
+		"-o", "ControlPersist=10m",
+		"-o", "BatchMode=yes",
+	}
+}
+
+// shellQuote quotes s for the remote shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// command builds the remote tmux command line. ssh hands it to the remote
+// shell, so every argument is quoted.
+func (r *Remote) command(args []string) string {
+	parts := []string{"tmux"}
+	if r.Socket != "" {
+		flag := "-L"
+		if strings.Contains(r.Socket, "/") {
+			flag = "-S"
+		}
+		parts = append(parts, flag, shellQuote(r.Socket))
+	}
+	for _, a := range args {
+		parts = append(parts, shellQuote(a))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Run executes a tmux command on the remote host.
+func (r *Remote) Run(args ...string) (string, error) {
+	return r.run(nil, args...)
+}
+
+func (r *Remote) run(stdin io.Reader, args ...string) (string, error) {
+	if err := os.MkdirAll(controlDir(), 0700); err != nil {
+		return "", err
+	}
+	sshArgs := append(r.sshArgs(), "--", r.Host, r.command(args))
+	debugf("running: ssh %s", strings.Join(sshArgs, " "))
+	cmd := exec.Command("ssh", sshArgs...)
+	cmd.Stdin = stdin
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", r.explain(err, stderr.String())
+	}
+	return out.String(), nil
+}
+
+// explain turns a failed ssh invocation into an error that says whether
+// ssh, the remote tmux binary or the remote tmux server is the problem.
+func (r *Remote) explain(err error, stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	code := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	}
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return errors.New("ssh is not installed")
+	case code == 255:
+		return fmt.Errorf("ssh %s failed: %s", r.Host, msg)
+	case code == 127 || strings.Contains(msg, "command not found"):
+		return fmt.Errorf("tmux is not installed on %s", r.Host)
+	case strings.Contains(msg, "no server running") || strings.Contains(msg, "error connecting to"):
+		where := r.Host
+		if r.Socket != "" {
+			where += " (" + r.Socket + ")"
+		}
+		return fmt.Errorf("no tmux server running on %s", where)
+	case msg != "":
+		return fmt.Errorf("tmux on %s: %s", r.Host, msg)
+	}
+	return fmt.Errorf("tmux on %s: %w", r.Host, err)
+}
+
+// ListPanes lists the panes of the remote server with ids in %name:%3 form.
+func (r *Remote) ListPanes() ([]PaneInfo, error) {
+	out, err := r.Run("list-panes", "-a", "-F", paneFormat)
+	if err != nil {
+		return nil, err
+	}
+	panes := parsePanes(out)
+	for i := range panes {
+		panes[i].ID = "%" + r.Name + ":" + panes[i].ID
+	}
+	return panes, nil
+}
+
+// close asks the shared ssh connection to exit.
+func (r *Remote) close() {
+	args := append(r.sshArgs(), "-O", "exit", "--", r.Host)
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = io.Discard
+	cmd.Run()
+}
@@ -7,8 +7,11 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Verbose controls whether debug logging is enabled.
@@ -20,25 +23,73 @@ func debugf(format string, args ...interface{}) {
 	}
 }
 
-// CapturePane connects to the tmux server over its UNIX socket and captures the
-// contents of the specified pane. If target is empty, the current pane is
-// captured.
-func CapturePane(target string) (string, error) {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return "", errors.New("TMUX environment variable is not set")
+// Socket and SocketName pick the tmux server like tmux -S and -L do. When
+// both are empty the server grimux runs in, taken from $TMUX, is used.
+var Socket string
+var SocketName string
+
+// ExplicitServer reports whether Socket or SocketName select the server.
+func ExplicitServer() bool {
+	return Socket != "" || SocketName != ""
+}
+
+// namedSocket returns the path tmux uses for a -L socket name.
+func namedSocket(name string) string {
+	dir := os.Getenv("TMUX_TMPDIR")
+	if dir == "" {
+		dir = "/tmp"
 	}
+	return filepath.Join(dir, fmt.Sprintf("tmux-%d", os.Getuid()), name)
+}
+
+// envSocket returns the socket from $TMUX, or "" outside tmux.
+func envSocket() string {
+	return strings.Split(os.Getenv("TMUX"), ",")[0]
+}
 
-	socket := strings.Split(tmuxEnv, ",")[0]
+// socketPath returns the socket of the selected tmux server.
+func socketPath() (string, error) {
+	socket := Socket
+	switch {
+	case socket != "":
+	case SocketName != "":
+		socket = namedSocket(SocketName)
+	default:
+		socket = envSocket()
+		if socket == "" {
+			return "", errors.New("not inside tmux: set $TMUX or pass -tmux-socket or -L")
+		}
+	}
 	debugf("using tmux socket: %s", socket)
 	if _, err := os.Stat(socket); err != nil {
-		return "", fmt.Errorf("tmux socket missing: %w", err)
+		return "", fmt.Errorf("no tmux server at %s: %w", socket, err)
 	}
+	return socket, nil
+}
 
-	args := []string{"-S", socket, "capture-pane", "-p"}
-	if target != "" {
-		args = append(args, "-t", target)
+// run executes a tmux command and returns its standard output. Commands
+// targeting a remote pane (-t %host:%3) run over ssh. Others go over the
+// control mode connection when one is active and fork a tmux process
+// otherwise.
+func run(args ...string) (string, error) {
+	r, args, err := routeRemote(args)
+	if err != nil {
+		return "", err
+	}
+	if r != nil {
+		return r.Run(args...)
+	}
+	if c := activeControl(); c != nil {
+		out, err := c.Run(args...)
+		if !errors.Is(err, ErrControlClosed) {
+			return out, err
+		}
+	}
+	socket, err := socketPath()
+	if err != nil {
+		return "", err
 	}
+	args = append([]string{"-S", socket}, args...)
 	debugf("running: tmux %s", strings.Join(args, " "))
 	cmd := exec.Command("tmux", args...)
 	var buf bytes.Buffer
@@ -49,63 +100,427 @@ func CapturePane(target string) (string, error) {
 	return buf.String(), nil
 }
 
+// inServer reports whether grimux runs inside the selected server, so that
+// $TMUX and $TMUX_PANE describe it.
+func inServer() bool {
+	env := envSocket()
+	if env == "" {
+		return false
+	}
+	if !ExplicitServer() {
+		return true
+	}
+	socket, err := socketPath()
+	return err == nil && socket == env
+}
+
+// CurrentPane returns the pane grimux runs in, or "" when it runs outside
+// the selected server.
+func CurrentPane() string {
+	if !inServer() {
+		return ""
+	}
+	return os.Getenv("TMUX_PANE")
+}
+
+// currentTarget fills in the pane grimux runs in when target is empty and
+// commands go over control mode, which has no notion of the calling pane.
+func currentTarget(target string) string {
+	if target == "" && activeControl() != nil {
+		return CurrentPane()
+	}
+	return target
+}
+
+// CapturePane connects to the tmux server over its UNIX socket and captures the
+// contents of the specified pane. If target is empty, the current pane is
+// captured.
+func CapturePane(target string) (string, error) {
+	args := []string{"capture-pane", "-p"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
+	}
+	return run(args...)
+}
+
 // CapturePaneFull grabs the entire scrollback of the pane.
 func CapturePaneFull(target string) (string, error) {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return "", errors.New("TMUX environment variable is not set")
+	args := []string{"capture-pane", "-p", "-J", "-S", "-32768"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
 	}
-	socket := strings.Split(tmuxEnv, ",")[0]
-	args := []string{"-S", socket, "capture-pane", "-p", "-J", "-S", "-32768"}
-	if target != "" {
+	return run(args...)
+}
+
+// CapturePaneANSI is like CapturePane but keeps color and attribute escape
+// sequences.
+func CapturePaneANSI(target string) (string, error) {
+	args := []string{"capture-pane", "-p", "-e"}
+	if target = currentTarget(target); target != "" {
 		args = append(args, "-t", target)
 	}
-	cmd := exec.Command("tmux", args...)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("tmux command: %w", err)
+	return run(args...)
+}
+
+// CapturePaneFullANSI is like CapturePaneFull but keeps escape sequences.
+func CapturePaneFullANSI(target string) (string, error) {
+	args := []string{"capture-pane", "-p", "-e", "-J", "-S", "-32768"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
 	}
-	return buf.String(), nil
+	return run(args...)
+}
+
+// CapturePaneRange captures lines start through end of the pane, where 0 is
+// the first visible line and negative numbers reach into the history.
+// Wrapped lines are joined and escapes are kept when escapes is set.
+func CapturePaneRange(target string, start, end int, escapes bool) (string, error) {
+	args := []string{"capture-pane", "-p", "-J"}
+	if escapes {
+		args = append(args, "-e")
+	}
+	args = append(args, "-S", strconv.Itoa(start), "-E", strconv.Itoa(end))
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
+	}
+	return run(args...)
+}
+
+// PanePosition returns the number of history lines of the pane and the row
+// the cursor is on. Together they give the absolute line of the cursor.
+func PanePosition(target string) (history, cursor int, err error) {
+	args := []string{"display-message", "-p"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
+	}
+	out, err := run(append(args, "#{history_size} #{cursor_y}")...)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := fmt.Sscan(out, &history, &cursor); err != nil {
+		return 0, 0, fmt.Errorf("unexpected pane position %q", strings.TrimSpace(out))
+	}
+	return history, cursor, nil
+}
+
+// PaneDeadStatus reports whether the command of the pane has exited, which
+// tmux keeps showing with remain-on-exit, and its exit status.
+func PaneDeadStatus(target string) (dead bool, status int, err error) {
+	args := []string{"display-message", "-p"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
+	}
+	out, err := run(append(args, "#{pane_dead} #{pane_dead_status}")...)
+	if err != nil {
+		return false, 0, err
+	}
+	f := strings.Fields(out)
+	if len(f) == 0 {
+		return false, 0, fmt.Errorf("unexpected pane state %q", strings.TrimSpace(out))
+	}
+	if f[0] != "1" {
+		return false, 0, nil
+	}
+	if len(f) > 1 {
+		status, _ = strconv.Atoi(f[1])
+	}
+	return true, status, nil
 }
 
 // SendKeys sends the given keys to the specified pane using tmux send-keys.
 // The keys slice is passed as individual arguments to the tmux command.
 func SendKeys(target string, keys ...string) error {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return errors.New("TMUX environment variable is not set")
+	args := []string{"send-keys"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
 	}
-	socket := strings.Split(tmuxEnv, ",")[0]
-	if _, err := os.Stat(socket); err != nil {
-		return fmt.Errorf("tmux socket missing: %w", err)
+	args = append(args, keys...)
+	_, err := run(args...)
+	return err
+}
+
+// SendLiteral types text into the pane as is. Unlike SendKeys, words such
+// as Enter or C-c are not treated as key names.
+func SendLiteral(target, text string) error {
+	args := []string{"send-keys", "-l"}
+	if target = currentTarget(target); target != "" {
+		args = append(args, "-t", target)
+	}
+	_, err := run(append(args, "--", text)...)
+	return err
+}
+
+// pasteBufferName is the temporary buffer PasteText goes through.
+const pasteBufferName = "grimux-paste"
+
+// PasteText pastes data into the pane through a temporary tmux buffer.
+// Applications that enable bracketed paste, such as shells, python or gdb,
+// receive multi-line input in one piece instead of line by line.
+func PasteText(target, data string) error {
+	if r, pane, ok, err := splitRemote(target); ok {
+		if err != nil {
+			return err
+		}
+		if _, err := r.run(strings.NewReader(data), "load-buffer", "-b", pasteBufferName, "-"); err != nil {
+			return err
+		}
+		_, err = r.Run("paste-buffer", "-d", "-p", "-b", pasteBufferName, "-t", pane)
+		return err
+	}
+	if err := SetBuffer(pasteBufferName, data); err != nil {
+		return err
 	}
-	args := []string{"-S", socket, "send-keys"}
-	if target != "" {
+	args := []string{"paste-buffer", "-d", "-p", "-b", pasteBufferName}
+	if target = currentTarget(target); target != "" {
 		args = append(args, "-t", target)
 	}
-	args = append(args, keys...)
-	debugf("running: tmux %s", strings.Join(args, " "))
-	cmd := exec.Command("tmux", args...)
-	return cmd.Run()
+	_, err := run(args...)
+	return err
 }
 
-// ListPaneIDs returns the IDs of all tmux panes.
+// PipePane sends everything the pane prints to the stdin of command, run
+// by the shell. An empty command stops the pipe.
+func PipePane(target, command string) error {
+	if IsRemoteTarget(target) {
+		return errors.New("remote panes cannot be piped")
+	}
+	args := []string{"pipe-pane", "-t", target}
+	if command != "" {
+		args = append(args, command)
+	}
+	_, err := run(args...)
+	return err
+}
+
+// ListPaneIDs returns the IDs of all tmux panes across every session.
 func ListPaneIDs() ([]string, error) {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return nil, errors.New("TMUX environment variable is not set")
+	out, err := run("list-panes", "-a", "-F", "#{pane_id}")
+	if err != nil {
+		return nil, err
 	}
-	socket := strings.Split(tmuxEnv, ",")[0]
-	args := []string{"-S", socket, "list-panes", "-F", "#{pane_id}"}
-	cmd := exec.Command("tmux", args...)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("tmux command: %w", err)
+	return strings.Fields(out), nil
+}
+
+// PaneInfo describes a pane as reported by list-panes. Activity is the last
+// activity in the pane's window since tmux does not track it per pane.
+type PaneInfo struct {
+	ID         string    `json:"id"`
+	Session    string    `json:"session"`
+	Window     int       `json:"window"`
+	WindowName string    `json:"window_name"`
+	Title      string    `json:"title"`
+	Command    string    `json:"command"`
+	Path       string    `json:"path"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Activity   time.Time `json:"activity"`
+	Active     bool      `json:"active"`
+	Label      string    `json:"label,omitempty"`
+	Start      string    `json:"start,omitempty"`
+}
+
+// LabelOption is the pane user option holding labels set with SetPaneLabel.
+const LabelOption = "@grimux_name"
+
+// fieldSep separates fields in list formats. Control mode clients get tabs
+// and other control characters replaced with underscores, so it is plain
+// ASCII.
+const fieldSep = "|;|"
+
+// paneFormat lists the fields parsed by ListPanes. The start command comes
+// last so a separator inside it does not shift the other fields.
+var paneFormat = strings.Join([]string{
+	"#{pane_id}", "#{session_name}", "#{window_index}", "#{window_name}",
+	"#{pane_title}", "#{pane_current_command}", "#{pane_current_path}",
+	"#{pane_width}", "#{pane_height}", "#{window_activity}",
+	"#{&&:#{pane_active},#{window_active}}", "#{" + LabelOption + "}", "#{pane_start_command}",
+}, fieldSep)
+
+// ListPanes returns details about every pane in every session.
+func ListPanes() ([]PaneInfo, error) {
+	out, err := run("list-panes", "-a", "-F", paneFormat)
+	if err != nil {
+		return nil, err
+	}
+	return parsePanes(out), nil
+}
+
+func parsePanes(out string) []PaneInfo {
+	var panes []PaneInfo
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.SplitN(line, fieldSep, 13)
+		if len(f) < 11 {
+			continue
+		}
+		p := PaneInfo{ID: f[0], Session: f[1], WindowName: f[3], Title: f[4], Command: f[5], Path: f[6], Active: f[10] == "1"}
+		p.Window, _ = strconv.Atoi(f[2])
+		p.Width, _ = strconv.Atoi(f[7])
+		p.Height, _ = strconv.Atoi(f[8])
+		if secs, err := strconv.ParseInt(f[9], 10, 64); err == nil && secs > 0 {
+			p.Activity = time.Unix(secs, 0)
+		}
+		if len(f) > 11 {
+			p.Label = f[11]
+		}
+		if len(f) > 12 {
+			p.Start = unquoteCommand(f[12])
+		}
+		panes = append(panes, p)
+	}
+	return panes
+}
+
+// unquoteCommand undoes the quoting tmux adds to #{pane_start_command}.
+func unquoteCommand(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	return s
+}
+
+// SetPaneLabel stores label in the pane's LabelOption. An empty label
+// removes it.
+func SetPaneLabel(target, label string) error {
+	args := []string{"set-option", "-p", "-t", target}
+	if label == "" {
+		args = append(args, "-u", LabelOption)
+	} else {
+		args = append(args, LabelOption, label)
+	}
+	_, err := run(args...)
+	return err
+}
+
+// SplitOptions controls SplitWindow. Target defaults to the current pane.
+// Horizontal places the new pane beside the target instead of below it and
+// Before puts it left of or above the target.
+type SplitOptions struct {
+	Target     string
+	Horizontal bool
+	Before     bool
+	Dir        string
+	Command    string
+}
+
+// SplitWindow splits a pane without moving focus and returns the id of the
+// new pane.
+func SplitWindow(opts SplitOptions) (string, error) {
+	args := []string{"split-window", "-d", "-P", "-F", "#{pane_id}"}
+	if opts.Horizontal {
+		args = append(args, "-h")
+	} else {
+		args = append(args, "-v")
 	}
-	out := strings.Fields(buf.String())
-	return out, nil
+	if opts.Before {
+		args = append(args, "-b")
+	}
+	if target := currentTarget(opts.Target); target != "" {
+		args = append(args, "-t", target)
+	}
+	if opts.Dir != "" {
+		args = append(args, "-c", opts.Dir)
+	}
+	if opts.Command != "" {
+		args = append(args, opts.Command)
+	}
+	out, err := run(args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// NewWindow creates a background window in the current session and returns
+// the id of its pane.
+func NewWindow(name, dir, command string) (string, error) {
+	args := []string{"new-window", "-d", "-P", "-F", "#{pane_id}"}
+	if target := currentTarget(""); target != "" {
+		args = append(args, "-t", target)
+	}
+	if name != "" {
+		args = append(args, "-n", name)
+	}
+	if dir != "" {
+		args = append(args, "-c", dir)
+	}
+	if command != "" {
+		args = append(args, command)
+	}
+	out, err := run(args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// SelectLayout applies a layout name or a layout string saved from
+// #{window_layout} to the window containing target.
+func SelectLayout(target, layout string) error {
+	_, err := run("select-layout", "-t", target, layout)
+	return err
+}
+
+// SetPaneTitle sets the title of target.
+func SetPaneTitle(target, title string) error {
+	_, err := run("select-pane", "-t", target, "-T", title)
+	return err
+}
+
+// CurrentSession returns the name of the session grimux runs in.
+func CurrentSession() (string, error) {
+	args := []string{"display-message", "-p"}
+	if pane := CurrentPane(); pane != "" {
+		args = append(args, "-t", pane)
+	}
+	out, err := run(append(args, "#{session_name}")...)
+	return strings.TrimSpace(out), err
+}
+
+// WindowInfo describes a window and its layout string.
+type WindowInfo struct {
+	Index  int    `json:"index"`
+	Name   string `json:"name"`
+	Layout string `json:"layout"`
+	Active bool   `json:"active"`
+}
+
+// windowFormat lists the fields parsed by ListWindows, name last.
+var windowFormat = strings.Join([]string{"#{window_index}", "#{window_active}", "#{window_layout}", "#{window_name}"}, fieldSep)
+
+// ListWindows returns the windows of session in index order.
+func ListWindows(session string) ([]WindowInfo, error) {
+	out, err := run("list-windows", "-t", session, "-F", windowFormat)
+	if err != nil {
+		return nil, err
+	}
+	var wins []WindowInfo
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.SplitN(line, fieldSep, 4)
+		if len(f) < 4 {
+			continue
+		}
+		w := WindowInfo{Name: f[3], Layout: f[2], Active: f[1] == "1"}
+		w.Index, _ = strconv.Atoi(f[0])
+		wins = append(wins, w)
+	}
+	return wins, nil
+}
+
+// KillPane closes the target pane.
+func KillPane(target string) error {
+	_, err := run("kill-pane", "-t", target)
+	return err
+}
+
+// SelectPane focuses target, switching to its window first.
+func SelectPane(target string) error {
+	if _, err := run("select-window", "-t", target); err != nil {
+		return err
+	}
+	_, err := run("select-pane", "-t", target)
+	return err
 }
 
 // BufferInfo contains the name and size of a tmux buffer.
@@ -116,19 +531,11 @@ type BufferInfo struct {
 
 // ListBuffers returns information about all tmux buffers.
 func ListBuffers() ([]BufferInfo, error) {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return nil, errors.New("TMUX environment variable is not set")
+	out, err := run("list-buffers", "-F", "#{buffer_name}|#{buffer_size}")
+	if err != nil {
+		return nil, err
 	}
-	socket := strings.Split(tmuxEnv, ",")[0]
-	args := []string{"-S", socket, "list-buffers", "-F", "#{buffer_name}|#{buffer_size}"}
-	cmd := exec.Command("tmux", args...)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("tmux command: %w", err)
-	}
-	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
 	infos := make([]BufferInfo, 0, len(lines))
 	for _, line := range lines {
 		if line == "" {
@@ -147,31 +554,20 @@ func ListBuffers() ([]BufferInfo, error) {
 
 // ShowBuffer returns the contents of the specified tmux buffer.
 func ShowBuffer(name string) (string, error) {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return "", errors.New("TMUX environment variable is not set")
-	}
-	socket := strings.Split(tmuxEnv, ",")[0]
-	args := []string{"-S", socket, "show-buffer"}
+	args := []string{"show-buffer"}
 	if name != "" {
 		args = append(args, "-b", name)
 	}
-	cmd := exec.Command("tmux", args...)
-	var buf bytes.Buffer
-	cmd.Stdout = &buf
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("tmux command: %w", err)
-	}
-	return buf.String(), nil
+	return run(args...)
 }
 
-// SetBuffer stores data into a named tmux buffer.
+// SetBuffer stores data into a named tmux buffer. The data is streamed on
+// stdin so this always forks a tmux process.
 func SetBuffer(name, data string) error {
-	tmuxEnv := os.Getenv("TMUX")
-	if tmuxEnv == "" {
-		return errors.New("TMUX environment variable is not set")
+	socket, err := socketPath()
+	if err != nil {
+		return err
 	}
-	socket := strings.Split(tmuxEnv, ",")[0]
 	args := []string{"-S", socket, "load-buffer"}
 	if name != "" {
 		args = append(args, "-b", name)
@@ -181,3 +577,78 @@ func SetBuffer(name, data string) error {
 	cmd.Stdin = strings.NewReader(data)
 	return cmd.Run()
 }
+
+// versionPattern finds the release in tmux -V output such as "tmux 3.3a" or
+// "tmux next-3.4".
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// Version returns the version of the tmux binary. Builds without a release
+// number, like "tmux master", are reported as 99.0.
+func Version() (major, minor int, err error) {
+	out, err := exec.Command("tmux", "-V").Output()
+	if err != nil {
+		return 0, 0, fmt.Errorf("tmux -V: %w", err)
+	}
+	major, minor = parseVersion(string(out))
+	return major, minor, nil
+}
+
+func parseVersion(s string) (major, minor int) {
+	m := versionPattern.FindStringSubmatch(s)
+	if m == nil {
+		return 99, 0
+	}
+	major, _ = strconv.Atoi(m[1])
+	minor, _ = strconv.Atoi(m[2])
+	return major, minor
+}
+
+// PopupOptions controls DisplayPopup. Target picks the client showing that
+// pane; Width and Height take tmux sizes such as 80%.
+type PopupOptions struct {
+	Target  string
+	Title   string
+	Dir     string
+	Width   string
+	Height  string
+	Command string
+}
+
+// DisplayPopup runs a shell command in a popup (tmux 3.2 or later) and waits
+// until it exits. Popups belong to a client, which control mode connections
+// do not have, so this always forks a tmux process.
+func DisplayPopup(opts PopupOptions) error {
+	socket, err := socketPath()
+	if err != nil {
+		return err
+	}
+	args := []string{"-S", socket, "display-popup", "-E"}
+	if opts.Target != "" {
+		args = append(args, "-t", opts.Target)
+	}
+	if opts.Title != "" {
+		// the title is a format, so # has to be doubled
+		args = append(args, "-T", " "+strings.ReplaceAll(opts.Title, "#", "##")+" ")
+	}
+	if opts.Dir != "" {
+		args = append(args, "-d", opts.Dir)
+	}
+	if opts.Width != "" {
+		args = append(args, "-w", opts.Width)
+	}
+	if opts.Height != "" {
+		args = append(args, "-h", opts.Height)
+	}
+	args = append(args, opts.Command)
+	debugf("running: tmux %s", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.Command("tmux", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("display-popup: %s", msg)
+		}
+		return fmt.Errorf("display-popup: %w", err)
+	}
+	return nil
+}
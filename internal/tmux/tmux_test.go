@@ -1,10 +1,13 @@
 package tmux
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -81,6 +84,25 @@ func TestCapturePaneCurrent(t *testing.T) {
 	}
 }
 
+func TestCapturePaneANSI(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "\x1b[31mred\x1b[0m\n")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",session")
+
+	if _, err := CapturePaneFullANSI("%2"); err != nil {
+		t.Fatalf("CapturePaneFullANSI: %v", err)
+	}
+	b, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	args := string(bytes.TrimSpace(b))
+	expected := fmt.Sprintf("-S %s capture-pane -p -e -J -S -32768 -t %s", sock, "%2")
+	if args != expected {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
+
 func TestSendKeys(t *testing.T) {
 	sock, argsFile, cleanup := startFakeTmux(t, "")
 	defer cleanup()
@@ -101,6 +123,44 @@ func TestSendKeys(t *testing.T) {
 	}
 }
 
+func TestSendLiteral(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",session")
+
+	if err := SendLiteral("%2", "Enter"); err != nil {
+		t.Fatalf("SendLiteral: %v", err)
+	}
+	b, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	args := string(bytes.TrimSpace(b))
+	expected := fmt.Sprintf("-S %s send-keys -l -t %s -- Enter", sock, "%2")
+	if args != expected {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
+
+func TestPasteText(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",session")
+
+	if err := PasteText("%2", "def f():\n    pass\n"); err != nil {
+		t.Fatalf("PasteText: %v", err)
+	}
+	b, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	args := string(bytes.TrimSpace(b))
+	expected := fmt.Sprintf("-S %s paste-buffer -d -p -b grimux-paste -t %s", sock, "%2")
+	if args != expected {
+		t.Fatalf("unexpected args: %q", args)
+	}
+}
+
 func TestListBuffers(t *testing.T) {
 	sock, argsFile, cleanup := startFakeTmux(t, "buf1|5\nbuf2|3\n")
 	defer cleanup()
@@ -159,3 +219,268 @@ func TestSetBuffer(t *testing.T) {
 		t.Fatalf("unexpected args: %q", args)
 	}
 }
+
+// fakeControl wires a Control to pipes so tests can play the tmux side.
+func fakeControl(t *testing.T) (*Control, *bufio.Reader, io.WriteCloser) {
+	t.Helper()
+	cmdR, cmdW := io.Pipe()
+	outR, outW := io.Pipe()
+	c := newControl(outR, cmdW)
+	t.Cleanup(func() { outW.Close(); cmdR.Close() })
+	return c, bufio.NewReader(cmdR), outW
+}
+
+func TestControlRun(t *testing.T) {
+	c, cmds, out := fakeControl(t)
+	// output from the initial attach is not a reply to our commands
+	go io.WriteString(out, "%begin 1 10 0\n%end 1 10 0\n")
+
+	done := make(chan string)
+	go func() {
+		res, err := c.Run("capture-pane", "-p", "-t", "%1")
+		if err != nil {
+			t.Errorf("Run: %v", err)
+		}
+		done <- res
+	}()
+	line, _ := cmds.ReadString('\n')
+	if line != "\"capture-pane\" \"-p\" \"-t\" \"%1\"\n" {
+		t.Fatalf("unexpected command line: %q", line)
+	}
+	io.WriteString(out, "%output %1 hi\\015\\012\n%begin 2 11 1\nline one\n%end 2 11 1\n")
+	if got := <-done; got != "line one\n" {
+		t.Fatalf("unexpected reply: %q", got)
+	}
+
+	go func() {
+		_, err := c.Run("bogus")
+		done <- fmt.Sprint(err)
+	}()
+	cmds.ReadString('\n')
+	io.WriteString(out, "%begin 3 12 1\nparse error: unknown command: bogus\n%error 3 12 1\n")
+	if got := <-done; !strings.Contains(got, "unknown command") {
+		t.Fatalf("expected error, got %q", got)
+	}
+}
+
+func TestControlEvents(t *testing.T) {
+	c, _, out := fakeControl(t)
+	events := make(chan Event, 4)
+	cancel := c.Subscribe(func(ev Event) { events <- ev })
+	io.WriteString(out, "%output %3 a\\134b\\033[0m\\012\n%window-add @4\n")
+	ev := <-events
+	if ev.Name != "output" || ev.Pane != "%3" || ev.Data != "a\\b\033[0m\n" {
+		t.Fatalf("unexpected output event: %+v", ev)
+	}
+	ev = <-events
+	if ev.Name != "window-add" || len(ev.Args) != 1 || ev.Args[0] != "@4" {
+		t.Fatalf("unexpected window event: %+v", ev)
+	}
+	cancel()
+	out.Close()
+	<-c.done
+	if _, err := c.Run("list-panes"); err != ErrControlClosed {
+		t.Fatalf("expected closed error, got %v", err)
+	}
+}
+
+func TestParseEventPane(t *testing.T) {
+	ev := ParseEvent("%window-pane-changed @1 %5")
+	if ev.Name != "window-pane-changed" || ev.Pane != "%5" {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+}
+
+func TestListPanes(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, strings.ReplaceAll("%1\tmain\t2\teditor\thost\tvim\t/src\t120\t40\t1700000000\t1\n%7\tops\t0\tlogs\t\ttail\t/var/log\t80\t24\t0\t0\n", "\t", fieldSep))
+	defer cleanup()
+	os.Setenv("TMUX", sock+",s")
+
+	panes, err := ListPanes()
+	if err != nil {
+		t.Fatalf("ListPanes: %v", err)
+	}
+	if len(panes) != 2 {
+		t.Fatalf("unexpected panes: %+v", panes)
+	}
+	p := panes[0]
+	if p.ID != "%1" || p.Session != "main" || p.Window != 2 || p.WindowName != "editor" || p.Command != "vim" || p.Path != "/src" || p.Width != 120 || p.Height != 40 || !p.Active || p.Activity.Unix() != 1700000000 {
+		t.Fatalf("unexpected pane: %+v", p)
+	}
+	if panes[1].Active || !panes[1].Activity.IsZero() {
+		t.Fatalf("unexpected second pane: %+v", panes[1])
+	}
+
+	b, _ := os.ReadFile(argsFile)
+	if !strings.HasPrefix(string(b), fmt.Sprintf("-S %s list-panes -a -F #{pane_id}", sock)) {
+		t.Fatalf("unexpected args: %q", b)
+	}
+}
+
+func TestSetPaneLabel(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",s")
+
+	if err := SetPaneLabel("%3", "web"); err != nil {
+		t.Fatalf("SetPaneLabel: %v", err)
+	}
+	b, _ := os.ReadFile(argsFile)
+	if got := string(bytes.TrimSpace(b)); got != fmt.Sprintf("-S %s set-option -p -t %%3 @grimux_name web", sock) {
+		t.Fatalf("unexpected args: %q", got)
+	}
+}
+
+// startFakeSSH puts an "ssh" script on PATH for the rest of the test that
+// records its arguments, prints output and exits with code, writing stderr
+// to standard error. Remotes removed by deferred calls still reach it.
+func startFakeSSH(t *testing.T, output, stderr string, code int) (argsFile string) {
+	t.Helper()
+	tmp := t.TempDir()
+	argsFile = filepath.Join(tmp, "args")
+	script := fmt.Sprintf("#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > %s\nprintf '%%s' '%s'\nprintf '%%s' '%s' >&2\nexit %d\n", argsFile, output, stderr, code)
+	if err := os.WriteFile(filepath.Join(tmp, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+	t.Setenv("PATH", tmp+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return argsFile
+}
+
+func TestRemoteCapture(t *testing.T) {
+	argsFile := startFakeSSH(t, "remote screen", "", 0)
+	if err := AddRemote("jump", "op@10.0.0.5", "/tmp/ops.sock"); err != nil {
+		t.Fatalf("AddRemote: %v", err)
+	}
+	defer RemoveRemote("jump")
+
+	got, err := CapturePane("%jump:%3")
+	if err != nil || got != "remote screen" {
+		t.Fatalf("CapturePane: %q %v", got, err)
+	}
+	b, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	args := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if !strings.Contains(string(b), "ControlMaster=auto") || args[len(args)-3] != "--" || args[len(args)-2] != "op@10.0.0.5" {
+		t.Fatalf("unexpected ssh args: %q", args)
+	}
+	want := "tmux -S '/tmp/ops.sock' 'capture-pane' '-p' '-t' '%3'"
+	if args[len(args)-1] != want {
+		t.Fatalf("unexpected remote command: %q", args[len(args)-1])
+	}
+	if _, err := CapturePane("%nowhere:%3"); err == nil || !strings.Contains(err.Error(), "unknown remote") {
+		t.Fatalf("expected unknown remote error, got %v", err)
+	}
+	if err := AddRemote("evil", "-oProxyCommand=touch /tmp/pwned", ""); err == nil {
+		t.Fatalf("host starting with - accepted")
+	}
+}
+
+func TestRemoteErrors(t *testing.T) {
+	tests := []struct {
+		stderr string
+		code   int
+		want   string
+	}{
+		{"sh: 1: tmux: not found", 127, "tmux is not installed on box"},
+		{"no server running on /tmp/tmux-0/default", 1, "no tmux server running on box"},
+		{"ssh: connect to host box port 22: Connection refused", 255, "ssh box failed: ssh: connect to host box port 22: Connection refused"},
+	}
+	for _, tt := range tests {
+		startFakeSSH(t, "", tt.stderr, tt.code)
+		AddRemote("box", "box", "")
+		_, err := CapturePane("%box:%1")
+		RemoveRemote("box")
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("stderr %q: got %v, want %q", tt.stderr, err, tt.want)
+		}
+	}
+}
+
+func TestListWindows(t *testing.T) {
+	sock, _, cleanup := startFakeTmux(t, "0|;|1|;|b25f,80x24,0,0,1|;|main\n2|;|0|;|c3a1,80x24,0,0,4|;|a|;|b\n")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",s")
+
+	wins, err := ListWindows("s")
+	if err != nil {
+		t.Fatalf("ListWindows: %v", err)
+	}
+	if len(wins) != 2 || wins[0].Name != "main" || !wins[0].Active || wins[1].Index != 2 || wins[1].Name != "a|;|b" || wins[1].Layout != "c3a1,80x24,0,0,4" {
+		t.Fatalf("unexpected windows: %+v", wins)
+	}
+}
+
+func TestExplicitServer(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "hi\n")
+	defer cleanup()
+	t.Setenv("TMUX", "")
+	t.Setenv("TMUX_PANE", "")
+	defer func() { Socket, SocketName = "", "" }()
+
+	if _, err := CapturePane("%1"); err == nil || !strings.Contains(err.Error(), "not inside tmux") {
+		t.Fatalf("expected not inside tmux error, got %v", err)
+	}
+
+	Socket = sock
+	if _, err := CapturePane("%1"); err != nil {
+		t.Fatalf("CapturePane: %v", err)
+	}
+	b, _ := os.ReadFile(argsFile)
+	if got := string(bytes.TrimSpace(b)); got != "-S "+sock+" capture-pane -p -t %1" {
+		t.Fatalf("unexpected args: %q", got)
+	}
+
+	// a pane of another server must not be used as the current pane
+	t.Setenv("TMUX", "/tmp/other.sock,1,0")
+	t.Setenv("TMUX_PANE", "%7")
+	if p := CurrentPane(); p != "" {
+		t.Fatalf("unexpected current pane %q", p)
+	}
+	t.Setenv("TMUX", sock+",1,0")
+	if p := CurrentPane(); p != "%7" {
+		t.Fatalf("unexpected current pane %q", p)
+	}
+
+	Socket, SocketName = "", "work"
+	dir := t.TempDir()
+	t.Setenv("TMUX_TMPDIR", dir)
+	want := filepath.Join(dir, fmt.Sprintf("tmux-%d", os.Getuid()), "work")
+	if _, err := CapturePane("%1"); err == nil || !strings.Contains(err.Error(), "no tmux server at "+want) {
+		t.Fatalf("expected missing server at %s, got %v", want, err)
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in           string
+		major, minor int
+	}{
+		{"tmux 3.3a\n", 3, 3},
+		{"tmux next-3.4\n", 3, 4},
+		{"tmux 2.9\n", 2, 9},
+		{"tmux master\n", 99, 0},
+	}
+	for _, tt := range tests {
+		if major, minor := parseVersion(tt.in); major != tt.major || minor != tt.minor {
+			t.Errorf("%q: got %d.%d", tt.in, major, minor)
+		}
+	}
+}
+
+func TestDisplayPopup(t *testing.T) {
+	sock, argsFile, cleanup := startFakeTmux(t, "")
+	defer cleanup()
+	os.Setenv("TMUX", sock+",s")
+
+	err := DisplayPopup(PopupOptions{Target: "%2", Title: "#notes", Width: "80%", Command: "less /tmp/x"})
+	if err != nil {
+		t.Fatalf("DisplayPopup: %v", err)
+	}
+	b, _ := os.ReadFile(argsFile)
+	want := fmt.Sprintf("-S %s display-popup -E -t %%2 -T  ##notes  -w 80%% less /tmp/x", sock)
+	if got := string(bytes.TrimSpace(b)); got != want {
+		t.Fatalf("unexpected args: %q", got)
+	}
+}